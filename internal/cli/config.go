@@ -0,0 +1,332 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables setting flags, such as READIUM_S3_REGION
+const envPrefix = "READIUM_"
+
+// Suffix of the environment variables and configuration keys giving the path
+// of a file containing the value of a flag, such as READIUM_S3_SECRET_KEY_FILE
+const fileSuffix = "_FILE"
+
+// Annotation of the flags whose value must not be shown
+const secretAnnotation = "readium_secret"
+
+// Flags that can't be set in a configuration file
+var configExcludedFlags = []string{"config", "print-config", "help"}
+
+// Value of a flag in a configuration file
+type configEntry struct {
+	key    string
+	values []string // Several values for lists
+	list   bool
+	line   int // Line of the key in the file, if known
+}
+
+// Mark flags of a command as secrets, masked when printing the configuration.
+func markSecretFlags(cmd *cobra.Command, names ...string) {
+	for _, name := range names {
+		cmd.Flags().SetAnnotation(name, secretAnnotation, []string{"true"})
+	}
+}
+
+func isSecretFlag(f *pflag.Flag) bool {
+	_, ok := f.Annotations[secretAnnotation]
+	return ok
+}
+
+// Name of the environment variable setting a flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// Read a value from a file, such as a secret mounted by an orchestrator.
+// A trailing newline is ignored.
+func readValueFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// Read the entries of a YAML, JSON or TOML configuration file, depending on
+// its extension. Keys of nested tables are joined with a dash, so that
+// `s3: {region: auto}` sets the s3-region flag.
+func readConfigFile(path string) ([]configEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []configEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			return nil, nil
+		}
+		return flattenYAML(doc.Content[0], "", entries)
+	case ".toml":
+		var doc map[string]any
+		if _, err := toml.Decode(string(b), &doc); err != nil {
+			return nil, err
+		}
+		return flattenTOML(doc, "", entries)
+	default:
+		return nil, fmt.Errorf("unsupported format %q, expected .yaml, .yml, .json or .toml", filepath.Ext(path))
+	}
+}
+
+func joinKey(prefix, key string) string {
+	key = strings.ReplaceAll(key, "_", "-")
+	if prefix == "" {
+		return key
+	}
+	return prefix + "-" + key
+}
+
+func flattenYAML(node *yaml.Node, prefix string, entries []configEntry) ([]configEntry, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of keys to values", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		key := joinKey(prefix, k.Value)
+		var err error
+		switch v.Kind {
+		case yaml.MappingNode:
+			entries, err = flattenYAML(v, key, entries)
+			if err != nil {
+				return nil, err
+			}
+		case yaml.SequenceNode:
+			entry := configEntry{key: key, list: true, line: k.Line, values: []string{}}
+			for _, item := range v.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("line %d: key %q: expected a list of values", item.Line, key)
+				}
+				entry.values = append(entry.values, item.Value)
+			}
+			entries = append(entries, entry)
+		case yaml.ScalarNode:
+			entries = append(entries, configEntry{key: key, values: []string{v.Value}, line: k.Line})
+		default:
+			return nil, fmt.Errorf("line %d: key %q: unsupported value", k.Line, key)
+		}
+	}
+	return entries, nil
+}
+
+func tomlScalar(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case time.Time:
+		return v.Format(time.RFC3339), true
+	default:
+		return "", false
+	}
+}
+
+func flattenTOML(table map[string]any, prefix string, entries []configEntry) ([]configEntry, error) {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		key := joinKey(prefix, k)
+		var err error
+		switch v := table[k].(type) {
+		case map[string]any:
+			entries, err = flattenTOML(v, key, entries)
+			if err != nil {
+				return nil, err
+			}
+		case []any:
+			entry := configEntry{key: key, list: true, values: []string{}}
+			for _, item := range v {
+				s, ok := tomlScalar(item)
+				if !ok {
+					return nil, fmt.Errorf("key %q: expected a list of values", key)
+				}
+				entry.values = append(entry.values, s)
+			}
+			entries = append(entries, entry)
+		default:
+			s, ok := tomlScalar(v)
+			if !ok {
+				return nil, fmt.Errorf("key %q: unsupported value", key)
+			}
+			entries = append(entries, configEntry{key: key, values: []string{s}})
+		}
+	}
+	return entries, nil
+}
+
+// Set a flag from the values of a configuration entry or an environment variable.
+func setFlag(fs *pflag.FlagSet, f *pflag.Flag, values []string, list bool) error {
+	if sv, ok := f.Value.(pflag.SliceValue); ok && list {
+		if err := sv.Replace(values); err != nil {
+			return err
+		}
+		f.Changed = true
+		return nil
+	}
+	if list {
+		return fmt.Errorf("expected a single value, not a list")
+	}
+	return fs.Set(f.Name, values[0])
+}
+
+// Set the flags of a command that weren't given on the command line from the
+// environment (READIUM_<FLAG> or READIUM_<FLAG>_FILE), then from the
+// configuration file given with --config, if any.
+func loadConfig(cmd *cobra.Command) error {
+	fs := cmd.Flags()
+
+	// Environment variables
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || (f.Name != "config" && slices.Contains(configExcludedFlags, f.Name)) {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if path, fok := os.LookupEnv(name + fileSuffix); fok {
+			if ok {
+				err = fmt.Errorf("environment variables %s and %s can't both be set", name, name+fileSuffix)
+				return
+			}
+			if value, err = readValueFile(path); err != nil {
+				err = fmt.Errorf("environment variable %s: %w", name+fileSuffix, err)
+				return
+			}
+			name, ok = name+fileSuffix, true
+		}
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("environment variable %s: invalid value for --%s: %w", name, f.Name, serr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Configuration file
+	configFile, _ := fs.GetString("config")
+	if configFile == "" {
+		return nil
+	}
+	entries, err := readConfigFile(configFile)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", configFile, err)
+	}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		where := fmt.Sprintf("config file %s", configFile)
+		if entry.line > 0 {
+			where += fmt.Sprintf(", line %d", entry.line)
+		}
+
+		key, fromFile := entry.key, false
+		f := fs.Lookup(key)
+		if f == nil {
+			if base, ok := strings.CutSuffix(key, "-file"); ok {
+				f, fromFile = fs.Lookup(base), true
+			}
+		}
+		if f == nil || slices.Contains(configExcludedFlags, f.Name) {
+			return fmt.Errorf("%s: unknown key %q", where, key)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("%s: key %q: --%s is already set", where, key, f.Name)
+		}
+		seen[f.Name] = true
+		if f.Changed {
+			continue // The command line and the environment take precedence
+		}
+
+		values := entry.values
+		if fromFile {
+			if entry.list {
+				return fmt.Errorf("%s: key %q: expected the path of a file", where, key)
+			}
+			value, err := readValueFile(values[0])
+			if err != nil {
+				return fmt.Errorf("%s: key %q: %w", where, key, err)
+			}
+			values = []string{value}
+		}
+		if err := setFlag(fs, f, values, entry.list); err != nil {
+			return fmt.Errorf("%s: key %q: invalid value for --%s: %w", where, key, f.Name, err)
+		}
+	}
+	return nil
+}
+
+// Print the effective configuration of a command in YAML, with the value of
+// each of its flags, and secrets masked.
+func printConfig(cmd *cobra.Command) error {
+	config := make(map[string]any)
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if slices.Contains(configExcludedFlags, f.Name) {
+			return
+		}
+		if isSecretFlag(f) {
+			if f.Value.String() != "" {
+				config[f.Name] = "********"
+			} else {
+				config[f.Name] = ""
+			}
+			return
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			config[f.Name] = sv.GetSlice()
+			return
+		}
+		switch f.Value.Type() {
+		case "bool":
+			config[f.Name], _ = strconv.ParseBool(f.Value.String())
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+			config[f.Name], _ = strconv.ParseInt(f.Value.String(), 10, 64)
+		case "float32", "float64":
+			config[f.Name], _ = strconv.ParseFloat(f.Value.String(), 64)
+		default:
+			config[f.Name] = f.Value.String()
+		}
+	})
+
+	enc := yaml.NewEncoder(cmd.OutOrStdout())
+	enc.SetIndent(2)
+	if err := enc.Encode(config); err != nil {
+		return err
+	}
+	return enc.Close()
+}
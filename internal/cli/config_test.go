@@ -0,0 +1,247 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Command with flags of each kind, parsed from args, then configured with
+// loadConfig.
+func newTestConfigCommand(t *testing.T, args ...string) (*cobra.Command, error) {
+	t.Helper()
+	cmd := &cobra.Command{Use: "test"}
+	fs := cmd.Flags()
+	fs.String("config", "", "")
+	fs.Bool("print-config", false, "")
+	fs.String("s3-region", "", "")
+	fs.String("s3-secret-key", "", "")
+	fs.StringSlice("cors-origins", nil, "")
+	fs.Bool("debug", false, "")
+	fs.Uint16("port", 15080, "")
+	fs.Duration("timeout", 0, "")
+	markSecretFlags(cmd, "s3-secret-key")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, loadConfig(cmd)
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	secret := writeTestFile(t, "secret", "from-secret-file\n")
+	yamlConfig := writeTestFile(t, "config.yaml", `
+s3:
+  region: file-region
+  secret_key_file: `+secret+`
+cors-origins: [https://a.example.com, https://b.example.com]
+debug: true
+port: 8080
+timeout: 30s
+`)
+	tomlConfig := writeTestFile(t, "config.toml", `
+cors-origins = ["https://a.example.com"]
+port = 8080
+
+[s3]
+region = "file-region"
+`)
+	jsonConfig := writeTestFile(t, "config.json", `{"s3": {"region": "file-region"}, "debug": true}`)
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected map[string]string
+	}{
+		{
+			"defaults",
+			nil, nil,
+			map[string]string{"s3-region": "", "cors-origins": "[]", "debug": "false", "port": "15080"},
+		},
+		{
+			"YAML file",
+			[]string{"--config", yamlConfig}, nil,
+			map[string]string{
+				"s3-region":     "file-region",
+				"s3-secret-key": "from-secret-file",
+				"cors-origins":  "[https://a.example.com,https://b.example.com]",
+				"debug":         "true",
+				"port":          "8080",
+				"timeout":       "30s",
+			},
+		},
+		{
+			"TOML file",
+			[]string{"--config", tomlConfig}, nil,
+			map[string]string{"s3-region": "file-region", "cors-origins": "[https://a.example.com]", "port": "8080"},
+		},
+		{
+			"JSON file",
+			[]string{"--config", jsonConfig}, nil,
+			map[string]string{"s3-region": "file-region", "debug": "true"},
+		},
+		{
+			"environment",
+			nil,
+			map[string]string{"READIUM_S3_REGION": "env-region", "READIUM_CORS_ORIGINS": "https://c.example.com,https://d.example.com"},
+			map[string]string{"s3-region": "env-region", "cors-origins": "[https://c.example.com,https://d.example.com]"},
+		},
+		{
+			"environment file",
+			nil,
+			map[string]string{"READIUM_S3_SECRET_KEY_FILE": secret},
+			map[string]string{"s3-secret-key": "from-secret-file"},
+		},
+		{
+			"environment over file",
+			[]string{"--config", yamlConfig},
+			map[string]string{"READIUM_S3_REGION": "env-region", "READIUM_PORT": "9090", "READIUM_CORS_ORIGINS": "https://c.example.com"},
+			map[string]string{"s3-region": "env-region", "port": "9090", "cors-origins": "[https://c.example.com]", "debug": "true"},
+		},
+		{
+			"flags over environment and file",
+			[]string{"--config", yamlConfig, "--s3-region", "flag-region", "--debug=false", "--cors-origins", "https://e.example.com"},
+			map[string]string{"READIUM_S3_REGION": "env-region"},
+			map[string]string{"s3-region": "flag-region", "debug": "false", "cors-origins": "[https://e.example.com]", "port": "8080"},
+		},
+		{
+			"config file from the environment",
+			nil,
+			map[string]string{"READIUM_CONFIG": tomlConfig},
+			map[string]string{"s3-region": "file-region", "port": "8080"},
+		},
+		{
+			"excluded flags aren't read from the environment",
+			nil,
+			map[string]string{"READIUM_PRINT_CONFIG": "true"},
+			map[string]string{"print-config": "false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cmd, err := newTestConfigCommand(t, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, expected := range tt.expected {
+				if got := cmd.Flags().Lookup(name).Value.String(); got != expected {
+					t.Errorf("--%s: got %q, expected %q", name, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	secret := writeTestFile(t, "secret", "secret")
+	tests := []struct {
+		name  string
+		file  string // Content of a config.yaml file, if any
+		env   map[string]string
+		error string
+	}{
+		{"unknown key", "s3-bucket: books", nil, `line 1: unknown key "s3-bucket"`},
+		{"excluded key", "print-config: true", nil, `unknown key "print-config"`},
+		{"nested excluded key", "print:\n  config: true", nil, `unknown key "print-config"`},
+		{"duplicate key", "s3-region: a\ns3:\n  region: b", nil, `line 3: key "s3-region": --s3-region is already set`},
+		{"duplicate file key", "s3-secret-key: a\ns3-secret-key-file: " + secret, nil, "--s3-secret-key is already set"},
+		{"list for a single value", "s3-region: [a, b]", nil, "expected a single value, not a list"},
+		{"list of files", "s3-secret-key-file: [a]", nil, "expected the path of a file"},
+		{"missing value file", "s3-secret-key-file: /nonexistent", nil, `key "s3-secret-key-file"`},
+		{"invalid value", "port: http", nil, `line 1: key "port": invalid value for --port`},
+		{"nested list", "cors-origins: [[a]]", nil, "expected a list of values"},
+		{"not a mapping", "- a", nil, "expected a mapping of keys to values"},
+		{"invalid environment value", "", map[string]string{"READIUM_DEBUG": "maybe"}, "environment variable READIUM_DEBUG: invalid value for --debug"},
+		{
+			"environment value and file",
+			"",
+			map[string]string{"READIUM_S3_REGION": "a", "READIUM_S3_REGION_FILE": secret},
+			"READIUM_S3_REGION and READIUM_S3_REGION_FILE can't both be set",
+		},
+		{"missing environment file", "", map[string]string{"READIUM_S3_REGION_FILE": "/nonexistent"}, "environment variable READIUM_S3_REGION_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var args []string
+			if tt.file != "" {
+				args = []string{"--config", writeTestFile(t, "config.yaml", tt.file)}
+			}
+			_, err := newTestConfigCommand(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("got error %v, expected %q", err, tt.error)
+			}
+		})
+	}
+
+	if _, err := newTestConfigCommand(t, "--config", writeTestFile(t, "config.ini", "")); err == nil || !strings.Contains(err.Error(), "unsupported format") {
+		t.Errorf("got error %v for an unsupported format", err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for flag, expected := range map[string]string{
+		"debug":                 "READIUM_DEBUG",
+		"s3-region":             "READIUM_S3_REGION",
+		"remote-archive-cache":  "READIUM_REMOTE_ARCHIVE_CACHE",
+		"iiif-cache-size":       "READIUM_IIIF_CACHE_SIZE",
+		"jwt-shared-secret":     "READIUM_JWT_SHARED_SECRET",
+		"introspection-timeout": "READIUM_INTROSPECTION_TIMEOUT",
+	} {
+		if got := envName(flag); got != expected {
+			t.Errorf("%s: got %s, expected %s", flag, got, expected)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	t.Setenv("READIUM_S3_SECRET_KEY", "hunter2")
+	cmd, err := newTestConfigCommand(t, "--port", "8080", "--cors-origins", "https://a.example.com", "--debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	if err := printConfig(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") {
+		t.Error("secret printed")
+	}
+
+	var config map[string]any
+	if err := yaml.Unmarshal(out.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{
+		"s3-region":     "",
+		"s3-secret-key": "********",
+		"cors-origins":  []any{"https://a.example.com"},
+		"debug":         true,
+		"port":          8080,
+		"timeout":       "0s",
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("got %v, expected %v", config, expected)
+	}
+}
@@ -1 +1,109 @@
 package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/helpers"
+	"github.com/readium/go-toolkit/pkg/asset"
+	"github.com/readium/go-toolkit/pkg/streamer"
+	"github.com/readium/go-toolkit/pkg/util/url"
+	"github.com/spf13/cobra"
+)
+
+// Href of the resource of the reading order to output the guided navigation document of.
+var guidedNavigationResourceFlag string
+
+var guidedNavigationCmd = &cobra.Command{
+	Use:   "guided-navigation <pub-path>",
+	Short: "Generate Readium Guided Navigation Documents from the media overlays of a publication",
+	Long: `Generate Readium Guided Navigation Documents from the media overlays of a publication.
+
+This command will parse an EPUB 3 publication with Media Overlays, and convert
+its SMIL documents to Readium Guided Navigation Documents, which synchronize
+the text of the publication with its audio narration. By default, a single
+document covering the whole reading order is printed to stdout.
+
+Examples:
+  Print out the guided navigation of the whole publication.
+  $ readium guided-navigation publication.epub
+
+  Pretty-print the guided navigation of a single resource using two-space indent.
+  $ readium guided-navigation --indent "  " --resource OEBPS/chapter1.xhtml publication.epub
+  `,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("expects a path to the publication")
+		} else if len(args) > 1 {
+			return errors.New("accepts a single path to a publication")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// By the time we reach this point, we know that the arguments were
+		// properly parsed, and we don't want to show the usage if an API error
+		// occurs.
+		cmd.SilenceUsage = true
+
+		path, err := url.FromFilepath(filepath.Clean(args[0]))
+		if err != nil {
+			return fmt.Errorf("failed creating URL from filepath: %w", err)
+		}
+
+		pub, err := streamer.New(streamer.Config{}).Open(
+			context.TODO(),
+			asset.File(path), "",
+		)
+		if err != nil {
+			return fmt.Errorf("failed opening %s: %w", path, err)
+		}
+		defer pub.Close()
+
+		overlays, err := helpers.MediaOverlays(context.TODO(), pub)
+		if err != nil {
+			return fmt.Errorf("failed converting media overlays of %s: %w", path, err)
+		}
+		if len(overlays) == 0 {
+			return fmt.Errorf("publication %s has no media overlays", path)
+		}
+
+		var doc *helpers.GuidedNavigationDocument
+		if guidedNavigationResourceFlag != "" {
+			var ok bool
+			doc, ok = overlays[guidedNavigationResourceFlag]
+			if !ok {
+				return fmt.Errorf("resource %s has no media overlay", guidedNavigationResourceFlag)
+			}
+		} else {
+			// Combine the documents in the order of the reading order
+			doc = &helpers.GuidedNavigationDocument{}
+			for _, link := range pub.Manifest.ReadingOrder {
+				if overlay, ok := overlays[link.Href.String()]; ok {
+					doc.Guided = append(doc.Guided, overlay.Guided...)
+				}
+			}
+		}
+
+		var jsonBytes []byte
+		if indentFlag == "" {
+			jsonBytes, err = json.Marshal(doc)
+		} else {
+			jsonBytes, err = json.MarshalIndent(doc, "", indentFlag)
+		}
+		if err != nil {
+			return fmt.Errorf("failed rendering JSON for %s: %w", path, err)
+		}
+
+		fmt.Println(string(jsonBytes))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(guidedNavigationCmd)
+	guidedNavigationCmd.Flags().StringVarP(&indentFlag, "indent", "i", "", "Indentation used to pretty-print")
+	guidedNavigationCmd.Flags().StringVar(&guidedNavigationResourceFlag, "resource", "", "Href of a resource of the reading order, to only print the guided navigation of this resource")
+}
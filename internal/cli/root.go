@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"fmt"
+	"log/slog"
 	"os"
 
 	"github.com/readium/cli/internal/version"
@@ -12,6 +14,45 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "readium",
 	Short: "Utilities for Readium Web Publications",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Commands with a configuration file can also be configured with
+		// environment variables
+		if cmd.Flags().Lookup("config") != nil {
+			if err := loadConfig(cmd); err != nil {
+				cmd.SilenceUsage = true // The usage doesn't help with the configuration
+				return err
+			}
+		}
+		return setupLogging()
+	},
+}
+
+var logFormatFlag string
+var logLevelFlag string
+
+// Level of the logs, which commands can change after setup
+var logLevel = new(slog.LevelVar)
+
+// Set up the default logger, writing to stderr.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevelFlag)); err != nil {
+		return fmt.Errorf("log level must be one of debug, info, warn or error, not %s", logLevelFlag)
+	}
+	switch logFormatFlag {
+	case "text":
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	default:
+		return fmt.Errorf("log format must be one of text or json, not %s", logFormatFlag)
+	}
+	setLogLevel(level)
+	return nil
+}
+
+func setLogLevel(level slog.Level) {
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level) // For the default text logger
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -29,4 +70,7 @@ func Execute() {
 
 func init() {
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
+
+	rootCmd.PersistentFlags().StringVar(&logFormatFlag, "log-format", "text", "Format of the logs: text or json")
+	rootCmd.PersistentFlags().StringVar(&logLevelFlag, "log-level", "info", "Minimum level of the logs: debug, info, warn or error")
 }
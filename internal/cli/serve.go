@@ -3,14 +3,20 @@ package cli
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"log/slog"
@@ -23,15 +29,23 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/pkg/errors"
+	"github.com/readium/cli/internal/version"
 	"github.com/readium/cli/pkg/serve"
 	"github.com/readium/cli/pkg/serve/auth"
 	"github.com/readium/cli/pkg/serve/client"
 	"github.com/readium/go-toolkit/pkg/streamer"
 	"github.com/readium/go-toolkit/pkg/util/url"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
+var configFlag string
+var printConfigFlag bool
+
 var debugFlag bool
 
 var bindAddressFlag string
@@ -45,7 +59,32 @@ var fileDirectoryFlag string
 var mode string
 
 var jwtSharedSecret string
+var jwtKeyringFlag string
+var jwtKeyringGraceFlag time.Duration
 var jwksURL string
+var oidcIssuerFlag string
+var pemKeyFlag []string
+var pemAlgorithmsFlag []string
+
+// OAuth 2.0 token introspection
+var introspectionEndpointFlag string
+var introspectionClientIDFlag string
+var introspectionClientSecretFlag string
+var introspectionPathFieldFlag string
+var introspectionCacheTTLFlag time.Duration
+var introspectionNegativeCacheTTLFlag time.Duration
+
+// Encrypted tokens
+var jweSecretFlag string
+var jweKeyFlag string
+var jweAlgorithmsFlag []string
+var jweEncryptionFlag []string
+
+// Claims required in JWTs
+var jwtIssuerFlag string
+var jwtAudienceFlag []string
+var jwtLeewayFlag time.Duration
+var jwtMaxLifetimeFlag time.Duration
 
 // Cloud-related flags
 var s3EndpointFlag string
@@ -63,6 +102,59 @@ var remoteArchiveCacheSize uint32
 var remoteArchiveCacheCount uint32
 var remoteArchiveCacheAll uint32
 
+var maxRangesFlag uint16
+var reprDigestFlag bool
+
+var opdsFlag bool
+var opdsSourceFlag []string
+var opdsTitleFlag string
+var opdsItemsPerPageFlag uint16
+var opdsTokenTTLFlag time.Duration
+var opdsBearerTokenFlag string
+
+var iiifMaxSizeFlag uint16
+var iiifCacheSizeFlag uint64
+
+var injectCSSBeforeFlag []string
+var injectCSSAfterFlag []string
+var injectJSFlag []string
+var injectViewportFlag string
+var injectFXLCSSBeforeFlag []string
+var injectFXLCSSAfterFlag []string
+var injectFXLJSFlag []string
+var injectFXLViewportFlag string
+
+var contentSecurityFlag string
+var scriptedPublicationFlag []string
+
+var publicBaseURLFlag string
+var trustedProxyFlag []string
+var resourceBaseURLFlag string
+
+var corsOriginFlag []string
+var corsCredentialsFlag bool
+var corsExposeHeaderFlag []string
+var corsMaxAgeFlag time.Duration
+var enforceOriginFlag string
+
+var tlsCertFlag string
+var tlsKeyFlag string
+var tlsClientCAFlag string
+var h2cFlag bool
+
+var drainDelayFlag time.Duration
+var drainTimeoutFlag time.Duration
+
+var adminAddressFlag string
+
+var readyLocationFlag []string
+
+var accessLogFlag bool
+var accessLogPublicationFlag string
+
+var otlpEndpointFlag string
+var traceSampleRatioFlag float64
+
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start a local HTTP server, serving publications locally or remotely",
@@ -94,6 +186,10 @@ access to publications and prevent abuse or unauthorized access.`,
 		// occurs.
 		cmd.SilenceUsage = true
 
+		if printConfigFlag {
+			return printConfig(cmd)
+		}
+
 		// Validate schemes
 		schemes := make([]url.Scheme, len(schemeFlag))
 		for i, v := range schemeFlag {
@@ -127,11 +223,42 @@ access to publications and prevent abuse or unauthorized access.`,
 			return fmt.Errorf("file scheme is enabled, but no local directory was specified with the --file-directory flag")
 		}
 
-		// Log level
-		if debugFlag {
-			slog.SetLogLoggerLevel(slog.LevelDebug)
-		} else {
-			slog.SetLogLoggerLevel(slog.LevelInfo)
+		// Debug mode implies debug logs, unless the log level is set
+		if debugFlag && !cmd.Flags().Changed("log-level") {
+			setLogLevel(slog.LevelDebug)
+		}
+
+		// Access log
+		switch accessLogPublicationFlag {
+		case serve.AccessLogPublicationHash, serve.AccessLogPublicationRedact:
+		default:
+			return fmt.Errorf("publications in the access log must be hash or redact, not %s", accessLogPublicationFlag)
+		}
+
+		// Tracing, enabled by an OTLP endpoint
+		if otlpEndpointFlag != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			if traceSampleRatioFlag < 0 || traceSampleRatioFlag > 1 {
+				return fmt.Errorf("trace sample ratio must be between 0 and 1, not %g", traceSampleRatioFlag)
+			}
+			tp, err := serve.NewTracerProvider(context.Background(), serve.TracingConfig{
+				Endpoint:    otlpEndpointFlag,
+				SampleRatio: traceSampleRatioFlag,
+				Version:     version.Version,
+			})
+			if err != nil {
+				return err
+			}
+			defer func() {
+				// Flush the remaining spans
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := tp.Shutdown(ctx); err != nil {
+					slog.Warn("failed exporting the remaining spans", "error", err)
+				}
+			}()
+			otel.SetTracerProvider(tp)
+			otel.SetTextMapPropagator(propagation.TraceContext{})
+			slog.Info("Tracing enabled", "endpoint", otlpEndpointFlag, "ratio", traceSampleRatioFlag)
 		}
 
 		// Set up remote publication retrieval clients
@@ -149,7 +276,8 @@ access to publications and prevent abuse or unauthorized access.`,
 				config.WithRegion(s3RegionFlag),
 				config.WithRequestChecksumCalculation(0),
 				config.WithResponseChecksumValidation(0),
-				// TODO: look into custom HTTP client, user-agent
+				config.WithHTTPClient(&http.Client{Transport: otelhttp.NewTransport(serve.InstrumentTransport("s3", nil))}),
+				// TODO: look into user-agent
 			}
 			if s3AccessKeyFlag != "" && s3SecretKeyFlag != "" {
 				options = append(options, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(s3AccessKeyFlag, s3SecretKeyFlag, "")))
@@ -177,11 +305,14 @@ access to publications and prevent abuse or unauthorized access.`,
 		// GCS
 		var err error
 		if slices.Contains(schemes, url.SchemeGS) {
+			transport, err := htransport.NewTransport(ctx, otelhttp.NewTransport(serve.InstrumentTransport("gs", nil)), option.WithScopes(storage.ScopeReadOnly))
+			if err != nil {
+				return fmt.Errorf("GCS transport creation failed: %w", err)
+			}
 			opts := []option.ClientOption{
-				option.WithScopes(storage.ScopeReadOnly),
+				option.WithHTTPClient(&http.Client{Transport: transport}),
 				storage.WithJSONReads(),
 				// option.WithUserAgent(TODO),
-				// TODO: look into more efficient transport (HTTP client)
 			}
 			remote.GCS, err = storage.NewClient(ctx, opts...)
 			if err != nil {
@@ -207,6 +338,8 @@ access to publications and prevent abuse or unauthorized access.`,
 		remote.HTTP, err = client.NewHTTPClient(httpAuthorizationFlag, urlWhitelist, httpUnsafeRequestsFlag)
 		if err != nil {
 			slog.Warn("HTTP client creation failed, HTTP support will be disabled", "error", err)
+		} else {
+			remote.HTTP.Transport = serve.InstrumentTransport("", remote.HTTP.Transport)
 		}
 		remote.HTTPEnabled = slices.Contains(schemes, url.SchemeHTTP)
 		remote.HTTPSEnabled = slices.Contains(schemes, url.SchemeHTTPS)
@@ -217,12 +350,45 @@ access to publications and prevent abuse or unauthorized access.`,
 		remote.Config.Timeout = time.Duration(remoteArchiveTimeoutFlag) * time.Second
 		remote.Config.CacheAllThreshold = int64(remoteArchiveCacheAll)
 
+		claims := auth.ClaimsConfig{
+			Issuer:      jwtIssuerFlag,
+			Audience:    jwtAudienceFlag,
+			Leeway:      jwtLeewayFlag,
+			MaxLifetime: jwtMaxLifetimeFlag,
+		}
+		if jwtLeewayFlag < 0 || jwtMaxLifetimeFlag < 0 || jwtKeyringGraceFlag < 0 {
+			return fmt.Errorf("jwt-leeway, jwt-max-lifetime and jwt-keyring-grace can't be negative")
+		}
+		if oidcIssuerFlag != "" && mode != "jwks" {
+			return fmt.Errorf("oidc-issuer is only available in jwks mode")
+		}
+
 		var authProvider auth.AuthProvider
+		var keyReloader auth.Reloader // Keys reloaded on SIGHUP, if any
+		if jwtKeyringFlag != "" && mode != "jwt" {
+			return fmt.Errorf("jwt-keyring is only available in jwt mode")
+		}
+		if (len(pemKeyFlag) > 0 || len(pemAlgorithmsFlag) > 0) && mode != "pem" {
+			return fmt.Errorf("pem-key and pem-algorithms are only available in pem mode")
+		}
 		switch mode {
 		case "base64":
 			authProvider = auth.NewB64EncodedAuthProvider()
 			slog.Info("Operating in open access mode with base64url encoding (insecure)")
 		case "jwt":
+			if jwtKeyringFlag != "" {
+				if jwtSharedSecret != "" {
+					return fmt.Errorf("jwt-shared-secret and jwt-keyring can't both be specified")
+				}
+				keyring, err := auth.NewKeyring(jwtKeyringFlag, jwtKeyringGraceFlag)
+				if err != nil {
+					return fmt.Errorf("failed loading JWT keyring: %w", err)
+				}
+				slog.Info("Operating in HS256 JWT access mode", "keyring", jwtKeyringFlag, "grace", jwtKeyringGraceFlag)
+				authProvider = auth.NewJWTKeyringAuthProvider(keyring, claims)
+				keyReloader = keyring
+				break
+			}
 			var sharedSecret []byte
 			if jwtSharedSecret == "" {
 				// Auto-generate shared secret
@@ -240,21 +406,259 @@ access to publications and prevent abuse or unauthorized access.`,
 				}
 				slog.Info("Operating in HS256 JWT access mode", "secret", "<jwt-shared-secret flag>")
 			}
-			authProvider, err = auth.NewJWTAuthProvider(sharedSecret)
+			authProvider, err = auth.NewJWTAuthProvider(sharedSecret, claims)
 			if err != nil {
 				return fmt.Errorf("failed creating JWT auth provider: %w", err)
 			}
 		case "jwks":
-			if jwksURL == "" {
-				return fmt.Errorf("jwks-url must be specified in jwks mode")
+			// Separate client, without the authorization of remote publications
+			jwksClient, err := client.NewHTTPClient("", urlWhitelist, httpUnsafeRequestsFlag)
+			if err != nil {
+				return fmt.Errorf("failed creating JWKS HTTP client: %w", err)
+			}
+			if oidcIssuerFlag != "" {
+				if jwksURL != "" {
+					return fmt.Errorf("jwks-url and oidc-issuer can't both be specified")
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				jwksURL, err = auth.DiscoverJWKSURL(ctx, jwksClient, oidcIssuerFlag)
+				cancel()
+				if err != nil {
+					return fmt.Errorf("failed discovering the JWKS of OIDC issuer %s: %w", oidcIssuerFlag, err)
+				}
+				if claims.Issuer == "" {
+					// Tokens of other issuers could be signed with the same keys
+					claims.Issuer = oidcIssuerFlag
+				}
+			} else if jwksURL == "" {
+				return fmt.Errorf("jwks-url or oidc-issuer must be specified in jwks mode")
 			}
-			slog.Info("Operating in JWKS JWT access mode", "jwks_url", jwksURL)
-			authProvider, err = auth.NewJWKSAuthProvider(context.Background(), remote.HTTP, jwksURL)
+			slog.Info("Operating in JWKS JWT access mode", "jwks_url", jwksURL, "issuer", claims.Issuer)
+			authProvider, err = auth.NewJWKSAuthProvider(context.Background(), jwksClient, jwksURL, claims)
 			if err != nil {
 				return fmt.Errorf("failed creating JWKS auth provider: %w", err)
 			}
+		case "pem":
+			pemProvider, err := auth.NewPEMAuthProvider(pemKeyFlag, pemAlgorithmsFlag, claims)
+			if err != nil {
+				return fmt.Errorf("failed creating PEM auth provider: %w", err)
+			}
+			slog.Info("Operating in PEM JWT access mode", "keys", pemKeyFlag, "algorithms", pemAlgorithmsFlag)
+			authProvider = pemProvider
+			keyReloader = pemProvider
+		case "introspection":
+			if introspectionEndpointFlag == "" {
+				return fmt.Errorf("introspection-endpoint must be specified in introspection mode")
+			}
+			endpointURL, err := nurl.Parse(introspectionEndpointFlag)
+			if err != nil {
+				return fmt.Errorf("invalid introspection endpoint %s: %w", introspectionEndpointFlag, err)
+			}
+			// Separate client, without the authorization of remote publications,
+			// only allowed to request the endpoint
+			introspectionClient, err := client.NewHTTPClient("", []*nurl.URL{endpointURL}, httpUnsafeRequestsFlag)
+			if err != nil {
+				return fmt.Errorf("failed creating introspection HTTP client: %w", err)
+			}
+			authProvider, err = auth.NewIntrospectionAuthProvider(introspectionClient, auth.IntrospectionConfig{
+				Endpoint:         introspectionEndpointFlag,
+				ClientID:         introspectionClientIDFlag,
+				ClientSecret:     introspectionClientSecretFlag,
+				PathField:        introspectionPathFieldFlag,
+				CacheTTL:         introspectionCacheTTLFlag,
+				NegativeCacheTTL: introspectionNegativeCacheTTLFlag,
+			})
+			if err != nil {
+				return fmt.Errorf("failed creating introspection auth provider: %w", err)
+			}
+			slog.Info("Operating in OAuth 2.0 token introspection access mode", "endpoint", introspectionEndpointFlag, "client_id", introspectionClientIDFlag)
+		default:
+			return fmt.Errorf("invalid access mode %q, acceptable values: base64, jwt, jwks, pem, introspection", mode)
+		}
+
+		// OPDS feed
+		var opdsConfig *serve.OPDSConfig
+		if opdsFlag {
+			if _, ok := authProvider.(auth.TokenIssuer); !ok {
+				return fmt.Errorf("the OPDS feed is not available in %s access mode, since tokens can't be issued", mode)
+			}
+			if mode != "base64" && opdsBearerTokenFlag == "" {
+				// Anyone able to read the feed could access every publication
+				return fmt.Errorf("the OPDS feed contains tokens granting access to every listed publication in %s access mode, so it must be protected with opds-bearer-token", mode)
+			}
+			if mode == "jwt" && jwtMaxLifetimeFlag > 0 && opdsTokenTTLFlag > jwtMaxLifetimeFlag {
+				return fmt.Errorf("opds-token-ttl can't be longer than jwt-max-lifetime, since the tokens would be rejected")
+			}
+			for _, source := range opdsSourceFlag {
+				su, err := nurl.Parse(source)
+				if err != nil {
+					return fmt.Errorf("invalid OPDS source %s: %w", source, err)
+				}
+				switch su.Scheme {
+				case "s3":
+					if remote.S3 == nil {
+						return fmt.Errorf("OPDS source %s requires the s3 scheme to be enabled", source)
+					}
+				case "gs":
+					if remote.GCS == nil {
+						return fmt.Errorf("OPDS source %s requires the gs scheme to be enabled", source)
+					}
+				default:
+					return fmt.Errorf("OPDS source %s must have s3 or gs scheme", source)
+				}
+				if su.Host == "" {
+					return fmt.Errorf("OPDS source %s must have a bucket", source)
+				}
+			}
+			opdsConfig = &serve.OPDSConfig{
+				Title:        opdsTitleFlag,
+				Sources:      opdsSourceFlag,
+				ItemsPerPage: int(opdsItemsPerPageFlag),
+				TokenTTL:     opdsTokenTTLFlag,
+				BearerToken:  opdsBearerTokenFlag,
+			}
+			slog.Info("OPDS feed enabled", "sources", len(opdsSourceFlag), "local", fileDirectoryFlag != "")
+		} else if len(opdsSourceFlag) > 0 {
+			slog.Warn("OPDS sources are set, but the OPDS feed is not enabled")
+		}
+
+		// Encrypted tokens, containing the JWTs of the access mode. The OPDS
+		// feed checks whether the access mode can issue tokens beforehand.
+		if jweSecretFlag != "" || jweKeyFlag != "" {
+			if mode == "base64" || mode == "introspection" {
+				return fmt.Errorf("encrypted tokens are not available in %s access mode, since its tokens aren't JWTs", mode)
+			}
+			var key interface{}
+			switch {
+			case jweSecretFlag != "" && jweKeyFlag != "":
+				return fmt.Errorf("jwe-secret and jwe-key can't both be specified")
+			case jweSecretFlag != "":
+				key, err = hex.DecodeString(jweSecretFlag)
+				if err != nil {
+					return fmt.Errorf("failed to decode hex-encoded JWE secret: %w", err)
+				}
+			default:
+				data, err := os.ReadFile(jweKeyFlag)
+				if err != nil {
+					return fmt.Errorf("failed reading JWE key file: %w", err)
+				}
+				key, err = auth.ParseJWEPrivateKey(data)
+				if err != nil {
+					return fmt.Errorf("invalid JWE key file %s: %w", jweKeyFlag, err)
+				}
+			}
+			authProvider, err = auth.NewJWEAuthProvider(key, jweAlgorithmsFlag, jweEncryptionFlag, authProvider)
+			if err != nil {
+				return fmt.Errorf("failed creating JWE auth provider: %w", err)
+			}
+			slog.Info("Encrypted tokens (JWE) required")
+		} else if len(jweAlgorithmsFlag) > 0 || len(jweEncryptionFlag) > 0 {
+			return fmt.Errorf("jwe-algorithms and jwe-encryption require jwe-secret or jwe-key")
+		}
+
+		// Readiness checks
+		var readinessLocations []string
+		if cmd.Flags().Changed("ready-location") {
+			readinessLocations = readyLocationFlag
+		}
+		for _, location := range readyLocationFlag {
+			lu, err := nurl.Parse(location)
+			if err != nil || lu.Host == "" {
+				return fmt.Errorf("readiness location %s must be an S3 or GCS location with a bucket", location)
+			}
+			switch {
+			case lu.Scheme == "s3" && remote.S3 != nil, lu.Scheme == "gs" && remote.GCS != nil:
+			default:
+				return fmt.Errorf("readiness location %s requires the s3 or gs scheme to be enabled", location)
+			}
+		}
+
+		// Injection in HTML and XHTML resources
+		var injectionConfig *serve.InjectionConfig
+		injection := serve.InjectionConfig{
+			Reflowable: serve.InjectionRules{
+				StylesheetsBefore: injectCSSBeforeFlag,
+				StylesheetsAfter:  injectCSSAfterFlag,
+				Scripts:           injectJSFlag,
+				Viewport:          injectViewportFlag,
+			},
+			FixedLayout: serve.InjectionRules{
+				StylesheetsBefore: injectFXLCSSBeforeFlag,
+				StylesheetsAfter:  injectFXLCSSAfterFlag,
+				Scripts:           injectFXLJSFlag,
+				Viewport:          injectFXLViewportFlag,
+			},
+		}
+		if cmd.Flags().Changed("inject-css-before") || cmd.Flags().Changed("inject-css-after") || cmd.Flags().Changed("inject-js") || cmd.Flags().Changed("inject-viewport") ||
+			cmd.Flags().Changed("inject-fxl-css-before") || cmd.Flags().Changed("inject-fxl-css-after") || cmd.Flags().Changed("inject-fxl-js") || cmd.Flags().Changed("inject-fxl-viewport") {
+			injectionConfig = &injection
+			slog.Info("Injecting elements in HTML resources")
+		}
+
+		// Content security
+		switch contentSecurityFlag {
+		case serve.ContentSecurityOff:
+			if len(scriptedPublicationFlag) > 0 {
+				slog.Warn("Scripted publications are set, but content security is off")
+			}
+		case serve.ContentSecurityCSP, serve.ContentSecuritySanitize:
+			for i, pattern := range scriptedPublicationFlag {
+				normalized, err := serve.ScriptedPublicationPattern(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid scripted publication pattern %s: %w", pattern, err)
+				}
+				scriptedPublicationFlag[i] = normalized
+			}
+			slog.Info("Content security enabled", "mode", contentSecurityFlag, "scripted", len(scriptedPublicationFlag))
 		default:
-			return fmt.Errorf("invalid access mode %q, acceptable values: base64, jwt, jwks", mode)
+			return fmt.Errorf("content security mode must be one of off, csp or sanitize, not %s", contentSecurityFlag)
+		}
+
+		// Public URLs
+		for name, u := range map[string]string{"public base URL": publicBaseURLFlag, "resource base URL": resourceBaseURLFlag} {
+			if u == "" {
+				continue
+			}
+			pu, err := nurl.Parse(u)
+			if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" || pu.RawQuery != "" || pu.Fragment != "" {
+				return fmt.Errorf("%s %s must be an absolute HTTP or HTTPS URL without query or fragment", name, u)
+			}
+		}
+		var trustedProxies []netip.Prefix
+		for _, proxy := range trustedProxyFlag {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(proxy)
+				if aerr != nil {
+					return fmt.Errorf("trusted proxy %s must be an IP address or a CIDR range", proxy)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			trustedProxies = append(trustedProxies, prefix.Masked())
+		}
+		if publicBaseURLFlag != "" && len(trustedProxies) > 0 {
+			slog.Warn("Trusted proxies are set, but the public base URL takes precedence over forwarded headers")
+		}
+
+		// Cross-origin requests
+		switch enforceOriginFlag {
+		case serve.OriginEnforcementOff, serve.OriginEnforcementLenient, serve.OriginEnforcementStrict:
+		default:
+			return fmt.Errorf("origin enforcement mode must be one of off, lenient or strict, not %s", enforceOriginFlag)
+		}
+		for _, origin := range corsOriginFlag {
+			if origin == "*" {
+				continue
+			}
+			if ou, err := nurl.Parse(origin); err != nil || ou.Scheme == "" || ou.Host == "" || strings.TrimSuffix(ou.Path, "/") != "" {
+				return fmt.Errorf("CORS origin %s must be * or a scheme and a host, such as https://reader.example.com", origin)
+			}
+		}
+		if corsCredentialsFlag && slices.Contains(corsOriginFlag, "*") {
+			return errors.New("CORS credentials can't be allowed for any origin, set the allowed origins with --cors-origin")
+		}
+		if enforceOriginFlag != serve.OriginEnforcementOff && slices.Contains(corsOriginFlag, "*") {
+			slog.Warn("Origins are enforced, but any origin is allowed")
 		}
 
 		// Create server
@@ -263,6 +667,32 @@ access to publications and prevent abuse or unauthorized access.`,
 			JSONIndent:        indentFlag,
 			InferA11yMetadata: streamer.InferA11yMetadata(inferA11yFlag),
 			Auth:              authProvider,
+			AuthMode:          mode,
+			MaxRanges:         int(maxRangesFlag),
+			ReprDigest:        reprDigestFlag,
+			OPDS:              opdsConfig,
+			IIIFMaxSize:       int(iiifMaxSizeFlag),
+			IIIFCacheSize:     int64(iiifCacheSizeFlag),
+			Injection:         injectionConfig,
+			ContentSecurity: serve.ContentSecurityConfig{
+				Mode:                 contentSecurityFlag,
+				ScriptedPublications: scriptedPublicationFlag,
+			},
+			PublicBaseURL:   publicBaseURLFlag,
+			TrustedProxies:  trustedProxies,
+			ResourceBaseURL: resourceBaseURLFlag,
+			CORS: serve.CORSConfig{
+				AllowedOrigins:    corsOriginFlag,
+				AllowCredentials:  corsCredentialsFlag,
+				ExposedHeaders:    corsExposeHeaderFlag,
+				MaxAge:            corsMaxAgeFlag,
+				OriginEnforcement: enforceOriginFlag,
+			},
+			ReadinessLocations: readinessLocations,
+			AccessLog: serve.AccessLogConfig{
+				Enabled:     accessLogFlag,
+				Publication: accessLogPublicationFlag,
+			},
 		}, remote)
 
 		bind := fmt.Sprintf("%s:%d", bindAddressFlag, bindPortFlag)
@@ -273,13 +703,150 @@ access to publications and prevent abuse or unauthorized access.`,
 			Addr:           bind,
 			Handler:        pubServer.Routes(),
 		}
-		slog.Info("Starting HTTP server", "address", "http://"+httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			slog.Error("Server stopped", "error", err)
-		} else {
-			slog.Info("Goodbye!")
+
+		// TLS
+		useTLS := tlsCertFlag != "" || tlsKeyFlag != ""
+		if useTLS {
+			if tlsCertFlag == "" || tlsKeyFlag == "" {
+				return errors.New("both --tls-cert and --tls-key are required to enable TLS")
+			}
+			if h2cFlag {
+				return errors.New("h2c can't be enabled along with TLS, which already supports HTTP/2")
+			}
+			reloader, err := serve.NewCertificateReloader(tlsCertFlag, tlsKeyFlag)
+			if err != nil {
+				return err
+			}
+			httpServer.TLSConfig = &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: reloader.GetCertificate,
+			}
+			if tlsClientCAFlag != "" {
+				pem, err := os.ReadFile(tlsClientCAFlag)
+				if err != nil {
+					return fmt.Errorf("failed reading client CA file: %w", err)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					return fmt.Errorf("no certificate found in client CA file %s", tlsClientCAFlag)
+				}
+				httpServer.TLSConfig.ClientCAs = pool
+				httpServer.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				slog.Info("Client certificates required")
+			}
+		} else if tlsClientCAFlag != "" {
+			return errors.New("client certificates require TLS to be enabled with --tls-cert and --tls-key")
+		}
+
+		// HTTP/2 over cleartext, for use behind a trusted proxy
+		if h2cFlag {
+			httpServer.Protocols = new(http.Protocols)
+			httpServer.Protocols.SetHTTP1(true)
+			httpServer.Protocols.SetUnencryptedHTTP2(true)
+			slog.Info("HTTP/2 over cleartext (h2c) enabled")
 		}
 
+		serveErr := make(chan error, 2)
+
+		// Admin listener, on a TCP address or a Unix socket
+		var adminServer *http.Server
+		if adminAddressFlag != "" {
+			network, address := "tcp", adminAddressFlag
+			if socket, ok := strings.CutPrefix(adminAddressFlag, "unix:"); ok {
+				network, address = "unix", socket
+				if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed removing previous admin socket: %w", err)
+				}
+				defer os.Remove(socket)
+			}
+			listener, err := net.Listen(network, address)
+			if err != nil {
+				return fmt.Errorf("failed listening on admin address %s: %w", adminAddressFlag, err)
+			}
+			adminServer = &http.Server{
+				ReadTimeout:    10 * time.Second,
+				MaxHeaderBytes: 1 << 20,
+				Handler:        pubServer.AdminRoutes(),
+			}
+			go func() {
+				slog.Info("Starting admin server", "address", network+":"+address)
+				if err := adminServer.Serve(listener); err != http.ErrServerClosed {
+					serveErr <- fmt.Errorf("admin server: %w", err)
+				}
+			}()
+		} else if debugFlag {
+			slog.Info("Profiling is available on the admin listener, enabled with --admin-address")
+		}
+		go func() {
+			if useTLS {
+				slog.Info("Starting HTTPS server", "address", "https://"+httpServer.Addr)
+				serveErr <- httpServer.ListenAndServeTLS("", "")
+			} else {
+				slog.Info("Starting HTTP server", "address", "http://"+httpServer.Addr)
+				serveErr <- httpServer.ListenAndServe()
+			}
+		}()
+
+		// Reload keys on SIGHUP, in addition to when their files change
+		if keyReloader != nil {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+			go func() {
+				for range hup {
+					if err := keyReloader.Reload(); err != nil {
+						slog.Error("Failed reloading keys, keeping the current ones", "error", err)
+					} else {
+						slog.Info("Keys reloaded")
+					}
+				}
+			}()
+		}
+
+		// Wait for the server to fail, or for a signal to shut it down
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		select {
+		case err := <-serveErr:
+			if adminServer != nil {
+				adminServer.Close()
+			}
+			httpServer.Close()
+			pubServer.Close()
+			return fmt.Errorf("server stopped: %w", err)
+		case sig := <-signals:
+			slog.Info("Shutting down", "signal", sig.String(), "delay", drainDelayFlag, "timeout", drainTimeoutFlag)
+		}
+
+		// Report the server as unhealthy, and give load balancers time to notice
+		pubServer.Drain()
+		select {
+		case <-time.After(drainDelayFlag):
+		case <-signals:
+			drainTimeoutFlag = 0 // Second signal, stop right away
+		}
+
+		// Let in-flight requests, such as audio streams, complete
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), drainTimeoutFlag)
+		defer shutdownCancel()
+		go func() {
+			select {
+			case <-signals:
+				shutdownCancel()
+			case <-shutdownCtx.Done():
+			}
+		}()
+		if adminServer != nil {
+			adminServer.Close()
+		}
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Requests still in progress after the drain timeout, closing their connections", "error", err)
+			httpServer.Close()
+		}
+		pubServer.Close()
+		slog.Info("Goodbye!")
+
 		return nil
 	},
 }
@@ -287,16 +854,49 @@ access to publications and prevent abuse or unauthorized access.`,
 func init() {
 	rootCmd.AddCommand(serveCmd)
 
+	serveCmd.Flags().StringVar(&configFlag, "config", "", "Path to a YAML, JSON or TOML configuration file, with flags as keys. Flags can also be set with READIUM_<FLAG> environment variables, such as READIUM_S3_REGION, and read from a file with READIUM_<FLAG>_FILE")
+	serveCmd.Flags().BoolVar(&printConfigFlag, "print-config", false, "Print the effective configuration, with secrets masked, and exit")
 	serveCmd.Flags().StringSliceVarP(&schemeFlag, "scheme", "s", []string{"file"}, "Scheme(s) to enable for accessing content. Acceptable values: file, http, https, s3, gs")
 	serveCmd.Flags().StringVarP(&bindAddressFlag, "address", "a", "localhost", "Address to bind the HTTP server to")
 	serveCmd.Flags().Uint16VarP(&bindPortFlag, "port", "p", 15080, "Port to bind the HTTP server to")
+	serveCmd.Flags().StringVar(&tlsCertFlag, "tls-cert", "", "Path to a PEM certificate (chain) to serve HTTPS, reloaded when the file changes")
+	serveCmd.Flags().StringVar(&tlsKeyFlag, "tls-key", "", "Path to the PEM private key of the TLS certificate, reloaded when the file changes")
+	serveCmd.Flags().StringVar(&tlsClientCAFlag, "tls-client-ca", "", "Path to PEM certificates of the authorities of client certificates. If set, clients must present a valid certificate")
+	serveCmd.Flags().BoolVar(&h2cFlag, "h2c", false, "Enable HTTP/2 over cleartext (h2c), for use behind a trusted proxy or load balancer")
+	serveCmd.Flags().DurationVar(&drainDelayFlag, "drain-delay", 0, "How long the server keeps accepting requests while reporting itself as unhealthy on shutdown, for load balancers to stop sending requests to it")
+	serveCmd.Flags().DurationVar(&drainTimeoutFlag, "drain-timeout", 30*time.Second, "How long in-flight requests are allowed to complete on shutdown, before their connections are closed")
+	serveCmd.Flags().StringVar(&adminAddressFlag, "admin-address", "", "Address of the admin listener, with profiling and cache management endpoints, such as localhost:15081 or unix:/run/readium/admin.sock. It must not be publicly reachable")
+	serveCmd.Flags().StringSliceVar(&readyLocationFlag, "ready-location", []string{}, "S3 or GCS location listed by the readiness checks of /ready (e.g. 's3://bucket/prefix'). Defaults to the OPDS sources")
+	serveCmd.Flags().BoolVar(&accessLogFlag, "access-log", false, "Log each request once its response has been sent, without the token or encoded path of its publication")
+	serveCmd.Flags().StringVar(&accessLogPublicationFlag, "access-log-publication", serve.AccessLogPublicationHash, "How publications are identified in the access log: hash (truncated SHA-256 digest of their path) or redact (not at all)")
+	serveCmd.Flags().StringVar(&otlpEndpointFlag, "otlp-endpoint", "", "URL of an OTLP/HTTP collector to export traces to (e.g. http://localhost:4318). Tracing is also enabled by the OTEL_EXPORTER_OTLP_ENDPOINT environment variable")
+	serveCmd.Flags().Float64Var(&traceSampleRatioFlag, "trace-sample-ratio", 1, "Ratio of requests traced, unless the trace context of the request says otherwise")
 	serveCmd.Flags().StringVarP(&indentFlag, "indent", "i", "", "Indentation used to pretty-print JSON files")
 	serveCmd.Flags().Var(&inferA11yFlag, "infer-a11y", "Infer accessibility metadata: no, merged, split")
 	serveCmd.Flags().BoolVarP(&debugFlag, "debug", "d", false, "Enable debug mode")
-	serveCmd.Flags().StringVarP(&mode, "mode", "m", "base64", "Access mode: base64 (default, base64url-encoded paths), jwt (JWT auth with a shared secret), jwks (JWT auth with keys in a JWKS)")
+	serveCmd.Flags().StringVarP(&mode, "mode", "m", "base64", "Access mode: base64 (default, base64url-encoded paths), jwt (JWT auth with a shared secret), jwks (JWT auth with keys in a JWKS), pem (JWT auth with public keys in PEM files), introspection (opaque tokens validated with OAuth 2.0 token introspection)")
 
 	serveCmd.Flags().StringVar(&jwtSharedSecret, "jwt-shared-secret", "", "Hex-encoded shared secret used for HS256 JWT signature validation. If omitted, but JWT auth is enabled, the secret is auto-generated and logged (debug) at runtime")
+	serveCmd.Flags().StringVar(&jwtKeyringFlag, "jwt-keyring", "", "Path to a file of HS256 secrets selected by the kid header of JWTs, one '<kid> <hex-encoded secret>' per line, instead of jwt-shared-secret. The first one signs issued tokens. Reloaded on SIGHUP or when the file changes")
+	serveCmd.Flags().DurationVar(&jwtKeyringGraceFlag, "jwt-keyring-grace", 24*time.Hour, "How long secrets removed from the keyring still validate JWTs")
 	serveCmd.Flags().StringVar(&jwksURL, "jwks-url", "", "URL to a JWKS (JSON Web Key Set) used for JWT signature validation when in 'jwks' mode")
+	serveCmd.Flags().StringVar(&oidcIssuerFlag, "oidc-issuer", "", "URL of an OpenID Connect issuer whose JWKS is used in 'jwks' mode, discovered from its /.well-known/openid-configuration, instead of jwks-url. JWTs must then be issued by it, unless jwt-issuer is set")
+	serveCmd.Flags().StringSliceVar(&pemKeyFlag, "pem-key", []string{}, "Paths to PEM files of public keys or certificates used for JWT signature validation when in 'pem' mode, reloaded on SIGHUP or when the files change")
+	serveCmd.Flags().StringSliceVar(&pemAlgorithmsFlag, "pem-algorithms", []string{}, "Algorithms allowed for JWT signatures when in 'pem' mode: RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512, EdDSA")
+	serveCmd.Flags().StringVar(&introspectionEndpointFlag, "introspection-endpoint", "", "URL of the OAuth 2.0 token introspection endpoint (RFC 7662) when in 'introspection' mode. Requests are only allowed to this URL, independently of the HTTP host whitelist, and are subject to the restrictions of unsafe requests")
+	serveCmd.Flags().StringVar(&introspectionClientIDFlag, "introspection-client-id", "", "Client ID authenticating to the introspection endpoint")
+	serveCmd.Flags().StringVar(&introspectionClientSecretFlag, "introspection-client-secret", "", "Client secret authenticating to the introspection endpoint")
+	serveCmd.Flags().StringVar(&introspectionPathFieldFlag, "introspection-path-field", auth.DefaultIntrospectionPathField, "Member of the introspection response containing the path of the publication")
+	serveCmd.Flags().DurationVar(&introspectionCacheTTLFlag, "introspection-cache-ttl", auth.DefaultIntrospectionCacheTTL, "Max duration active tokens are cached, also limited by their expiry")
+	serveCmd.Flags().DurationVar(&introspectionNegativeCacheTTLFlag, "introspection-negative-cache-ttl", auth.DefaultIntrospectionNegativeCacheTTL, "Duration inactive tokens are cached")
+	serveCmd.Flags().StringVar(&jweSecretFlag, "jwe-secret", "", "Hex-encoded symmetric key decrypting tokens, which must then be JWE tokens containing the JWTs of the access mode")
+	serveCmd.Flags().StringVar(&jweKeyFlag, "jwe-key", "", "Path to a PEM file of the EC or RSA private key decrypting tokens, which must then be JWE tokens containing the JWTs of the access mode")
+	serveCmd.Flags().StringSliceVar(&jweAlgorithmsFlag, "jwe-algorithms", []string{}, "Key management algorithms allowed for JWE tokens, depending on the key: dir, A128KW, A192KW, A256KW, A128GCMKW, A192GCMKW, A256GCMKW (jwe-secret), ECDH-ES, ECDH-ES+A128KW, ECDH-ES+A192KW, ECDH-ES+A256KW (EC key), RSA-OAEP, RSA-OAEP-256 (RSA key). Defaults to dir, ECDH-ES or RSA-OAEP-256")
+	serveCmd.Flags().StringSliceVar(&jweEncryptionFlag, "jwe-encryption", []string{}, "Content encryption algorithms allowed for JWE tokens: A128GCM, A192GCM, A256GCM, A128CBC-HS256, A192CBC-HS384, A256CBC-HS512. Defaults to A256GCM")
+	serveCmd.Flags().StringVar(&jwtIssuerFlag, "jwt-issuer", "", "Required issuer (iss claim) of JWTs")
+	serveCmd.Flags().StringSliceVar(&jwtAudienceFlag, "jwt-audience", []string{}, "Accepted audiences (aud claim) of JWTs, one of which is required. Tokens issued for the OPDS feed have the first one")
+	serveCmd.Flags().DurationVar(&jwtLeewayFlag, "jwt-leeway", 0, "Tolerated clock skew when validating the expiry (exp), not before (nbf) and issued at (iat) claims of JWTs")
+	serveCmd.Flags().DurationVar(&jwtMaxLifetimeFlag, "jwt-max-lifetime", 0, "Max lifetime of JWTs, between their issued at (iat) and expiry (exp) claims, which are then required (0 for no limit)")
 
 	serveCmd.Flags().StringVar(&fileDirectoryFlag, "file-directory", "", "Local directory path to serve publications from")
 
@@ -314,4 +914,41 @@ func init() {
 	serveCmd.Flags().Uint32Var(&remoteArchiveCacheSize, "remote-archive-cache-size", 1024*1024, "Max size of items in an archive that can be cached (in bytes)")
 	serveCmd.Flags().Uint32Var(&remoteArchiveCacheCount, "remote-archive-cache-count", 64, "Max number of items in an archive that can be cached")
 	serveCmd.Flags().Uint32Var(&remoteArchiveCacheAll, "remote-archive-cache-all", 1024*1024, "Archives this size or less (in bytes) will be cached in full")
+
+	serveCmd.Flags().Uint16Var(&maxRangesFlag, "max-ranges", serve.DefaultMaxRanges, "Max number of byte ranges (after merging overlapping ranges) allowed in a single request. Requests with more ranges receive the full resource")
+	serveCmd.Flags().BoolVar(&reprDigestFlag, "repr-digest", false, "Add a Repr-Digest header (SHA-256) to publication resources. Computing the digest requires reading each resource in full once")
+
+	serveCmd.Flags().BoolVar(&opdsFlag, "opds", false, "Serve an OPDS 2.0 feed of the available publications at /opds/publications.json")
+	serveCmd.Flags().StringSliceVar(&opdsSourceFlag, "opds-source", []string{}, "S3 or GCS location to list in the OPDS feed, in addition to the local directory (e.g. 's3://bucket/prefix', 'gs://bucket/prefix')")
+	serveCmd.Flags().StringVar(&opdsTitleFlag, "opds-title", "Publications", "Title of the OPDS feed")
+	serveCmd.Flags().Uint16Var(&opdsItemsPerPageFlag, "opds-items-per-page", serve.DefaultOPDSItemsPerPage, "Number of publications in each page of the OPDS feed")
+	serveCmd.Flags().DurationVar(&opdsTokenTTLFlag, "opds-token-ttl", serve.DefaultOPDSTokenTTL, "Lifetime of the tokens in the links of the OPDS feed (jwt mode)")
+	serveCmd.Flags().StringVar(&opdsBearerTokenFlag, "opds-bearer-token", "", "Bearer token required in the Authorization header of requests for the OPDS feed. Required in jwt mode, since the feed contains tokens granting access to every publication")
+
+	serveCmd.Flags().Uint16Var(&iiifMaxSizeFlag, "iiif-max-size", serve.DefaultIIIFMaxSize, "Max width and height (in pixels) of images produced by the IIIF image service")
+	serveCmd.Flags().Uint64Var(&iiifCacheSizeFlag, "iiif-cache-size", serve.DefaultIIIFCacheSize, "Max total size of the images produced by the IIIF image service kept in memory (in bytes)")
+
+	serveCmd.Flags().StringSliceVar(&injectCSSBeforeFlag, "inject-css-before", []string{}, "URL of a stylesheet to inject at the start of the head of reflowable HTML resources, before the publisher's styles (e.g. ReadiumCSS-before.css)")
+	serveCmd.Flags().StringSliceVar(&injectCSSAfterFlag, "inject-css-after", []string{}, "URL of a stylesheet to inject at the end of the head of reflowable HTML resources, after the publisher's styles (e.g. ReadiumCSS-default.css, ReadiumCSS-after.css)")
+	serveCmd.Flags().StringSliceVar(&injectJSFlag, "inject-js", []string{}, "URL of a script to inject at the end of the head of reflowable HTML resources")
+	serveCmd.Flags().StringVar(&injectViewportFlag, "inject-viewport", "", "Content of a viewport meta tag to inject in reflowable HTML resources that don't have one (e.g. 'width=device-width, initial-scale=1')")
+	serveCmd.Flags().StringSliceVar(&injectFXLCSSBeforeFlag, "inject-fxl-css-before", []string{}, "URL of a stylesheet to inject at the start of the head of fixed-layout HTML resources")
+	serveCmd.Flags().StringSliceVar(&injectFXLCSSAfterFlag, "inject-fxl-css-after", []string{}, "URL of a stylesheet to inject at the end of the head of fixed-layout HTML resources")
+	serveCmd.Flags().StringSliceVar(&injectFXLJSFlag, "inject-fxl-js", []string{}, "URL of a script to inject at the end of the head of fixed-layout HTML resources")
+	serveCmd.Flags().StringVar(&injectFXLViewportFlag, "inject-fxl-viewport", "", "Content of a viewport meta tag to inject in fixed-layout HTML resources that don't have one")
+
+	serveCmd.Flags().StringVar(&contentSecurityFlag, "content-security", serve.ContentSecurityOff, "How scripts in HTML, XHTML and SVG resources are handled: off, csp (forbid them with a Content-Security-Policy) or sanitize (also remove them)")
+	serveCmd.Flags().StringSliceVar(&scriptedPublicationFlag, "scripted-publication", []string{}, "Pattern of the publications allowed to run scripts when content security is enabled, matched against the path of local publications (e.g. 'interactive/*.epub') or the URL of remote ones (e.g. 's3://bucket/interactive/*.epub')")
+
+	serveCmd.Flags().StringVar(&publicBaseURLFlag, "public-base-url", "", "Base URL of the server used in the links it generates, including any path prefix (e.g. https://example.com/reader). By default, it's taken from the request")
+	serveCmd.Flags().StringSliceVar(&trustedProxyFlag, "trusted-proxy", []string{}, "IP address or CIDR range of a reverse proxy allowed to set the base URL with the Forwarded, X-Forwarded-Host, X-Forwarded-Proto and X-Forwarded-Prefix headers")
+	serveCmd.Flags().StringVar(&resourceBaseURLFlag, "resource-base-url", "", "Base URL of a separate origin (such as a sandbox domain or a CDN) serving the resources of publications, used for their hrefs in manifests")
+
+	serveCmd.Flags().StringSliceVar(&corsOriginFlag, "cors-origin", []string{"*"}, "Origin allowed to make cross-origin requests (e.g. https://reader.example.com, or https://*.example.com for its subdomains), * for any")
+	serveCmd.Flags().BoolVar(&corsCredentialsFlag, "cors-credentials", false, "Allow cross-origin requests with credentials")
+	serveCmd.Flags().StringSliceVar(&corsExposeHeaderFlag, "cors-expose-header", serve.DefaultCORSExposedHeaders, "Response header readable by cross-origin clients")
+	serveCmd.Flags().DurationVar(&corsMaxAgeFlag, "cors-max-age", serve.DefaultCORSMaxAge, "How long browsers can cache the response to a preflight request")
+	serveCmd.Flags().StringVar(&enforceOriginFlag, "enforce-origin", serve.OriginEnforcementOff, "Reject requests from origins that aren't allowed, based on their Origin or Referer header: off, lenient (allow requests without these headers) or strict")
+
+	markSecretFlags(serveCmd, "jwt-shared-secret", "jwe-secret", "introspection-client-secret", "opds-bearer-token", "s3-secret-key", "http-authorization")
 }
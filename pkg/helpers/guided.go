@@ -0,0 +1,231 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/pub"
+)
+
+const SMILMediaType = "application/smil+xml"
+
+const smilNamespaceEPUB = "http://www.idpf.org/2007/ops"
+
+// GuidedNavigationObject is an item of a Readium Guided Navigation Document.
+type GuidedNavigationObject struct {
+	AudioRef string                   `json:"audioref,omitempty"`
+	ImgRef   string                   `json:"imgref,omitempty"`
+	TextRef  string                   `json:"textref,omitempty"`
+	Text     string                   `json:"text,omitempty"`
+	Role     []string                 `json:"role,omitempty"`
+	Children []GuidedNavigationObject `json:"children,omitempty"`
+}
+
+// GuidedNavigationDocument is a Readium Guided Navigation Document, used to
+// synchronize the audio and text of a publication (read-aloud).
+type GuidedNavigationDocument struct {
+	Guided []GuidedNavigationObject `json:"guided"`
+}
+
+// Generic SMIL element, keeping the order of children
+type smilNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []smilNode `xml:",any"`
+}
+
+func (n smilNode) attr(space, local string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == local && a.Name.Space == space {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n smilNode) child(local string) *smilNode {
+	for i := range n.Children {
+		if n.Children[i].XMLName.Local == local {
+			return &n.Children[i]
+		}
+	}
+	return nil
+}
+
+// Parse a SMIL clock value (such as "0:01:02.5", "12.3s" or "500ms") into seconds.
+func parseClockValue(v string) (float64, error) {
+	v = strings.TrimSpace(v)
+	if strings.Contains(v, ":") {
+		var seconds float64
+		parts := strings.Split(v, ":")
+		if len(parts) > 3 {
+			return 0, errors.New("invalid clock value " + v)
+		}
+		for _, p := range parts {
+			f, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return 0, errors.New("invalid clock value " + v)
+			}
+			seconds = seconds*60 + f
+		}
+		return seconds, nil
+	}
+
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix     string
+		multiplier float64
+	}{{"ms", 0.001}, {"min", 60}, {"h", 3600}, {"s", 1}} {
+		if strings.HasSuffix(v, unit.suffix) {
+			v = strings.TrimSuffix(v, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errors.New("invalid clock value " + v)
+	}
+	return f * multiplier, nil
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', -1, 64)
+}
+
+// Resolve a reference in a SMIL document against the href of the document.
+func resolveSMILRef(smilHref, ref string) string {
+	if ref == "" || strings.Contains(ref, "://") {
+		return ref
+	}
+	p, fragment, hasFragment := strings.Cut(ref, "#")
+	if p == "" {
+		p = path.Base(smilHref)
+	}
+	resolved := path.Join(path.Dir(smilHref), p)
+	if hasFragment {
+		resolved += "#" + fragment
+	}
+	return resolved
+}
+
+func convertSMILNodes(nodes []smilNode, smilHref string) ([]GuidedNavigationObject, error) {
+	var objects []GuidedNavigationObject
+	for _, node := range nodes {
+		var obj GuidedNavigationObject
+		if t := node.attr(smilNamespaceEPUB, "type"); t != "" {
+			obj.Role = strings.Fields(t)
+		}
+
+		switch node.XMLName.Local {
+		case "seq":
+			obj.TextRef = resolveSMILRef(smilHref, node.attr(smilNamespaceEPUB, "textref"))
+			children, err := convertSMILNodes(node.Children, smilHref)
+			if err != nil {
+				return nil, err
+			}
+			obj.Children = children
+		case "par":
+			if text := node.child("text"); text != nil {
+				obj.TextRef = resolveSMILRef(smilHref, text.attr("", "src"))
+			}
+			if audio := node.child("audio"); audio != nil {
+				obj.AudioRef = resolveSMILRef(smilHref, audio.attr("", "src"))
+				begin, end := audio.attr("", "clipBegin"), audio.attr("", "clipEnd")
+				if begin != "" || end != "" {
+					var start float64
+					var err error
+					if begin != "" {
+						if start, err = parseClockValue(begin); err != nil {
+							return nil, err
+						}
+					}
+					obj.AudioRef += "#t=" + formatSeconds(start)
+					if end != "" {
+						stop, err := parseClockValue(end)
+						if err != nil {
+							return nil, err
+						}
+						obj.AudioRef += "," + formatSeconds(stop)
+					}
+				}
+			}
+			if img := node.child("img"); img != nil {
+				obj.ImgRef = resolveSMILRef(smilHref, img.attr("", "src"))
+			}
+		default:
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// GuidedNavigationFromSMIL converts an EPUB 3 Media Overlay document (SMIL) to
+// a Readium Guided Navigation Document. References in the document are resolved
+// against the href of the SMIL document, to make them relative to the publication.
+func GuidedNavigationFromSMIL(r io.Reader, smilHref string) (*GuidedNavigationDocument, error) {
+	var smil smilNode
+	if err := xml.NewDecoder(r).Decode(&smil); err != nil {
+		return nil, errors.Wrap(err, "failed parsing SMIL document")
+	}
+	body := smil.child("body")
+	if body == nil {
+		return nil, errors.New("SMIL document has no body")
+	}
+
+	guided, err := convertSMILNodes(body.Children, smilHref)
+	if err != nil {
+		return nil, err
+	}
+	return &GuidedNavigationDocument{Guided: guided}, nil
+}
+
+// Find the first text reference of guided navigation objects, without its fragment.
+func firstTextResource(objects []GuidedNavigationObject) string {
+	for _, obj := range objects {
+		if obj.TextRef != "" {
+			ref, _, _ := strings.Cut(obj.TextRef, "#")
+			return ref
+		}
+		if ref := firstTextResource(obj.Children); ref != "" {
+			return ref
+		}
+	}
+	return ""
+}
+
+// MediaOverlays converts the media overlays of a publication to Guided Navigation
+// Documents, keyed by the href of the resource of the reading order they apply to.
+func MediaOverlays(ctx context.Context, publication *pub.Publication) (map[string]*GuidedNavigationDocument, error) {
+	documents := make(map[string]*GuidedNavigationDocument)
+	for _, links := range []manifest.LinkList{publication.Manifest.ReadingOrder, publication.Manifest.Resources} {
+		for _, link := range links {
+			if link.MediaType == nil || link.MediaType.String() != SMILMediaType {
+				continue
+			}
+
+			res := publication.Get(ctx, link)
+			data, rerr := res.Read(ctx, 0, 0)
+			res.Close()
+			if rerr != nil {
+				return nil, errors.Wrap(rerr, "failed reading "+link.Href.String())
+			}
+			doc, err := GuidedNavigationFromSMIL(bytes.NewReader(data), link.Href.String())
+			if err != nil {
+				return nil, errors.Wrap(err, "failed converting "+link.Href.String())
+			}
+			if resource := firstTextResource(doc.Guided); resource != "" {
+				documents[resource] = doc
+			}
+		}
+	}
+	return documents, nil
+}
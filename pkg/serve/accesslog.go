@@ -0,0 +1,167 @@
+package serve
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// How the publication of a request is identified in the access log
+const (
+	AccessLogPublicationHash   = "hash"   // Truncated SHA-256 digest of its path
+	AccessLogPublicationRedact = "redact" // Not identified
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Max length of a request ID received from a client or a proxy
+const maxRequestIDLength = 128
+
+type AccessLogConfig struct {
+	Enabled     bool
+	Publication string // One of the AccessLogPublication* constants
+}
+
+type requestLogKey struct{}
+
+// Details of a request for the access log, filled in by its handlers
+type requestLog struct {
+	id          string
+	publication string // Path of the publication, once the token has been validated
+}
+
+// RequestID returns the ID of the request of a context, received in its
+// X-Request-ID header or generated by the server.
+func RequestID(ctx context.Context) string {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.id
+	}
+	return ""
+}
+
+// Record the path of the publication of a request, for the access log.
+func setLoggedPublication(ctx context.Context, path string) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.publication = path
+	}
+}
+
+// Whether a request ID received from a client can be used as is. It's
+// restricted to printable ASCII characters to be safe in logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Path of a request, with the token or encoded path of the publication
+// replaced, since it grants access to the publication and identifies it.
+func redactedPath(r *http.Request) string {
+	token, ok := mux.Vars(r)["path"]
+	if !ok || token == "" {
+		return r.URL.Path
+	}
+	return strings.Replace(r.URL.Path, "/"+token, "/-", 1)
+}
+
+// Address of the client of a request, as reported by a trusted proxy.
+func (s *Server) clientAddress(r *http.Request) string {
+	if s.fromTrustedProxy(r) {
+		if addr := lastHeaderValue(r, "X-Forwarded-For"); addr != "" {
+			return addr
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func (s *Server) loggedPublication(path string) string {
+	if path == "" || s.config.AccessLog.Publication == AccessLogPublicationRedact {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Middleware assigning an ID to each request, returned in the X-Request-ID
+// header and sent to remote storage, and logging the request once its
+// response has been sent, if the access log is enabled.
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl := &requestLog{id: r.Header.Get(requestIDHeader)}
+		if !validRequestID(rl.id) {
+			rl.id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, rl.id)
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("http.request.id", rl.id))
+
+		route := "other"
+		if cr := mux.CurrentRoute(r); cr != nil && cr.GetName() != "" {
+			route = cr.GetName()
+		}
+		if !s.config.AccessLog.Enabled || isProbeRoute(route) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+			return
+		}
+
+		start := time.Now()
+		mw := &metricsResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", rl.id),
+			slog.String("method", r.Method),
+			slog.String("path", redactedPath(r)),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Int64("bytes", mw.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client", s.clientAddress(r)),
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			attrs = append(attrs, slog.String("range", rng))
+		}
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			attrs = append(attrs, slog.String("encoding", encoding))
+		}
+		if publication := s.loggedPublication(rl.publication); publication != "" {
+			attrs = append(attrs, slog.String("publication", publication))
+		}
+		if sc := span.SpanContext(); sc.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+		}
+		if ua := r.UserAgent(); ua != "" {
+			attrs = append(attrs, slog.String("user_agent", ua))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
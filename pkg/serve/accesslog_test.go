@@ -0,0 +1,216 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// Captures the records logged with the default logger during a test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// Records of the access log in a capture.
+func accessLogRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "request" {
+			records = append(records, record)
+		}
+	}
+	buf.Reset()
+	return records
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	buf := captureLog(t)
+	s := NewServer(ServerConfig{AccessLog: AccessLogConfig{Enabled: true}}, Remote{})
+	h := s.Routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	req.Header.Set("Range", "bytes=0-1")
+	req.Header.Set("User-Agent", "test/1.0")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	records := accessLogRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, expected 1", len(records))
+	}
+	record := records[0]
+	expected := map[string]any{
+		"level":      "INFO",
+		"request_id": rec.Header().Get(requestIDHeader),
+		"method":     "GET",
+		"path":       "/version",
+		"route":      "version",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(rec.Body.Len()),
+		"client":     "192.0.2.1",
+		"range":      "bytes=0-1",
+		"user_agent": "test/1.0",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("%s: got %v, expected %v", key, record[key], value)
+		}
+	}
+	if _, ok := record["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms: got %v", record["duration_ms"])
+	}
+	for _, key := range []string{"publication", "encoding", "trace_id"} {
+		if _, ok := record[key]; ok {
+			t.Errorf("unexpected %s: %v", key, record[key])
+		}
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	records = accessLogRecords(t, buf)
+	if len(records) != 1 || records[0]["route"] != "other" || records[0]["status"] != float64(http.StatusNotFound) {
+		t.Errorf("got %v for an unknown path", records)
+	}
+
+	// Probes aren't logged
+	for _, path := range []string{"/health", "/ready"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if records := accessLogRecords(t, buf); len(records) != 0 {
+		t.Errorf("got %d records for probes", len(records))
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	buf := captureLog(t)
+	h := NewServer(ServerConfig{}, Remote{}).Routes()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if records := accessLogRecords(t, buf); len(records) != 0 {
+		t.Errorf("got %d records", len(records))
+	}
+	// Requests still get an ID
+	if !validRequestID(rec.Header().Get(requestIDHeader)) {
+		t.Errorf("got request ID %q", rec.Header().Get(requestIDHeader))
+	}
+}
+
+func TestAccessLogRequestID(t *testing.T) {
+	h := NewServer(ServerConfig{}, Remote{}).accessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(RequestID(r.Context())))
+	}))
+
+	tests := []struct {
+		name   string
+		id     string
+		reused bool
+	}{
+		{"none", "", false},
+		{"valid", "abc-123_XYZ.42", true},
+		{"max length", strings.Repeat("a", maxRequestIDLength), true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"space", "abc 123", false},
+		{"control character", "abc\x1b[31m", false},
+		{"non-ASCII", "abcé", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.id != "" {
+				req.Header.Set(requestIDHeader, tt.id)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(requestIDHeader)
+			if id != rec.Body.String() {
+				t.Errorf("got %q in the context, %q in the response", rec.Body.String(), id)
+			}
+			if (id == tt.id) != tt.reused {
+				t.Errorf("got %q for %q", id, tt.id)
+			}
+			if !tt.reused && len(id) != 32 {
+				t.Errorf("got generated ID %q", id)
+			}
+		})
+	}
+}
+
+func TestAccessLogPublication(t *testing.T) {
+	const path = "s3://bucket/book.epub"
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{"", "37bee3bb55cae595"},
+		{AccessLogPublicationHash, "37bee3bb55cae595"},
+		{AccessLogPublicationRedact, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			buf := captureLog(t)
+			s := NewServer(ServerConfig{AccessLog: AccessLogConfig{Enabled: true, Publication: tt.mode}}, Remote{})
+			h := s.accessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				setLoggedPublication(r.Context(), path)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			records := accessLogRecords(t, buf)
+			if len(records) != 1 {
+				t.Fatalf("got %d records, expected 1", len(records))
+			}
+			got, _ := records[0]["publication"].(string)
+			if got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+			if strings.Contains(buf.String(), path) {
+				t.Error("path of the publication logged")
+			}
+		})
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	s := NewServer(ServerConfig{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, Remote{})
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"192.0.2.1:5000", nil, "192.0.2.1"},
+		{"[2001:db8::1]:5000", nil, "2001:db8::1"},
+		{"192.0.2.1:5000", []string{"198.51.100.1"}, "192.0.2.1"}, // Untrusted
+		{"10.1.2.3:5000", nil, "10.1.2.3"},
+		{"10.1.2.3:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.1.2.3:5000", []string{"203.0.113.1, 198.51.100.1"}, "198.51.100.1"},
+		{"10.1.2.3:5000", []string{"203.0.113.1", "198.51.100.1"}, "198.51.100.1"},
+		{"pipe", nil, "pipe"},
+	}
+	for _, tt := range tests {
+		req := proxiedRequest(tt.remoteAddr)
+		for _, v := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if got := s.clientAddress(req); got != tt.expected {
+			t.Errorf("%s %q: got %q, expected %q", tt.remoteAddr, tt.forwarded, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/readium/cli/pkg/serve/cache"
+)
+
+type adminCacheEntry struct {
+	Key      string    `json:"key"`
+	CachedAt time.Time `json:"cachedAt"`
+	ModTime  time.Time `json:"modTime"`
+	Remote   bool      `json:"remote"`
+}
+
+type adminPublicationCache struct {
+	cache.Stats
+	Items []adminCacheEntry `json:"items"`
+}
+
+type adminCacheStats struct {
+	Publications adminPublicationCache `json:"publications"`
+	IIIF         cache.Stats           `json:"iiif"`
+	Documents    cache.Stats           `json:"documents"`
+	OPDS         *cache.Stats          `json:"opds,omitempty"`
+}
+
+// AdminRoutes returns the router of the admin API, with metrics, profiling and
+// cache management endpoints. It must only be exposed on a private address.
+func (s *Server) AdminRoutes() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/debug/pprof/", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	r.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
+	r.Handle("/debug/pprof/block", pprof.Handler("block"))
+	r.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
+	r.Handle("/debug/pprof/heap", pprof.Handler("heap"))
+	r.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
+	r.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+
+	r.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+
+	r.HandleFunc("/cache", s.getCacheStats).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/cache", s.purgeCache).Methods(http.MethodDelete)
+	r.HandleFunc("/cache/publications", s.evictPublication).Methods(http.MethodDelete)
+
+	return r
+}
+
+func (s *Server) getCacheStats(w http.ResponseWriter, req *http.Request) {
+	stats := adminCacheStats{
+		Publications: adminPublicationCache{
+			Stats: s.lfu.Stats(),
+			Items: []adminCacheEntry{},
+		},
+		IIIF:      s.iiif.Stats(),
+		Documents: s.rewritten.Stats(),
+	}
+	for key, item := range s.lfu.Items() {
+		cp := item.(*cache.CachedPublication)
+		stats.Publications.Items = append(stats.Publications.Items, adminCacheEntry{
+			Key:      key,
+			CachedAt: cp.CachedAt,
+			ModTime:  cp.ModTime,
+			Remote:   cp.Remote,
+		})
+	}
+	slices.SortFunc(stats.Publications.Items, func(a, b adminCacheEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	if s.opds != nil {
+		opds := s.opds.entries.Stats()
+		stats.OPDS = &opds
+	}
+
+	s.writeJSON(w, http.StatusOK, stats)
+}
+
+// Evict a publication from the cache, such as after it has been replaced in
+// storage. The publication is identified by its path, as in the OPDS feed or
+// the b64 access mode, before encoding.
+func (s *Server) evictPublication(w http.ResponseWriter, req *http.Request) {
+	filename := req.URL.Query().Get("path")
+	if filename == "" {
+		s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("missing path of the publication"))
+		return
+	}
+	u, err := publicationURL(filename)
+	if err != nil {
+		s.writePublicationProblem(w, err)
+		return
+	}
+
+	key := u.String()
+	evicted := s.lfu.DelMatching(func(k string) bool { return k == key })
+	images := s.iiif.DelMatching(func(k string) bool { return strings.HasPrefix(k, filename+"\x00") })
+	s.rewritten.DelMatching(func(k string) bool { return strings.HasPrefix(k, filename+"\x00") })
+	if evicted == 0 {
+		s.writeProblem(w, http.StatusNotFound, ErrCodePublicationNotFound, errors.New("publication "+key+" is not cached"))
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"evicted": key,
+		"images":  images,
+	})
+}
+
+// Purge all the caches of the server.
+func (s *Server) purgeCache(w http.ResponseWriter, req *http.Request) {
+	evicted := s.lfu.Len()
+	s.purgeCaches()
+	if s.opds != nil {
+		s.opds.invalidate()
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"evicted": evicted,
+	})
+}
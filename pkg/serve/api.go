@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log/slog"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"slices"
@@ -19,88 +20,158 @@ import (
 	"github.com/readium/cli/pkg/serve/cache"
 	"github.com/readium/go-toolkit/pkg/archive"
 	"github.com/readium/go-toolkit/pkg/asset"
-	"github.com/readium/go-toolkit/pkg/fetcher"
 	"github.com/readium/go-toolkit/pkg/manifest"
 	"github.com/readium/go-toolkit/pkg/pub"
 	"github.com/readium/go-toolkit/pkg/streamer"
 	"github.com/readium/go-toolkit/pkg/util/url"
 	"github.com/zeebo/xxh3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (s *Server) getPublication(ctx context.Context, filename string) (*pub.Publication, bool, time.Time, error) {
+// Turn the path of a publication, as decoded from the request, into its absolute URL.
+// Relative paths are turned into file:/// URLs.
+func publicationURL(filename string) (url.AbsoluteURL, error) {
 	loc, err := url.URLFromString(filename)
 	if err != nil {
-		return nil, false, time.Time{}, errors.Wrap(err, "failed creating URL from filepath")
+		return url.AbsoluteURL{}, newPublicationError(http.StatusBadRequest, ErrCodeInvalidPath, errors.Wrap(err, "failed creating URL from filepath"))
 	}
-	u := url.BaseFile.Resolve(loc).(url.AbsoluteURL) // Turn relative filepaths into file:/// URLs
+	return url.BaseFile.Resolve(loc).(url.AbsoluteURL), nil
+}
 
-	dat, ok := s.lfu.Get(u.String())
-	if !ok {
-		var pub *pub.Publication
-		var remote bool
-		config := streamer.Config{
-			InferA11yMetadata: s.config.InferA11yMetadata,
-			HttpClient:        s.remote.HTTP,
-			AddServiceLinks:   true,
+// Open a publication, without caching it.
+func (s *Server) openPublication(ctx context.Context, u url.AbsoluteURL) (_ *cache.CachedPublication, err error) {
+	ctx, span := tracer.Start(ctx, "openPublication", trace.WithAttributes(attribute.String("publication.scheme", u.Scheme().String())))
+	defer func(start time.Time) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		s.metrics.publicationOpen.WithLabelValues(u.Scheme().String(), result).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}(time.Now())
+
+	var pub *pub.Publication
+	var remote bool
+	var modTime time.Time
+	config := streamer.Config{
+		InferA11yMetadata: s.config.InferA11yMetadata,
+		HttpClient:        s.remote.HTTP,
+		AddServiceLinks:   true,
+	}
+	if !s.remote.AcceptsScheme(u.Scheme()) {
+		return nil, newPublicationError(http.StatusBadRequest, ErrCodeUnsupportedScheme, errors.New("unacceptable scheme "+u.Scheme().String()))
+	}
+	if u.IsFile() {
+		fp := filepath.Join(s.remote.LocalDirectory, path.Clean(u.Path()))
+		path, err := url.FromFilepath(fp)
+		if err != nil {
+			return nil, newPublicationError(http.StatusBadRequest, ErrCodeInvalidPath, errors.Wrap(err, "failed creating URL from filepath"))
+		}
+
+		pub, err = openAsset(ctx, config, asset.File(path))
+		if err != nil {
+			return nil, classifyOpenError(errors.Wrap(err, "failed opening "+path.String()), remote)
 		}
-		if !s.remote.AcceptsScheme(u.Scheme()) {
-			return nil, remote, time.Time{}, errors.New("unacceptable scheme " + u.Scheme().String())
+
+		// The modification time of the file is a stable validator for its resources
+		if fi, err := os.Stat(fp); err == nil {
+			modTime = fi.ModTime()
 		}
-		if u.IsFile() {
-			path, err := url.FromFilepath(filepath.Join(s.remote.LocalDirectory, path.Clean(u.Path())))
+	} else {
+		switch u.Scheme() {
+		case url.SchemeS3:
+			remote = true
+			if s.remote.S3 == nil {
+				return nil, newPublicationError(http.StatusBadRequest, ErrCodeUnsupportedScheme, errors.New("S3 client not configured"))
+			}
+			config.ArchiveFactory = archive.NewS3ArchiveFactory(s.remote.S3, archive.NewDefaultRemoteArchiveConfig())
+			pub, err = openAsset(ctx, config, asset.S3(s.remote.S3, u))
 			if err != nil {
-				return nil, remote, time.Time{}, errors.Wrap(err, "failed creating URL from filepath")
+				return nil, classifyOpenError(errors.Wrap(err, "failed opening "+u.String()), remote)
 			}
-
-			pub, err = streamer.New(config).Open(ctx, asset.File(path), "")
+		case url.SchemeGS:
+			remote = true
+			if s.remote.GCS == nil {
+				return nil, newPublicationError(http.StatusBadRequest, ErrCodeUnsupportedScheme, errors.New("GCS client not configured"))
+			}
+			config.ArchiveFactory = archive.NewGCSArchiveFactory(s.remote.GCS, archive.NewDefaultRemoteArchiveConfig())
+			pub, err = openAsset(ctx, config, asset.GCS(s.remote.GCS, u))
 			if err != nil {
-				return nil, remote, time.Time{}, errors.Wrap(err, "failed opening "+path.String())
+				return nil, classifyOpenError(errors.Wrap(err, "failed opening "+u.String()), remote)
 			}
-		} else {
-			switch u.Scheme() {
-			case url.SchemeS3:
-				remote = true
-				if s.remote.S3 == nil {
-					return nil, remote, time.Time{}, errors.New("S3 client not configured")
-				}
-				config.ArchiveFactory = archive.NewS3ArchiveFactory(s.remote.S3, archive.NewDefaultRemoteArchiveConfig())
-				pub, err = streamer.New(config).Open(ctx, asset.S3(s.remote.S3, u), "")
-				if err != nil {
-					return nil, remote, time.Time{}, errors.Wrap(err, "failed opening "+u.String())
-				}
-			case url.SchemeGS:
-				remote = true
-				if s.remote.GCS == nil {
-					return nil, remote, time.Time{}, errors.New("GCS client not configured")
-				}
-				config.ArchiveFactory = archive.NewGCSArchiveFactory(s.remote.GCS, archive.NewDefaultRemoteArchiveConfig())
-				pub, err = streamer.New(config).Open(ctx, asset.GCS(s.remote.GCS, u), "")
-				if err != nil {
-					return nil, remote, time.Time{}, errors.Wrap(err, "failed opening "+u.String())
-				}
-			case url.SchemeHTTP, url.SchemeHTTPS:
-				remote = true
-				if s.remote.HTTP == nil {
-					return nil, remote, time.Time{}, errors.New("HTTP client not configured")
-				}
-				config.ArchiveFactory = archive.NewHTTPArchiveFactory(s.remote.HTTP, archive.NewDefaultRemoteArchiveConfig())
-				pub, err = streamer.New(config).Open(ctx, asset.HTTP(s.remote.HTTP, u), "")
-				if err != nil {
-					return nil, remote, time.Time{}, errors.Wrap(err, "failed opening "+u.String())
-				}
-			default:
-				return nil, remote, time.Time{}, errors.New("unsupported scheme " + u.Scheme().String())
+		case url.SchemeHTTP, url.SchemeHTTPS:
+			remote = true
+			if s.remote.HTTP == nil {
+				return nil, newPublicationError(http.StatusBadRequest, ErrCodeUnsupportedScheme, errors.New("HTTP client not configured"))
 			}
+			config.ArchiveFactory = archive.NewHTTPArchiveFactory(s.remote.HTTP, archive.NewDefaultRemoteArchiveConfig())
+			pub, err = openAsset(ctx, config, asset.HTTP(s.remote.HTTP, u))
+			if err != nil {
+				return nil, classifyOpenError(errors.Wrap(err, "failed opening "+u.String()), remote)
+			}
+		default:
+			return nil, newPublicationError(http.StatusBadRequest, ErrCodeUnsupportedScheme, errors.New("unsupported scheme "+u.Scheme().String()))
 		}
+	}
+
+	encPub := cache.EncapsulatePublication(pub, remote)
+	if !modTime.IsZero() {
+		encPub.ModTime = modTime
+	}
 
-		// Cache the publication
-		encPub := cache.EncapsulatePublication(pub, remote)
-		s.lfu.Set(u.String(), encPub)
+	return encPub, nil
+}
+
+// Open a publication asset with the streamer. For remote archives, this
+// includes the range requests reading their directory.
+func openAsset(ctx context.Context, config streamer.Config, a asset.PublicationAsset) (*pub.Publication, error) {
+	ctx, span := tracer.Start(ctx, "streamer.Open")
+	pub, err := streamer.New(config).Open(ctx, a, "")
+	endSpan(span, err)
+	return pub, err
+}
 
-		return encPub.Publication, remote, encPub.CachedAt, nil
+// Get a publication from the cache, opening and caching it if needed. The
+// publication must be released with Release once the request is done with it,
+// so that it isn't closed while it's used if it's evicted in the meantime.
+func (s *Server) getPublication(ctx context.Context, filename string) (_ *cache.CachedPublication, err error) {
+	ctx, span := tracer.Start(ctx, "getPublication")
+	defer func() { endSpan(span, err) }()
+
+	u, err := publicationURL(filename)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("publication.url", u.String()))
+
+	dat, ok := s.lfu.Get(u.String())
+	// The publication may have been closed after being evicted since
+	ok = ok && dat.(*cache.CachedPublication).Acquire()
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
+	if ok {
+		return dat.(*cache.CachedPublication), nil
+	}
+
+	// Concurrent requests for a publication that isn't cached share its
+	// opening, which isn't canceled with the request that started it
+	v, err, _ := s.opening.Do(u.String(), func() (any, error) {
+		cp, err := s.openPublication(context.WithoutCancel(ctx), u)
+		if err != nil {
+			return nil, err
+		}
+		s.lfu.Set(u.String(), cp)
+		return cp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cp := v.(*cache.CachedPublication)
+	if !cp.Acquire() {
+		// Evicted and closed in the meantime, such as by a purge
+		return nil, errors.New("publication was evicted while it was opened")
 	}
-	cp := dat.(*cache.CachedPublication)
-	return cp.Publication, cp.Remote, cp.CachedAt, nil
+	return cp, nil
 }
 
 func (s *Server) getManifest(w http.ResponseWriter, req *http.Request) {
@@ -108,33 +179,21 @@ func (s *Server) getManifest(w http.ResponseWriter, req *http.Request) {
 	filename := req.Context().Value(ContextPathKey).(string)
 
 	// Load the publication
-	publication, _, cachedAt, err := s.getPublication(req.Context(), filename)
+	cp, err := s.getPublication(req.Context(), filename)
 	if err != nil {
-		slog.Error("failed opening publication", "error", err)
-		w.WriteHeader(500)
-		if s.config.Debug {
-			w.Write([]byte(err.Error()))
-		}
+		s.writePublicationProblem(w, err)
 		return
 	}
+	defer cp.Release()
+	publication := cp.Publication
 
 	// Create "self" link in manifest
-	scheme := "http://"
-	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
-		// Note: this is never going to be 100% accurate behind proxies,
-		// but it's better than nothing for a dev server.
-		scheme = "https://"
-	}
 	rPath, _ := s.router.Get("manifest").URLPath("path", vars["path"])
 	conformsTo := conformsToAsMimetype(publication.Manifest.Metadata.ConformsTo)
 
-	selfUrl, err := url.AbsoluteURLFromString(scheme + req.Host + rPath.String())
+	selfUrl, err := url.AbsoluteURLFromString(s.baseURL(req) + rPath.String())
 	if err != nil {
-		slog.Error("failed creating self URL", "error", err)
-		w.WriteHeader(500)
-		if s.config.Debug {
-			w.Write([]byte(err.Error()))
-		}
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed creating self URL"))
 		return
 	}
 
@@ -144,32 +203,40 @@ func (s *Server) getManifest(w http.ResponseWriter, req *http.Request) {
 		Href:      manifest.NewHREF(selfUrl),
 	}
 
+	// Resources can be served from a separate origin
+	m := withResourceBaseURL(publication.Manifest, s.resourceBaseURL(req))
+
+	// Advertise the services provided by the server
+	if hasSearchableContent(&m) {
+		m.Links = append(slices.Clone(m.Links), searchServiceLink())
+	}
+	if overlays, err := mediaOverlays(req.Context(), cp); err != nil {
+		slog.Warn("failed converting media overlays", "error", err)
+	} else {
+		m.ReadingOrder = withGuidedNavigationLinks(m.ReadingOrder, publication.Manifest.ReadingOrder, overlays)
+	}
+
 	// Marshal the manifest
 	var j []byte
 	if s.config.JSONIndent == "" {
-		j, err = json.Marshal(publication.Manifest.ToMap(selfLink))
+		j, err = json.Marshal(m.ToMap(selfLink))
 	} else {
-		j, err = json.MarshalIndent(publication.Manifest.ToMap(selfLink), "", s.config.JSONIndent)
+		j, err = json.MarshalIndent(m.ToMap(selfLink), "", s.config.JSONIndent)
 	}
 	if err != nil {
-		slog.Error("failed marshalling manifest JSON", "error", err)
-		w.WriteHeader(500)
-		if s.config.Debug {
-			w.Write([]byte(err.Error()))
-		}
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed marshalling manifest JSON"))
 		return
 	}
 
 	// Add headers
 	w.Header().Set("content-type", conformsTo.String()+"; charset=utf-8")
 	w.Header().Set("cache-control", "private, must-revalidate")
-	w.Header().Set("access-control-allow-origin", "*") // TODO: provide options?
 
 	// Etag based on hash of the manifest bytes
 	etag := `"` + strconv.FormatUint(xxh3.Hash(j), 36) + `"`
 	w.Header().Set("Etag", etag)
 
-	http.ServeContent(w, req, "manifest.json", cachedAt, bytes.NewReader(j))
+	http.ServeContent(w, req, "manifest.json", cp.ModTime, bytes.NewReader(j))
 }
 
 func (s *Server) getAsset(w http.ResponseWriter, r *http.Request) {
@@ -177,24 +244,19 @@ func (s *Server) getAsset(w http.ResponseWriter, r *http.Request) {
 	filename := r.Context().Value(ContextPathKey).(string)
 
 	// Load the publication
-	publication, remote, _, err := s.getPublication(r.Context(), filename)
+	cp, err := s.getPublication(r.Context(), filename)
 	if err != nil {
-		slog.Error("failed opening publication", "error", err)
-		w.WriteHeader(500)
-		if s.config.Debug {
-			w.Write([]byte(err.Error()))
-		}
+		s.writePublicationProblem(w, err)
 		return
 	}
+	defer cp.Release()
+	publication := cp.Publication
+	remote := cp.Remote
 
 	// Parse asset path from mux vars
 	href, err := url.URLFromDecodedPath(path.Clean(vars["asset"]))
 	if err != nil {
-		slog.Error("failed parsing asset path as URL", "error", err)
-		w.WriteHeader(400)
-		if s.config.Debug {
-			w.Write([]byte(err.Error()))
-		}
+		s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidPath, errors.Wrap(err, "failed parsing asset path as URL"))
 		return
 	}
 	rawHref := href.Raw()
@@ -204,7 +266,7 @@ func (s *Server) getAsset(w http.ResponseWriter, r *http.Request) {
 	// Make sure the asset exists in the publication
 	link := publication.LinkWithHref(href)
 	if link == nil {
-		w.WriteHeader(http.StatusNotFound)
+		s.writeProblem(w, http.StatusNotFound, ErrCodeResourceNotFound, errors.New("no resource with href "+href.String()))
 		return
 	}
 	finalLink := *link
@@ -221,128 +283,120 @@ func (s *Server) getAsset(w http.ResponseWriter, r *http.Request) {
 	// Get asset length in bytes
 	l, rerr := res.Length(r.Context())
 	if rerr != nil {
-		w.WriteHeader(rerr.HTTPStatus())
-		w.Write([]byte(rerr.Error()))
+		s.writeProblem(w, rerr.HTTPStatus(), codeForStatus(rerr.HTTPStatus()), rerr)
 		return
 	}
 
 	// Patch mimetype where necessary
-	contentType := link.MediaType.String()
-	if sub, ok := mimeSubstitutions[contentType]; ok {
-		contentType = sub
+	mimeType := link.MediaType.String()
+	if sub, ok := mimeSubstitutions[mimeType]; ok {
+		mimeType = sub
 	}
+	contentType := mimeType
 	if slices.Contains(utfCharsetNeeded, contentType) {
 		contentType += "; charset=utf-8"
 	}
 	w.Header().Set("content-type", contentType)
 	w.Header().Set("cache-control", "private, max-age=86400, immutable")
 	w.Header().Set("content-length", strconv.FormatInt(l, 10))
-	w.Header().Set("access-control-allow-origin", "*") // TODO: provide options?
 
-	var start, end int64
-	// Range reading assets
+	if policy := s.contentSecurityPolicy(filename, mimeType); policy != "" {
+		w.Header().Set("content-security-policy", policy)
+		w.Header().Set("x-content-type-options", "nosniff")
+	}
+
+	// Sanitized documents and documents with injected elements are rewritten in memory
+	rules := s.injectionRules(cp, finalLink, mimeType)
+	if sanitize := s.sanitizes(filename, mimeType); sanitize || rules != nil {
+		etag := resourceETag(r.Context(), filename, finalLink.Href.String(), cp.ModTime, res, l, "")
+		setRepresentation(r.Context(), "decompressed")
+		s.serveRewritten(w, r, cp, res, mimeType, etag, rules, sanitize)
+		return
+	}
+
+	// Compressed passthrough is only possible when responding with the full resource
 	rangeHeader := r.Header.Get("range")
-	if rangeHeader != "" {
+	var encoding string
+	if negotiatesEncoding(res) {
+		// Shared caches must not serve a compressed body, or a 304 for its
+		// validator, to clients that don't accept its encoding
+		w.Header().Add("vary", "Accept-Encoding")
+	}
+	if rangeHeader == "" {
+		encoding = negotiateEncoding(r, res, l)
+	}
+	if encoding != "" {
+		setRepresentation(r.Context(), "passthrough")
+	} else {
+		setRepresentation(r.Context(), "decompressed")
+	}
+
+	// Validators
+	etag := resourceETag(r.Context(), filename, finalLink.Href.String(), cp.ModTime, res, l, encoding)
+	w.Header().Set("etag", etag)
+	w.Header().Set("last-modified", cp.ModTime.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, cp.ModTime) {
+		writeNotModified(w)
+		return
+	}
+
+	if s.config.ReprDigest && !mayBeCompressed(r, mimeType, encoding) {
+		digest, rerr := reprDigest(r.Context(), cp, res, remote, etag, encoding)
+		if rerr != nil {
+			slog.Error("failed computing asset digest", "error", rerr.Error())
+		} else {
+			w.Header().Set("repr-digest", "sha-256=:"+digest+":")
+		}
+	}
+
+	var singleRange *httprange.Range
+	var multipleRanges []httprange.Range
+	// Range reading assets
+	if rangeHeader != "" && ifRangeMatches(r, etag, cp.ModTime) {
 		rng, err := httprange.ParseRange(rangeHeader, l)
 		if err != nil {
-			slog.Error("failed parsing range header", "error", err)
-			w.WriteHeader(http.StatusLengthRequired)
+			w.Header().Set("content-range", "bytes */"+strconv.FormatInt(l, 10))
+			s.writeProblem(w, http.StatusRequestedRangeNotSatisfiable, ErrCodeRangeNotSatisfiable, errors.Wrap(err, "failed parsing range header"))
 			return
 		}
-		if len(rng) > 1 {
-			slog.Error("no support for multiple read ranges")
-			w.WriteHeader(http.StatusNotImplemented)
-			return
+		rng = coalesceRanges(rng)
+		if len(rng) > s.config.MaxRanges {
+			// Too many ranges, ignore the header and respond with the full resource
+			slog.Debug("too many ranges requested", "count", len(rng), "max", s.config.MaxRanges)
+			rng = nil
 		}
-		if len(rng) > 0 {
+		if len(rng) > 1 {
+			multipleRanges = rng
+		} else if len(rng) > 0 {
 			w.Header().Set("content-range", rng[0].ContentRange(l))
-			start = rng[0].Start
-			end = start + rng[0].Length - 1
+			singleRange = &rng[0]
 			w.Header().Set("content-length", strconv.FormatInt(rng[0].Length, 10))
 		}
 	}
-	if w.Header().Get("content-range") != "" {
-		w.WriteHeader(http.StatusPartialContent)
-	} else {
-		w.Header().Set("accept-ranges", "bytes")
-	}
 
-	cres, ok := res.(fetcher.CompressedResource)
-	normalResponse := func() {
-		if r.Method == http.MethodHead {
-			return
-		}
-
-		if remote {
-			var bin []byte
-			bin, rerr = res.Read(r.Context(), start, end)
-			if rerr == nil {
-				_, err = w.Write(bin)
-				if err != nil {
-					rerr = fetcher.Other(err)
-				}
-			}
+	if multipleRanges != nil {
+		rerr = serveMultipartRanges(w, r, res, remote, multipleRanges, contentType, l)
+	} else {
+		status := http.StatusOK
+		if w.Header().Get("content-range") != "" {
+			status = http.StatusPartialContent
 		} else {
-			_, rerr = res.Stream(r.Context(), w, start, end)
+			w.Header().Set("accept-ranges", "bytes")
 		}
-	}
-	if ok && cres.CompressedAs(archive.CompressionMethodDeflate) && start == 0 && end == 0 {
-		// Stream the asset in compressed format if supported by the user agent
-		if supportsEncoding(r, "deflate") {
-			headers := func() {
-				w.Header().Set("content-encoding", "deflate")
-				w.Header().Set("content-length", strconv.FormatInt(cres.CompressedLength(r.Context()), 10))
-			}
-			if r.Method == http.MethodHead {
-				headers()
-				return
-			}
-			if remote {
-				var bin []byte
-				bin, rerr = cres.ReadCompressed(r.Context())
-				if rerr == nil {
-					headers()
-					_, err = w.Write(bin)
-					if err != nil {
-						rerr = fetcher.Other(err)
-					}
-				}
-			} else {
-				headers()
-				_, rerr = cres.StreamCompressed(r.Context(), w)
-			}
-		} else if supportsEncoding(r, "gzip") && l <= archive.GzipMaxLength {
-			headers := func() {
-				w.Header().Set("content-encoding", "gzip")
-				w.Header().Set("content-length", strconv.FormatInt(cres.CompressedLength(r.Context())+archive.GzipWrapperLength, 10))
-			}
-			if r.Method == http.MethodHead {
-				headers()
-				return
-			}
-			if remote {
-				var bin []byte
-				bin, rerr = cres.ReadCompressedGzip(r.Context())
-				if rerr == nil {
-					headers()
-					_, err = w.Write(bin)
-					if err != nil {
-						rerr = fetcher.Other(err)
-					}
-				}
-			} else {
-				headers()
-				_, rerr = cres.StreamCompressedGzip(r.Context(), w)
-			}
-		} else {
-			normalResponse()
+		if encoding != "" {
+			// Stream the asset in compressed format, as supported by the user agent
+			w.Header().Set("content-encoding", encoding)
+			w.Header().Set("content-length", strconv.FormatInt(encodedLength(r.Context(), res, encoding), 10))
+		}
+		w.WriteHeader(status)
+
+		if r.Method != http.MethodHead {
+			rerr = writeRepresentation(r.Context(), w, res, remote, encoding, singleRange)
 		}
-	} else {
-		normalResponse()
 	}
 
 	if rerr != nil {
-		if errors.Is(rerr.Cause, syscall.EPIPE) || errors.Is(rerr.Cause, syscall.ECONNRESET) {
+		if errors.Is(rerr.Cause, syscall.EPIPE) || errors.Is(rerr.Cause, syscall.ECONNRESET) || errors.Is(rerr.Cause, context.Canceled) {
 			// Ignore client errors
 			return
 		}
@@ -1,5 +1,29 @@
 package auth
 
+import (
+	"context"
+	"time"
+)
+
 type AuthProvider interface {
 	Validate(token string) (string, int, error)
 }
+
+// TokenIssuer is implemented by auth providers that can create tokens
+// for the path of a publication, such as for links in an OPDS feed.
+type TokenIssuer interface {
+	Issue(path string, expiresAt time.Time) (string, error)
+}
+
+// ReadinessChecker is implemented by auth providers depending on external
+// resources, such as keys fetched from a remote JWKS, to report whether they
+// can validate tokens.
+type ReadinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// Reloader is implemented by keys loaded from files, such as a Keyring, that
+// can be reloaded without restarting the server, such as on SIGHUP.
+type Reloader interface {
+	Reload() error
+}
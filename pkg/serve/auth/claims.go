@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var errTokenLifetime = errors.New("token lifetime exceeds the maximum")
+
+// ClaimsConfig restricts the JWTs accepted by the JWT auth providers, in
+// addition to their signature, expiry and subject.
+type ClaimsConfig struct {
+	Issuer      string        // Required iss claim, if any
+	Audience    []string      // Accepted aud claims, one of which is required, if any
+	Leeway      time.Duration // Tolerated clock skew when validating exp, nbf and iat
+	MaxLifetime time.Duration // Max duration between the iat and exp claims, which are then required, if any
+}
+
+func (c ClaimsConfig) parserOptions() []jwt.ParserOption {
+	var opts []jwt.ParserOption
+	if c.Leeway > 0 || c.MaxLifetime > 0 {
+		// Tokens issued in the future are only rejected when clock skew is
+		// tolerated, as issuers with a clock slightly ahead would break them
+		opts = append(opts, jwt.WithIssuedAt())
+	}
+	if c.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(c.Issuer))
+	}
+	if len(c.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(c.Audience...))
+	}
+	if c.Leeway > 0 {
+		opts = append(opts, jwt.WithLeeway(c.Leeway))
+	}
+	if c.MaxLifetime > 0 {
+		opts = append(opts, jwt.WithExpirationRequired())
+	}
+	return opts
+}
+
+// Claims of the tokens issued by a provider, so that they pass its own
+// validation.
+func (c ClaimsConfig) registeredClaims(path string, expiresAt time.Time) jwt.RegisteredClaims {
+	claims := jwt.RegisteredClaims{
+		Issuer:    c.Issuer,
+		Subject:   path,
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+	if len(c.Audience) > 0 {
+		claims.Audience = jwt.ClaimStrings{c.Audience[0]}
+	}
+	return claims
+}
+
+func (c ClaimsConfig) validateLifetime(claims jwt.Claims) error {
+	if c.MaxLifetime <= 0 {
+		return nil
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return err
+	}
+	if iat == nil {
+		return fmt.Errorf("%w: iat", jwt.ErrTokenRequiredClaimMissing)
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return err
+	}
+	if exp.Sub(iat.Time) > c.MaxLifetime {
+		return errTokenLifetime
+	}
+	return nil
+}
+
+// Subject of a parsed token, or the status and error to respond with if it
+// isn't valid.
+func (c ClaimsConfig) subject(t *jwt.Token, err error) (string, int, error) {
+	if err != nil {
+		if errors.Is(err, jwkset.ErrKeyNotFound) {
+			return "", http.StatusBadRequest, err
+		} else if errors.Is(err, jwt.ErrTokenMalformed) {
+			return "", http.StatusBadRequest, err
+		} else if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return "", http.StatusBadRequest, err
+		} else if errors.Is(err, jwt.ErrTokenExpired) {
+			return "", http.StatusGone, err
+		} else if errors.Is(err, jwt.ErrTokenInvalidClaims) {
+			// Such as a token for another issuer or audience, or not valid yet
+			return "", http.StatusUnauthorized, err
+		} else {
+			return "", http.StatusInternalServerError, err
+		}
+	}
+	if !t.Valid {
+		return "", http.StatusBadRequest, errors.New("invalid JWT token")
+	}
+	if err := c.validateLifetime(t.Claims); err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	subject, err := t.Claims.GetSubject()
+	if err != nil {
+		return "", http.StatusBadRequest, errors.New("failed extracting subject from JWT")
+	}
+	if subject == "" {
+		return "", http.StatusBadRequest, errors.New("JWT subject is empty")
+	}
+
+	return subject, http.StatusOK, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"time"
 )
 
 type B64EncodedAuthProvider struct{}
@@ -16,6 +17,11 @@ func (n *B64EncodedAuthProvider) Validate(token string) (string, int, error) {
 	return string(path), http.StatusOK, nil
 }
 
+// Issue implements TokenIssuer. Encoded paths never expire.
+func (n *B64EncodedAuthProvider) Issue(path string, expiresAt time.Time) (string, error) {
+	return base64.RawURLEncoding.EncodeToString([]byte(path)), nil
+}
+
 func NewB64EncodedAuthProvider() *B64EncodedAuthProvider {
 	return &B64EncodedAuthProvider{}
 }
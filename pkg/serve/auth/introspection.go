@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/readium/cli/pkg/serve/cache"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultIntrospectionPathField        = "sub"
+	DefaultIntrospectionCacheTTL         = 5 * time.Minute
+	DefaultIntrospectionNegativeCacheTTL = 30 * time.Second
+)
+
+// Max number of introspection results kept in the cache
+const introspectionCacheSize = 10000
+
+// How long a request to the introspection endpoint can take
+const introspectionTimeout = 10 * time.Second
+
+// Max size of an introspection response
+const maxIntrospectionResponseSize = 1 << 20
+
+type IntrospectionConfig struct {
+	Endpoint         string        // URL of the OAuth 2.0 token introspection endpoint (RFC 7662)
+	ClientID         string        // Client authenticating to the endpoint with HTTP Basic authentication
+	ClientSecret     string        // Secret of the client
+	PathField        string        // Member of the introspection response containing the path of the publication
+	CacheTTL         time.Duration // Max duration an active token is cached, also limited by its expiry
+	NegativeCacheTTL time.Duration // Duration an inactive or rejected token is cached
+}
+
+// Cached result of the introspection of a token
+type introspectionResult struct {
+	path      string
+	status    int
+	err       error
+	expiresAt time.Time
+}
+
+func (r *introspectionResult) OnEvict() {}
+
+// IntrospectionAuthProvider validates opaque access tokens with an OAuth 2.0
+// token introspection endpoint (RFC 7662). The path of the publication is
+// taken from a member of the response of active tokens. Results are cached,
+// until the expiry of active tokens, so that the endpoint isn't called for
+// every request, and concurrent validations of a token share one request.
+type IntrospectionAuthProvider struct {
+	client *http.Client
+	config IntrospectionConfig
+	cache  *cache.TinyLFU
+	group  singleflight.Group
+}
+
+func (p *IntrospectionAuthProvider) Validate(token string) (string, int, error) {
+	if token == "" {
+		return "", http.StatusBadRequest, errors.New("token is empty")
+	}
+	// Tokens aren't kept in memory as is
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if v, ok := p.cache.Get(key); ok {
+		if r := v.(*introspectionResult); time.Now().Before(r.expiresAt) {
+			return r.path, r.status, r.err
+		}
+	}
+
+	v, err, _ := p.group.Do(key, func() (any, error) {
+		r, err := p.introspect(token)
+		if err != nil {
+			// Failures of the endpoint aren't cached
+			return nil, err
+		}
+		p.cache.Set(key, r)
+		return r, nil
+	})
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	r := v.(*introspectionResult)
+	return r.path, r.status, r.err
+}
+
+// Request the introspection of a token, and turn the response into a
+// result to cache.
+func (p *IntrospectionAuthProvider) introspect(token string) (*introspectionResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), introspectionTimeout)
+	defer cancel()
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientID != "" {
+		// Credentials are form-encoded first, see RFC 6749 section 2.3.1
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed requesting token introspection: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token introspection failed with status %d", res.StatusCode)
+	}
+
+	var response map[string]any
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxIntrospectionResponseSize)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed decoding token introspection response: %w", err)
+	}
+
+	now := time.Now()
+	rejected := func(err error) *introspectionResult {
+		return &introspectionResult{status: http.StatusUnauthorized, err: err, expiresAt: now.Add(p.config.NegativeCacheTTL)}
+	}
+	if active, _ := response["active"].(bool); !active {
+		return rejected(errors.New("token is not active")), nil
+	}
+	expiresAt := now.Add(p.config.CacheTTL)
+	if exp, ok := response["exp"].(float64); ok {
+		expiry := time.Unix(int64(exp), 0)
+		if !expiry.After(now) {
+			return &introspectionResult{status: http.StatusGone, err: errors.New("token is expired"), expiresAt: now.Add(p.config.NegativeCacheTTL)}, nil
+		}
+		if expiry.Before(expiresAt) {
+			expiresAt = expiry
+		}
+	}
+	path, _ := response[p.config.PathField].(string)
+	if path == "" {
+		return rejected(fmt.Errorf("token introspection response has no %q member", p.config.PathField)), nil
+	}
+	return &introspectionResult{path: path, status: http.StatusOK, expiresAt: expiresAt}, nil
+}
+
+// NewIntrospectionAuthProvider returns a provider validating tokens with an
+// introspection endpoint, requested with a client such as one created with
+// client.NewHTTPClient, to restrict the addresses it can reach.
+func NewIntrospectionAuthProvider(client *http.Client, config IntrospectionConfig) (*IntrospectionAuthProvider, error) {
+	if client == nil {
+		return nil, errors.New("no HTTP client for token introspection")
+	}
+	u, err := url.Parse(config.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("introspection endpoint %q must be an http or https URL", config.Endpoint)
+	}
+	if config.ClientID == "" && config.ClientSecret != "" {
+		return nil, errors.New("introspection client secret requires a client ID")
+	}
+	if config.PathField == "" {
+		config.PathField = DefaultIntrospectionPathField
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = DefaultIntrospectionCacheTTL
+	}
+	if config.NegativeCacheTTL <= 0 {
+		config.NegativeCacheTTL = DefaultIntrospectionNegativeCacheTTL
+	}
+
+	c := cache.NewTinyLFU(introspectionCacheSize, max(config.CacheTTL, config.NegativeCacheTTL))
+	c.UseRandomizedTTL(0) // Results expire with the token anyway
+	return &IntrospectionAuthProvider{
+		client: client,
+		config: config,
+		cache:  c,
+	}, nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Stand-in introspection endpoint, counting its requests.
+type introspectionServer struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+func newIntrospectionServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *introspectionServer {
+	s := &introspectionServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func respond(w http.ResponseWriter, response map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func newTestIntrospectionProvider(t *testing.T, s *introspectionServer, config IntrospectionConfig) *IntrospectionAuthProvider {
+	config.Endpoint = s.URL
+	p, err := NewIntrospectionAuthProvider(s.Client(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestIntrospectionResponses(t *testing.T) {
+	s := newIntrospectionServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostFormValue("token") {
+		case "active":
+			respond(w, map[string]any{"active": true, "sub": "book.epub", "exp": time.Now().Add(time.Hour).Unix()})
+		case "inactive":
+			respond(w, map[string]any{"active": false})
+		case "expired":
+			respond(w, map[string]any{"active": true, "sub": "book.epub", "exp": time.Now().Add(-time.Minute).Unix()})
+		case "no-path":
+			respond(w, map[string]any{"active": true, "username": "reader"})
+		}
+	})
+	p := newTestIntrospectionProvider(t, s, IntrospectionConfig{})
+
+	tests := []struct {
+		token  string
+		path   string
+		status int
+	}{
+		{"active", "book.epub", http.StatusOK},
+		{"inactive", "", http.StatusUnauthorized},
+		{"expired", "", http.StatusGone},
+		{"no-path", "", http.StatusUnauthorized},
+		{"", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		path, status, err := p.Validate(tt.token)
+		if path != tt.path || status != tt.status {
+			t.Errorf("token %q: got %q, %d, %v, expected %q, %d", tt.token, path, status, err, tt.path, tt.status)
+		}
+		if (err == nil) != (tt.status == http.StatusOK) {
+			t.Errorf("token %q: unexpected error %v", tt.token, err)
+		}
+	}
+}
+
+func TestIntrospectionPathField(t *testing.T) {
+	s := newIntrospectionServer(t, func(w http.ResponseWriter, r *http.Request) {
+		respond(w, map[string]any{"active": true, "sub": "user", "publication": "book.epub"})
+	})
+	p := newTestIntrospectionProvider(t, s, IntrospectionConfig{PathField: "publication"})
+	if path, status, err := p.Validate("token"); path != "book.epub" || status != http.StatusOK {
+		t.Errorf("got %q, %d, %v", path, status, err)
+	}
+}
+
+func TestIntrospectionCache(t *testing.T) {
+	exp := time.Now().Add(time.Minute).Unix()
+	s := newIntrospectionServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostFormValue("token") {
+		case "active":
+			respond(w, map[string]any{"active": true, "sub": "book.epub", "exp": exp})
+		case "inactive":
+			respond(w, map[string]any{"active": false})
+		}
+	})
+	p := newTestIntrospectionProvider(t, s, IntrospectionConfig{CacheTTL: time.Hour})
+
+	for range 3 {
+		p.Validate("active")
+		p.Validate("inactive")
+	}
+	if n := s.requests.Load(); n != 2 {
+		t.Errorf("endpoint requested %d times, expected 2", n)
+	}
+
+	// Active tokens are cached until their expiry, before the TTL
+	sum := sha256.Sum256([]byte("active"))
+	v, ok := p.cache.Get(hex.EncodeToString(sum[:]))
+	if !ok {
+		t.Fatal("active token isn't cached")
+	}
+	if expiresAt := v.(*introspectionResult).expiresAt; !expiresAt.Equal(time.Unix(exp, 0)) {
+		t.Errorf("cached until %v, expected the expiry of the token %v", expiresAt, time.Unix(exp, 0))
+	}
+}
+
+func TestIntrospectionFailuresArentCached(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	s := newIntrospectionServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		respond(w, map[string]any{"active": true, "sub": "book.epub"})
+	})
+	p := newTestIntrospectionProvider(t, s, IntrospectionConfig{})
+
+	if _, status, err := p.Validate("token"); status != http.StatusBadGateway || err == nil {
+		t.Errorf("got %d, %v, expected %d", status, err, http.StatusBadGateway)
+	}
+	failing.Store(false)
+	if path, status, err := p.Validate("token"); path != "book.epub" || status != http.StatusOK {
+		t.Errorf("got %q, %d, %v after the endpoint recovered", path, status, err)
+	}
+	if n := s.requests.Load(); n != 2 {
+		t.Errorf("endpoint requested %d times, expected 2", n)
+	}
+}
+
+func TestIntrospectionClientCredentials(t *testing.T) {
+	var clientID, clientSecret string
+	var ok bool
+	s := newIntrospectionServer(t, func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok = r.BasicAuth()
+		respond(w, map[string]any{"active": true, "sub": "book.epub"})
+	})
+	p := newTestIntrospectionProvider(t, s, IntrospectionConfig{ClientID: "web reader:1", ClientSecret: "s3cr&t=%"})
+	if _, status, err := p.Validate("token"); status != http.StatusOK {
+		t.Fatalf("got %d, %v", status, err)
+	}
+	// Credentials are form-encoded, see RFC 6749 section 2.3.1
+	if !ok || clientID != "web+reader%3A1" || clientSecret != "s3cr%26t%3D%25" {
+		t.Errorf("got credentials %q, %q", clientID, clientSecret)
+	}
+}
+
+func TestIntrospectionConcurrentValidations(t *testing.T) {
+	release := make(chan struct{})
+	requested := make(chan struct{}, 1)
+	s := newIntrospectionServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-release
+		respond(w, map[string]any{"active": true, "sub": "book.epub"})
+	})
+	p := newTestIntrospectionProvider(t, s, IntrospectionConfig{})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if path, status, err := p.Validate("token"); path != "book.epub" || status != http.StatusOK {
+				t.Errorf("got %q, %d, %v", path, status, err)
+			}
+		}()
+	}
+	<-requested
+	// Let the other validations wait for the same request
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := s.requests.Load(); n != 1 {
+		t.Errorf("endpoint requested %d times, expected 1", n)
+	}
+}
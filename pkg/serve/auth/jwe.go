@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// Key management algorithms supported for encrypted tokens, by type of key
+var (
+	jweSymmetricAlgorithms = []jose.KeyAlgorithm{
+		jose.DIRECT,
+		jose.A128KW, jose.A192KW, jose.A256KW,
+		jose.A128GCMKW, jose.A192GCMKW, jose.A256GCMKW,
+	}
+	jweECAlgorithms = []jose.KeyAlgorithm{
+		jose.ECDH_ES,
+		jose.ECDH_ES_A128KW, jose.ECDH_ES_A192KW, jose.ECDH_ES_A256KW,
+	}
+	jweRSAAlgorithms = []jose.KeyAlgorithm{
+		jose.RSA_OAEP, jose.RSA_OAEP_256,
+	}
+)
+
+// Size of the symmetric key of the key wrapping algorithms
+var jweKeyWrapSizes = map[jose.KeyAlgorithm]int{
+	jose.A128KW:    16,
+	jose.A192KW:    24,
+	jose.A256KW:    32,
+	jose.A128GCMKW: 16,
+	jose.A192GCMKW: 24,
+	jose.A256GCMKW: 32,
+}
+
+// Content encryption algorithms supported for encrypted tokens, with the
+// size of their key, which is the size of the symmetric key in dir mode
+var jweEncryptions = map[jose.ContentEncryption]int{
+	jose.A128GCM:       16,
+	jose.A192GCM:       24,
+	jose.A256GCM:       32,
+	jose.A128CBC_HS256: 32,
+	jose.A192CBC_HS384: 48,
+	jose.A256CBC_HS512: 64,
+}
+
+// JWEAuthProvider accepts compact JWE tokens, to hide the path of
+// publications from the users holding their URL. Tokens are decrypted, and
+// must contain a signed JWT (a nested JWT, with the "JWT" content type), which
+// is validated by the wrapped provider.
+type JWEAuthProvider struct {
+	key           interface{} // []byte, *ecdsa.PrivateKey or *rsa.PrivateKey
+	keyAlgorithms []jose.KeyAlgorithm
+	encryptions   []jose.ContentEncryption
+	next          AuthProvider
+}
+
+func (j *JWEAuthProvider) Validate(token string) (string, int, error) {
+	jwe, err := jose.ParseEncryptedCompact(token, j.keyAlgorithms, j.encryptions)
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid JWE token: %w", err)
+	}
+	if cty, _ := jwe.Header.ExtraHeaders[jose.HeaderContentType].(string); !strings.EqualFold(cty, "JWT") {
+		return "", http.StatusBadRequest, errors.New("JWE token doesn't contain a JWT")
+	}
+	inner, err := jwe.Decrypt(j.key)
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("failed decrypting JWE token: %w", err)
+	}
+	return j.next.Validate(string(inner))
+}
+
+// Issue implements TokenIssuer, encrypting the tokens issued by the wrapped
+// provider with the first allowed algorithms. It fails if the wrapped
+// provider can't issue tokens.
+func (j *JWEAuthProvider) Issue(path string, expiresAt time.Time) (string, error) {
+	issuer, ok := j.next.(TokenIssuer)
+	if !ok {
+		return "", errors.New("tokens can't be issued by the wrapped auth provider")
+	}
+	inner, err := issuer.Issue(path, expiresAt)
+	if err != nil {
+		return "", err
+	}
+
+	var key interface{}
+	switch k := j.key.(type) {
+	case *ecdsa.PrivateKey:
+		key = &k.PublicKey
+	case *rsa.PrivateKey:
+		key = &k.PublicKey
+	default:
+		key = k
+	}
+	encrypter, err := jose.NewEncrypter(
+		j.encryptions[0],
+		jose.Recipient{Algorithm: j.keyAlgorithms[0], Key: key},
+		(&jose.EncrypterOptions{}).WithContentType("JWT"),
+	)
+	if err != nil {
+		return "", err
+	}
+	jwe, err := encrypter.Encrypt([]byte(inner))
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+
+// Ready implements ReadinessChecker, reporting the readiness of the wrapped
+// provider, if it depends on external resources.
+func (j *JWEAuthProvider) Ready(ctx context.Context) error {
+	if rc, ok := j.next.(ReadinessChecker); ok {
+		return rc.Ready(ctx)
+	}
+	return nil
+}
+
+// ParseJWEPrivateKey parses the EC or RSA private key of a PEM file, used to
+// decrypt JWE tokens.
+func ParseJWEPrivateKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected %s block, expected a private key", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s block: %w", block.Type, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T, expected an EC or RSA key", key)
+	}
+}
+
+// NewJWEAuthProvider returns a provider decrypting JWE tokens with a key,
+// which is either a symmetric key ([]byte) or a private key parsed with
+// ParseJWEPrivateKey, and validating their content with another provider.
+// Only the given key management and content encryption algorithms are
+// allowed. The key management algorithms default to dir, ECDH-ES or
+// RSA-OAEP-256 depending on the key, and the content encryption to A256GCM.
+func NewJWEAuthProvider(key interface{}, keyAlgorithms []string, encryptions []string, next AuthProvider) (*JWEAuthProvider, error) {
+	var supported []jose.KeyAlgorithm
+	var defaultAlgorithm jose.KeyAlgorithm
+	switch k := key.(type) {
+	case []byte:
+		if len(k) < 16 {
+			return nil, errors.New("length of JWE key is less than 16 bytes")
+		}
+		supported, defaultAlgorithm = jweSymmetricAlgorithms, jose.DIRECT
+	case *ecdsa.PrivateKey:
+		supported, defaultAlgorithm = jweECAlgorithms, jose.ECDH_ES
+	case *rsa.PrivateKey:
+		supported, defaultAlgorithm = jweRSAAlgorithms, jose.RSA_OAEP_256
+	default:
+		return nil, fmt.Errorf("unsupported JWE key type %T", key)
+	}
+
+	j := &JWEAuthProvider{key: key, next: next}
+	if len(keyAlgorithms) == 0 {
+		j.keyAlgorithms = []jose.KeyAlgorithm{defaultAlgorithm}
+	}
+	for _, alg := range keyAlgorithms {
+		if !slices.Contains(supported, jose.KeyAlgorithm(alg)) {
+			return nil, fmt.Errorf("unsupported JWE key management algorithm %q for the key, acceptable values: %s", alg, joinAlgorithms(supported))
+		}
+		j.keyAlgorithms = append(j.keyAlgorithms, jose.KeyAlgorithm(alg))
+	}
+	if len(encryptions) == 0 {
+		j.encryptions = []jose.ContentEncryption{jose.A256GCM}
+	}
+	for _, enc := range encryptions {
+		if _, ok := jweEncryptions[jose.ContentEncryption(enc)]; !ok {
+			return nil, fmt.Errorf("unsupported JWE content encryption algorithm %q, acceptable values: %s", enc, joinAlgorithms(slices.Sorted(maps.Keys(jweEncryptions))))
+		}
+		j.encryptions = append(j.encryptions, jose.ContentEncryption(enc))
+	}
+
+	if k, ok := key.([]byte); ok {
+		// Key wrapping algorithms require a key of the size of their AES key
+		for _, alg := range j.keyAlgorithms {
+			if size, ok := jweKeyWrapSizes[alg]; ok && len(k) != size {
+				return nil, fmt.Errorf("length of JWE key must be %d bytes for %s", size, alg)
+			}
+		}
+		// In dir mode, the key is the content encryption key
+		if slices.Contains(j.keyAlgorithms, jose.DIRECT) {
+			for _, enc := range j.encryptions {
+				if size := jweEncryptions[enc]; len(k) != size {
+					return nil, fmt.Errorf("length of JWE key must be %d bytes for dir and %s", size, enc)
+				}
+			}
+		}
+	}
+	return j, nil
+}
+
+func joinAlgorithms[T ~string](algs []T) string {
+	s := make([]string, len(algs))
+	for i, alg := range algs {
+		s[i] = string(alg)
+	}
+	return strings.Join(s, ", ")
+}
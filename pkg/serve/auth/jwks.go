@@ -3,63 +3,74 @@ package auth
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/MicahParks/jwkset"
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type JWKSAuthProvider struct {
 	kf     keyfunc.Keyfunc
+	claims ClaimsConfig
 	parser *jwt.Parser
+
+	mu               sync.Mutex
+	lastRefreshError error
 }
 
 func (j *JWKSAuthProvider) Validate(token string) (string, int, error) {
 	t, err := j.parser.Parse(token, j.kf.Keyfunc)
-	if err != nil {
-		if errors.Is(err, jwkset.ErrKeyNotFound) {
-			return "", http.StatusBadRequest, err
-		} else if errors.Is(err, jwt.ErrTokenMalformed) {
-			return "", http.StatusBadRequest, err
-		} else if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
-			return "", http.StatusBadRequest, err
-		} else if errors.Is(err, jwt.ErrTokenExpired) {
-			return "", http.StatusGone, err
-		} else {
-			return "", http.StatusInternalServerError, err
-		}
-	}
-	if !t.Valid {
-		return "", http.StatusBadRequest, errors.New("invalid JWT token")
-	}
-	subject, err := t.Claims.GetSubject()
-	if err != nil {
-		return "", http.StatusBadRequest, errors.New("failed extracting subject from JWT")
-	}
-	if subject == "" {
-		return "", http.StatusBadRequest, errors.New("JWT subject is empty")
-	}
-
-	return subject, http.StatusOK, nil
+	return j.claims.subject(t, err)
 }
 
-func NewJWKSAuthProvider(context context.Context, client *http.Client, jwksUrl string) (*JWKSAuthProvider, error) {
+func NewJWKSAuthProvider(ctx context.Context, client *http.Client, jwksUrl string, claims ClaimsConfig) (*JWKSAuthProvider, error) {
 	if len(jwksUrl) == 0 {
 		return nil, errors.New("JWKS URL is empty")
 	}
 
-	kf, err := keyfunc.NewDefaultOverrideCtx(context, []string{jwksUrl}, keyfunc.Override{
+	j := &JWKSAuthProvider{
+		claims: claims,
+		parser: jwt.NewParser(claims.parserOptions()...),
+	}
+	kf, err := keyfunc.NewDefaultOverrideCtx(ctx, []string{jwksUrl}, keyfunc.Override{
 		Client:          client,
 		RefreshInterval: time.Hour * 12,
+		RefreshErrorHandlerFunc: func(u string) func(ctx context.Context, err error) {
+			return func(ctx context.Context, err error) {
+				slog.ErrorContext(ctx, "failed refreshing JWKS", "url", u, "error", err)
+				j.mu.Lock()
+				j.lastRefreshError = err
+				j.mu.Unlock()
+			}
+		},
 	})
 	if err != nil {
 		return nil, err
 	}
+	j.kf = kf
+
+	return j, nil
+}
+
+// Ready implements ReadinessChecker. The provider is ready as long as keys
+// are loaded, even if they couldn't be refreshed since.
+func (j *JWKSAuthProvider) Ready(ctx context.Context) error {
+	keys, err := j.kf.Storage().KeyReadAll(ctx)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return nil
+	}
 
-	return &JWKSAuthProvider{
-		kf:     kf,
-		parser: jwt.NewParser(),
-	}, nil
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.lastRefreshError != nil {
+		return fmt.Errorf("no keys loaded from the JWKS: %w", j.lastRefreshError)
+	}
+	return errors.New("no keys loaded from the JWKS")
 }
@@ -2,7 +2,8 @@ package auth
 
 import (
 	"errors"
-	"net/http"
+	"fmt"
+	"time"
 
 	"github.com/MicahParks/jwkset"
 	"github.com/golang-jwt/jwt/v5"
@@ -10,48 +11,62 @@ import (
 
 type JWTAuthProvider struct {
 	sharedSecret []byte
+	keyring      *Keyring // Replaces the shared secret, if any
+	claims       ClaimsConfig
 	parser       *jwt.Parser
 }
 
 func (j *JWTAuthProvider) Validate(token string) (string, int, error) {
 	t, err := j.parser.Parse(token, func(t *jwt.Token) (interface{}, error) {
 		// We're relying on the parser to enforce method HS256
-		return j.sharedSecret, nil
-	})
-	if err != nil {
-		if errors.Is(err, jwkset.ErrKeyNotFound) {
-			return "", http.StatusBadRequest, err
-		} else if errors.Is(err, jwt.ErrTokenMalformed) {
-			return "", http.StatusBadRequest, err
-		} else if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
-			return "", http.StatusBadRequest, err
-		} else if errors.Is(err, jwt.ErrTokenExpired) {
-			return "", http.StatusGone, err
-		} else {
-			return "", http.StatusInternalServerError, err
+		if j.keyring == nil {
+			return j.sharedSecret, nil
 		}
-	}
-	if !t.Valid {
-		return "", http.StatusBadRequest, errors.New("invalid JWT token")
-	}
-	subject, err := t.Claims.GetSubject()
-	if err != nil {
-		return "", http.StatusBadRequest, errors.New("failed extracting subject from JWT")
-	}
-	if subject == "" {
-		return "", http.StatusBadRequest, errors.New("JWT subject is empty")
-	}
+		kid, _ := t.Header["kid"].(string)
+		secret, ok := j.keyring.secret(kid)
+		if !ok {
+			return nil, fmt.Errorf("%w: kid %q", jwkset.ErrKeyNotFound, kid)
+		}
+		return secret, nil
+	})
+	return j.claims.subject(t, err)
+}
 
-	return subject, http.StatusOK, nil
+// Issue implements TokenIssuer. With a keyring, tokens are signed with its
+// current key.
+func (j *JWTAuthProvider) Issue(path string, expiresAt time.Time) (string, error) {
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, j.claims.registeredClaims(path, expiresAt))
+	if j.keyring == nil {
+		return t.SignedString(j.sharedSecret)
+	}
+	kid, secret := j.keyring.currentKey()
+	t.Header["kid"] = kid
+	return t.SignedString(secret)
 }
 
-func NewJWTAuthProvider(sharedSecret []byte) (*JWTAuthProvider, error) {
+func NewJWTAuthProvider(sharedSecret []byte, claims ClaimsConfig) (*JWTAuthProvider, error) {
 	if len(sharedSecret) < 8 {
 		return nil, errors.New("length of JWT shared secret is less than 8 bytes")
 	}
 
 	return &JWTAuthProvider{
 		sharedSecret: sharedSecret,
-		parser:       jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()})),
+		claims:       claims,
+		parser:       newHS256Parser(claims),
 	}, nil
 }
+
+// NewJWTKeyringAuthProvider returns a provider validating JWTs signed with
+// the keys of a keyring, selected by their kid header. Tokens without a kid
+// are validated with the current key.
+func NewJWTKeyringAuthProvider(keyring *Keyring, claims ClaimsConfig) *JWTAuthProvider {
+	return &JWTAuthProvider{
+		keyring: keyring,
+		claims:  claims,
+		parser:  newHS256Parser(claims),
+	}
+}
+
+func newHS256Parser(claims ClaimsConfig) *jwt.Parser {
+	return jwt.NewParser(append(claims.parserOptions(), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))...)
+}
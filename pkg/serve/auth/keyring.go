@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/readium/cli/pkg/serve/filewatch"
+)
+
+type keyringKey struct {
+	secret    []byte
+	retiredAt time.Time // When the key was removed from the file, zero if it's still in it
+}
+
+// Keyring holds HS256 secrets identified by the kid header of JWTs, loaded
+// from a file with one key per line:
+//
+//	# <kid> <hex-encoded secret>
+//	2025-06 8f0b...
+//	2025-01 c41a...
+//
+// The first key is the current one, used to issue tokens. The file is
+// reloaded when it changes on disk, or when Reload is called, such as on
+// SIGHUP. Keys removed from the file are still accepted during a grace
+// period, so that the tokens they signed remain valid until they expire.
+type Keyring struct {
+	file    string
+	grace   time.Duration
+	watcher *filewatch.Watcher
+
+	mu      sync.RWMutex
+	keys    map[string]*keyringKey
+	current string
+}
+
+func NewKeyring(file string, grace time.Duration) (*Keyring, error) {
+	k := &Keyring{
+		file:  file,
+		grace: grace,
+		keys:  make(map[string]*keyringKey),
+	}
+	var err error
+	k.watcher, err = filewatch.New([]string{file}, k.load)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Parse the keys of a keyring file, in order.
+func parseKeyring(data []byte) ([]string, map[string][]byte, error) {
+	var kids []string
+	secrets := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: expected a key ID and a hex-encoded secret", line)
+		}
+		kid := fields[0]
+		if _, ok := secrets[kid]; ok {
+			return nil, nil, fmt.Errorf("line %d: duplicate key ID %q", line, kid)
+		}
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: failed decoding hex-encoded secret of key %q", line, kid)
+		}
+		if len(secret) < 8 {
+			return nil, nil, fmt.Errorf("line %d: length of secret of key %q is less than 8 bytes", line, kid)
+		}
+		kids = append(kids, kid)
+		secrets[kid] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(kids) == 0 {
+		return nil, nil, errors.New("no key found")
+	}
+	return kids, secrets, nil
+}
+
+// Reload reads the keyring file. Keys that are no longer in it are retired,
+// and dropped once their grace period is over. If the file is invalid, the
+// current keys are kept.
+func (k *Keyring) Reload() error {
+	return k.watcher.Load()
+}
+
+func (k *Keyring) load() error {
+	data, err := os.ReadFile(k.file)
+	if err != nil {
+		return fmt.Errorf("failed reading keyring file: %w", err)
+	}
+	kids, secrets, err := parseKeyring(data)
+	if err != nil {
+		return fmt.Errorf("invalid keyring file %s: %w", k.file, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	for kid, key := range k.keys {
+		if _, ok := secrets[kid]; ok {
+			continue
+		}
+		if key.retiredAt.IsZero() {
+			key.retiredAt = now
+			slog.Info("JWT key retired", "kid", kid, "grace", k.grace)
+		}
+	}
+	for kid, secret := range secrets {
+		k.keys[kid] = &keyringKey{secret: secret}
+	}
+	k.current = kids[0]
+	k.prune(now)
+	return nil
+}
+
+// Drop the retired keys whose grace period is over.
+func (k *Keyring) prune(now time.Time) {
+	for kid, key := range k.keys {
+		if !key.retiredAt.IsZero() && now.Sub(key.retiredAt) >= k.grace {
+			delete(k.keys, kid)
+		}
+	}
+}
+
+// Reload the keyring file if it changed since it was last checked. If
+// reloading fails, the current keys are kept.
+func (k *Keyring) reloadIfChanged() {
+	if reloaded, err := k.watcher.Check(); err != nil {
+		// The file may be in the middle of being replaced
+		slog.Warn("failed reloading keyring, keeping the current keys", "error", err)
+	} else if reloaded {
+		slog.Info("JWT keyring reloaded", "file", k.file)
+	}
+}
+
+// Secret of the key with an ID, or of the current key if the ID is empty.
+func (k *Keyring) secret(kid string) ([]byte, bool) {
+	k.reloadIfChanged()
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" {
+		kid = k.current
+	}
+	key, ok := k.keys[kid]
+	if !ok || (!key.retiredAt.IsZero() && time.Since(key.retiredAt) >= k.grace) {
+		return nil, false
+	}
+	return key.secret, true
+}
+
+// ID and secret of the current key.
+func (k *Keyring) currentKey() (string, []byte) {
+	k.reloadIfChanged()
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current].secret
+}
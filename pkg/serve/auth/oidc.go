@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Max size of an OpenID Connect discovery document
+const maxDiscoveryDocumentSize = 1 << 20
+
+type oidcConfiguration struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// DiscoverJWKSURL returns the URL of the JWKS of an OpenID Connect issuer,
+// from its /.well-known/openid-configuration discovery document.
+func DiscoverJWKSURL(ctx context.Context, client *http.Client, issuer string) (string, error) {
+	if issuer == "" {
+		return "", errors.New("OIDC issuer is empty")
+	}
+	if client == nil {
+		return "", errors.New("no HTTP client for OIDC discovery")
+	}
+
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed fetching %s: %w", discoveryURL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed fetching %s: status %d", discoveryURL, res.StatusCode)
+	}
+
+	var config oidcConfiguration
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxDiscoveryDocumentSize)).Decode(&config); err != nil {
+		return "", fmt.Errorf("failed decoding %s: %w", discoveryURL, err)
+	}
+	// The issuer of the document must be the one it was fetched from, as in
+	// the iss claim of its tokens, see
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation
+	if config.Issuer != issuer {
+		return "", fmt.Errorf("issuer %q of %s doesn't match %q", config.Issuer, discoveryURL, issuer)
+	}
+	if config.JWKSURI == "" {
+		return "", fmt.Errorf("no jwks_uri in %s", discoveryURL)
+	}
+	return config.JWKSURI, nil
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/readium/cli/pkg/serve/filewatch"
+)
+
+// Asymmetric algorithms supported in pem mode
+var pemAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// PEMAuthProvider validates JWTs signed with asymmetric keys, whose public
+// keys or certificates are loaded from PEM files. The files are reloaded when
+// they change on disk, or when Reload is called, such as on SIGHUP.
+type PEMAuthProvider struct {
+	files   []string
+	claims  ClaimsConfig
+	parser  *jwt.Parser
+	watcher *filewatch.Watcher
+
+	mu   sync.RWMutex
+	keys []crypto.PublicKey
+}
+
+func (p *PEMAuthProvider) Validate(token string) (string, int, error) {
+	p.reloadIfChanged()
+	t, err := p.parser.Parse(token, p.keyfunc)
+	return p.claims.subject(t, err)
+}
+
+// Keys that can verify a token, depending on its algorithm, which the parser
+// restricts to the allowed ones.
+func (p *PEMAuthProvider) keyfunc(t *jwt.Token) (interface{}, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var set jwt.VerificationKeySet
+	for _, key := range p.keys {
+		var ok bool
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			_, ok = key.(*rsa.PublicKey)
+		case *jwt.SigningMethodECDSA:
+			_, ok = key.(*ecdsa.PublicKey)
+		case *jwt.SigningMethodEd25519:
+			_, ok = key.(ed25519.PublicKey)
+		}
+		if ok {
+			set.Keys = append(set.Keys, key)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("%w: no key for algorithm %s", jwkset.ErrKeyNotFound, t.Method.Alg())
+	}
+	return set, nil
+}
+
+// Parse the public keys of a PEM file, from PUBLIC KEY, RSA PUBLIC KEY or
+// CERTIFICATE blocks. The validity of certificates isn't checked.
+func parsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			if strings.Contains(block.Type, "PRIVATE KEY") {
+				return nil, fmt.Errorf("unexpected %s block, only public keys must be provided", block.Type)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %s block: %w", block.Type, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return keys, nil
+}
+
+// Reload implements Reloader, reading the key files again. If any of them is
+// invalid, the current keys are kept.
+func (p *PEMAuthProvider) Reload() error {
+	return p.watcher.Load()
+}
+
+func (p *PEMAuthProvider) load() error {
+	var keys []crypto.PublicKey
+	for _, f := range p.files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("failed reading key file: %w", err)
+		}
+		fileKeys, err := parsePublicKeys(data)
+		if err != nil {
+			return fmt.Errorf("invalid key file %s: %w", f, err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	return nil
+}
+
+// Reload the key files if they changed since they were last checked.
+func (p *PEMAuthProvider) reloadIfChanged() {
+	if reloaded, err := p.watcher.Check(); err != nil {
+		// The files may be in the middle of being replaced
+		slog.Warn("failed reloading key files, keeping the current keys", "error", err)
+	} else if reloaded {
+		slog.Info("JWT public keys reloaded", "files", p.files)
+	}
+}
+
+// NewPEMAuthProvider returns a provider validating JWTs with the public keys
+// of PEM files, which must be signed with one of the allowed algorithms.
+func NewPEMAuthProvider(files []string, algorithms []string, claims ClaimsConfig) (*PEMAuthProvider, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no PEM key file")
+	}
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("allowed algorithms must be specified, among %s", strings.Join(pemAlgorithms, ", "))
+	}
+	for _, alg := range algorithms {
+		if !slices.Contains(pemAlgorithms, alg) {
+			return nil, fmt.Errorf("unsupported algorithm %q, acceptable values: %s", alg, strings.Join(pemAlgorithms, ", "))
+		}
+	}
+
+	p := &PEMAuthProvider{
+		files:  files,
+		claims: claims,
+		parser: jwt.NewParser(append(claims.parserOptions(), jwt.WithValidMethods(algorithms))...),
+	}
+	var err error
+	p.watcher, err = filewatch.New(files, p.load)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
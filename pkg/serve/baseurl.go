@@ -0,0 +1,165 @@
+package serve
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// Whether a request comes from one of the trusted proxies.
+func (s *Server) fromTrustedProxy(req *http.Request) bool {
+	if len(s.config.TrustedProxies) == 0 {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range s.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Last value of a header that can be repeated or contain a comma-separated
+// list. The last value is the one added by the proxy closest to the server,
+// while the first ones could have been sent by the client.
+func lastHeaderValue(req *http.Request, name string) string {
+	values := req.Header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	list := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(list[len(list)-1])
+}
+
+// Host and protocol of the last element of a Forwarded header (RFC 7239).
+func parseForwarded(req *http.Request) (host, proto string) {
+	element := lastHeaderValue(req, "Forwarded")
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "host":
+			host = value
+		case "proto":
+			proto = strings.ToLower(value)
+		}
+	}
+	return
+}
+
+// Base URL (scheme, host and path prefix) of the server, without a trailing
+// slash. The configured public base URL is used if set. Otherwise, it's built
+// from the request, using the forwarded headers only if the request comes from
+// a trusted proxy.
+func (s *Server) baseURL(req *http.Request) string {
+	if s.config.PublicBaseURL != "" {
+		return strings.TrimSuffix(s.config.PublicBaseURL, "/")
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	var prefix string
+	if s.fromTrustedProxy(req) {
+		fHost, fProto := parseForwarded(req)
+		if fHost == "" {
+			fHost = lastHeaderValue(req, "X-Forwarded-Host")
+		}
+		if fProto == "" {
+			fProto = strings.ToLower(lastHeaderValue(req, "X-Forwarded-Proto"))
+		}
+		if fHost != "" {
+			host = fHost
+		}
+		if fProto == "http" || fProto == "https" {
+			scheme = fProto
+		}
+		prefix = strings.TrimSuffix(lastHeaderValue(req, "X-Forwarded-Prefix"), "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+	}
+	return scheme + "://" + host + prefix
+}
+
+// Make the relative hrefs of links absolute, using a base URL.
+func absoluteLinks(links manifest.LinkList, base string) manifest.LinkList {
+	if links == nil {
+		return nil
+	}
+	out := make(manifest.LinkList, len(links))
+	for i, link := range links {
+		if href := link.Href.String(); !strings.Contains(href, "://") {
+			if h, err := manifest.NewHREFFromString(base+strings.TrimPrefix(href, "/"), link.Href.IsTemplated()); err == nil {
+				link.Href = h
+			}
+		}
+		link.Children = absoluteLinks(link.Children, base)
+		link.Alternates = absoluteLinks(link.Alternates, base)
+		out[i] = link
+	}
+	return out
+}
+
+// Copy subcollections, such as the page list or landmarks, with the hrefs of
+// their links and of their own subcollections rewritten to the base URL.
+func absoluteCollections(collections manifest.PublicationCollectionMap, base string) manifest.PublicationCollectionMap {
+	if collections == nil {
+		return nil
+	}
+	out := make(manifest.PublicationCollectionMap, len(collections))
+	for role, cs := range collections {
+		ocs := make([]manifest.PublicationCollection, len(cs))
+		for i, c := range cs {
+			c.Links = absoluteLinks(c.Links, base)
+			c.Subcollections = absoluteCollections(c.Subcollections, base)
+			ocs[i] = c
+		}
+		out[role] = ocs
+	}
+	return out
+}
+
+// Base URL of the resources of the publication of a request, or an empty
+// string if resources are served from the same origin as the manifest.
+func (s *Server) resourceBaseURL(req *http.Request) string {
+	if s.config.ResourceBaseURL == "" {
+		return ""
+	}
+	manifestPath, err := s.router.Get("manifest").URLPath("path", mux.Vars(req)["path"])
+	if err != nil {
+		return ""
+	}
+	p := manifestPath.String()
+	return strings.TrimSuffix(s.config.ResourceBaseURL, "/") + p[:strings.LastIndexByte(p, '/')+1]
+}
+
+// Rewrite the hrefs of the resources of a manifest to the resource base URL,
+// so that they're served from a separate origin: in the reading order,
+// resources, table of contents and subcollections, along with their children
+// and alternates. The links of the manifest itself, such as to the services
+// of the publication, stay relative to the manifest, like the links to the
+// services of the server added after.
+func withResourceBaseURL(m manifest.Manifest, base string) manifest.Manifest {
+	if base == "" {
+		return m
+	}
+	m.ReadingOrder = absoluteLinks(m.ReadingOrder, base)
+	m.Resources = absoluteLinks(m.Resources, base)
+	m.TableOfContents = absoluteLinks(m.TableOfContents, base)
+	m.Subcollections = absoluteCollections(m.Subcollections, base)
+	return m
+}
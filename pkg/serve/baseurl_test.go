@@ -0,0 +1,237 @@
+package serve
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func testLink(href string, children ...manifest.Link) manifest.Link {
+	return manifest.Link{Href: manifest.MustNewHREFFromString(href, false), Children: children}
+}
+
+func TestWithResourceBaseURL(t *testing.T) {
+	const base = "https://cdn.example.com/webpub/abc/"
+	m := manifest.Manifest{
+		Links:           manifest.LinkList{testLink("positions")},
+		ReadingOrder:    manifest.LinkList{testLink("chapter1.html")},
+		Resources:       manifest.LinkList{testLink("/style.css"), testLink("https://example.com/font.woff")},
+		TableOfContents: manifest.LinkList{testLink("chapter1.html", testLink("chapter1.html#s1", testLink("chapter1.html#s1.1")))},
+		Subcollections: manifest.PublicationCollectionMap{
+			"pageList":  {{Links: manifest.LinkList{testLink("chapter1.html#page1")}}},
+			"landmarks": {{Links: manifest.LinkList{testLink("cover.html")}}},
+			"sub": {{Subcollections: manifest.PublicationCollectionMap{
+				"nested": {{Links: manifest.LinkList{testLink("nested.html", testLink("nested.html#child"))}}},
+			}}},
+		},
+	}
+	out := withResourceBaseURL(m, base)
+
+	tests := []struct {
+		name     string
+		link     manifest.Link
+		expected string
+	}{
+		{"links", out.Links[0], "positions"},
+		{"reading order", out.ReadingOrder[0], base + "chapter1.html"},
+		{"absolute path", out.Resources[0], base + "style.css"},
+		{"absolute URL", out.Resources[1], "https://example.com/font.woff"},
+		{"toc", out.TableOfContents[0], base + "chapter1.html"},
+		{"toc child", out.TableOfContents[0].Children[0], base + "chapter1.html#s1"},
+		{"toc grandchild", out.TableOfContents[0].Children[0].Children[0], base + "chapter1.html#s1.1"},
+		{"page list", out.Subcollections["pageList"][0].Links[0], base + "chapter1.html#page1"},
+		{"landmarks", out.Subcollections["landmarks"][0].Links[0], base + "cover.html"},
+		{"nested collection", out.Subcollections["sub"][0].Subcollections["nested"][0].Links[0], base + "nested.html"},
+		{"nested collection child", out.Subcollections["sub"][0].Subcollections["nested"][0].Links[0].Children[0], base + "nested.html#child"},
+	}
+	for _, tt := range tests {
+		if href := tt.link.Href.String(); href != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.name, href, tt.expected)
+		}
+	}
+
+	// The manifest of the cached publication is left as is
+	if href := m.Subcollections["pageList"][0].Links[0].Href.String(); href != "chapter1.html#page1" {
+		t.Errorf("original manifest was modified: %q", href)
+	}
+	if href := m.TableOfContents[0].Children[0].Href.String(); href != "chapter1.html#s1" {
+		t.Errorf("original manifest was modified: %q", href)
+	}
+}
+
+// Request from an address, with headers given as name/value pairs.
+func proxiedRequest(remoteAddr string, headers ...string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://internal:15080/webpub/abc/manifest.json", nil)
+	req.RemoteAddr = remoteAddr
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	return req
+}
+
+func TestFromTrustedProxy(t *testing.T) {
+	s := NewServer(ServerConfig{TrustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}}, Remote{})
+
+	tests := []struct {
+		remoteAddr string
+		expected   bool
+	}{
+		{"10.1.2.3:5000", true},
+		{"11.1.2.3:5000", false},
+		{"[fd00::1]:5000", true},
+		{"[fe80::1]:5000", false},
+		{"[::ffff:10.1.2.3]:5000", true}, // IPv4-mapped
+		{"10.1.2.3", false},              // Not an address and port
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := s.fromTrustedProxy(proxiedRequest(tt.remoteAddr)); got != tt.expected {
+			t.Errorf("%q: got %v, expected %v", tt.remoteAddr, got, tt.expected)
+		}
+	}
+
+	if NewServer(ServerConfig{}, Remote{}).fromTrustedProxy(proxiedRequest("10.1.2.3:5000")) {
+		t.Error("request trusted without trusted proxies")
+	}
+}
+
+func TestLastHeaderValue(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"a"}, "a"},
+		{[]string{"a, b"}, "b"},
+		{[]string{"a,b ,  c "}, "c"},
+		{[]string{"a, b", "c"}, "c"},
+		{[]string{"a", "b, c"}, "c"},
+		{[]string{"a,"}, ""},
+	}
+	for _, tt := range tests {
+		req := proxiedRequest("10.1.2.3:5000")
+		for _, v := range tt.values {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if got := lastHeaderValue(req, "X-Forwarded-For"); got != tt.expected {
+			t.Errorf("%q: got %q, expected %q", tt.values, got, tt.expected)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		values []string
+		host   string
+		proto  string
+	}{
+		{nil, "", ""},
+		{[]string{"host=example.com;proto=https"}, "example.com", "https"},
+		{[]string{`for=192.0.2.60; Host="example.com:8443"; PROTO=HTTPS`}, "example.com:8443", "https"},
+		{[]string{`for="[2001:db8::1]:4711";host=example.com`}, "example.com", ""},
+		{[]string{"host=spoofed.com;proto=http, host=example.com;proto=https"}, "example.com", "https"},
+		{[]string{"host=spoofed.com", "host=example.com"}, "example.com", ""},
+		// The last element wins even without a host
+		{[]string{"host=spoofed.com, for=192.0.2.60"}, "", ""},
+		{[]string{"host"}, "", ""},
+	}
+	for _, tt := range tests {
+		req := proxiedRequest("10.1.2.3:5000")
+		for _, v := range tt.values {
+			req.Header.Add("Forwarded", v)
+		}
+		host, proto := parseForwarded(req)
+		if host != tt.host || proto != tt.proto {
+			t.Errorf("%q: got %q, %q, expected %q, %q", tt.values, host, proto, tt.host, tt.proto)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name     string
+		config   ServerConfig
+		req      *http.Request
+		expected string
+	}{
+		{"request", ServerConfig{}, proxiedRequest("192.0.2.1:5000"), "http://internal:15080"},
+		{
+			"untrusted proxy",
+			ServerConfig{TrustedProxies: trusted},
+			proxiedRequest("192.0.2.1:5000", "X-Forwarded-Host", "example.com", "X-Forwarded-Proto", "https", "X-Forwarded-Prefix", "/books"),
+			"http://internal:15080",
+		},
+		{
+			"no trusted proxies",
+			ServerConfig{},
+			proxiedRequest("10.1.2.3:5000", "Forwarded", "host=example.com;proto=https"),
+			"http://internal:15080",
+		},
+		{
+			"X-Forwarded headers",
+			ServerConfig{TrustedProxies: trusted},
+			proxiedRequest("10.1.2.3:5000", "X-Forwarded-Host", "example.com", "X-Forwarded-Proto", "HTTPS", "X-Forwarded-Prefix", "/books/"),
+			"https://example.com/books",
+		},
+		{
+			"prefix without a leading slash",
+			ServerConfig{TrustedProxies: trusted},
+			proxiedRequest("10.1.2.3:5000", "X-Forwarded-Prefix", "books"),
+			"http://internal:15080/books",
+		},
+		{
+			"last X-Forwarded values",
+			ServerConfig{TrustedProxies: trusted},
+			proxiedRequest("10.1.2.3:5000", "X-Forwarded-Host", "spoofed.com, example.com", "X-Forwarded-Proto", "http", "X-Forwarded-Proto", "https"),
+			"https://example.com",
+		},
+		{
+			"Forwarded over X-Forwarded",
+			ServerConfig{TrustedProxies: trusted},
+			proxiedRequest("10.1.2.3:5000", "Forwarded", "host=example.com;proto=https", "X-Forwarded-Host", "other.com", "X-Forwarded-Proto", "http"),
+			"https://example.com",
+		},
+		{
+			"Forwarded without a protocol",
+			ServerConfig{TrustedProxies: trusted},
+			proxiedRequest("10.1.2.3:5000", "Forwarded", "host=example.com", "X-Forwarded-Proto", "https"),
+			"https://example.com",
+		},
+		{
+			"unknown protocol",
+			ServerConfig{TrustedProxies: trusted},
+			proxiedRequest("10.1.2.3:5000", "X-Forwarded-Proto", "javascript"),
+			"http://internal:15080",
+		},
+		{
+			"public base URL",
+			ServerConfig{PublicBaseURL: "https://books.example.com/", TrustedProxies: trusted},
+			proxiedRequest("10.1.2.3:5000", "X-Forwarded-Host", "example.com"),
+			"https://books.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewServer(tt.config, Remote{}).baseURL(tt.req); got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+
+	t.Run("TLS", func(t *testing.T) {
+		req := proxiedRequest("192.0.2.1:5000")
+		req.TLS = &tls.ConnectionState{}
+		if got := NewServer(ServerConfig{}, Remote{}).baseURL(req); got != "https://internal:15080" {
+			t.Errorf("got %q", got)
+		}
+	})
+}
@@ -25,8 +25,28 @@ type LocalCache interface {
 type TinyLFU struct {
 	mu     sync.Mutex
 	lfu    *tinylfu.T
+	size   int
 	ttl    time.Duration
 	offset time.Duration
+	items  map[*localItem]struct{} // Items currently in the cache, to purge them
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type localItem struct {
+	key   string
+	value Evictable
+}
+
+// Stats are the usage statistics of a cache.
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Size      int64  `json:"size,omitempty"` // Total size of the entries in bytes, for caches bounded by size
 }
 
 var _ LocalCache = (*TinyLFU)(nil)
@@ -41,8 +61,10 @@ func NewTinyLFU(size int, ttl time.Duration) *TinyLFU {
 
 	return &TinyLFU{
 		lfu:    tinylfu.New(size, 100000),
+		size:   size,
 		ttl:    ttl,
 		offset: offset,
+		items:  make(map[*localItem]struct{}),
 	}
 }
 
@@ -59,11 +81,19 @@ func (c *TinyLFU) Set(key string, b Evictable) {
 		ttl += time.Duration(rand.Int64N(int64(c.offset)))
 	}
 
+	// The underlying cache keeps duplicate keys, which would never be evicted
+	c.lfu.Del(key)
+
+	// Items of the underlying cache are reused, so they're tracked separately
+	li := &localItem{key: key, value: b}
+	c.items[li] = struct{}{}
 	c.lfu.Set(&tinylfu.Item{
 		Key:      key,
 		Value:    b,
 		ExpireAt: time.Now().Add(ttl),
 		OnEvict: func() {
+			delete(c.items, li)
+			c.evictions++
 			b.OnEvict()
 		},
 	})
@@ -75,9 +105,11 @@ func (c *TinyLFU) Get(key string) (Evictable, bool) {
 
 	val, ok := c.lfu.Get(key)
 	if !ok {
+		c.misses++
 		return nil, false
 	}
 
+	c.hits++
 	return val.(Evictable), true
 }
 
@@ -87,3 +119,70 @@ func (c *TinyLFU) Del(key string) {
 
 	c.lfu.Del(key)
 }
+
+// Len returns the number of items in the cache, including expired items that
+// haven't been evicted yet.
+func (c *TinyLFU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items)
+}
+
+// Purge evicts all the items of the cache.
+func (c *TinyLFU) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for li := range c.items {
+		c.evictions++
+		li.value.OnEvict()
+	}
+	c.items = make(map[*localItem]struct{})
+	c.lfu = tinylfu.New(c.size, 100000)
+}
+
+// DelMatching deletes the items whose key matches, and returns how many were deleted.
+func (c *TinyLFU) DelMatching(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	for li := range c.items {
+		if match(li.key) {
+			keys = append(keys, li.key)
+		}
+	}
+	deleted := 0
+	for _, key := range keys {
+		before := len(c.items)
+		c.lfu.Del(key)
+		deleted += before - len(c.items)
+	}
+	return deleted
+}
+
+// Items returns a snapshot of the items in the cache, by key.
+func (c *TinyLFU) Items() map[string]Evictable {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items := make(map[string]Evictable, len(c.items))
+	for li := range c.items {
+		items[li.key] = li.value
+	}
+	return items
+}
+
+// Stats returns the usage statistics of the cache.
+func (c *TinyLFU) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+	}
+}
@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+type countingItem struct {
+	evictions int
+}
+
+func (i *countingItem) OnEvict() {
+	i.evictions++
+}
+
+func TestTinyLFUSetReplaces(t *testing.T) {
+	c := NewTinyLFU(10, time.Hour)
+	first, second := &countingItem{}, &countingItem{}
+	c.Set("key", first)
+	c.Set("key", second)
+
+	if first.evictions != 1 {
+		t.Errorf("replaced item evicted %d times, expected 1", first.evictions)
+	}
+	if v, ok := c.Get("key"); !ok || v != second {
+		t.Errorf("got %v, expected the second item", v)
+	}
+	if n := c.Len(); n != 1 {
+		t.Errorf("got %d items, expected 1", n)
+	}
+
+	c.Purge()
+	if first.evictions != 1 || second.evictions != 1 {
+		t.Errorf("items evicted %d and %d times by the purge, expected 1 and 1", first.evictions, second.evictions)
+	}
+}
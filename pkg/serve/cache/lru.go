@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Sized is implemented by the items whose size counts towards the limit of
+// an LRU cache.
+type Sized interface {
+	Size() int64
+}
+
+// LRU is a cache bounded by the total size of its items, rather than by
+// their number, evicting the least recently used items first.
+type LRU struct {
+	mu      sync.Mutex
+	maxSize int64
+	ttl     time.Duration
+	size    int64
+	order   *list.List // Most recently used first
+	items   map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type lruItem struct {
+	key      string
+	value    Evictable
+	size     int64
+	expireAt time.Time
+}
+
+var _ LocalCache = (*LRU)(nil)
+
+// NewLRU returns a cache of items whose total size is at most maxSize bytes,
+// kept for at most ttl.
+func NewLRU(maxSize int64, ttl time.Duration) *LRU {
+	return &LRU{
+		maxSize: maxSize,
+		ttl:     ttl,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Set stores an item, unless it's larger than the cache. Items that don't
+// implement Sized have no size.
+func (c *LRU) Set(key string, b Evictable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.evict(e)
+	}
+	var size int64
+	if s, ok := b.(Sized); ok {
+		size = s.Size()
+	}
+	if size > c.maxSize {
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key: key, value: b, size: size, expireAt: time.Now().Add(c.ttl)})
+	c.size += size
+	for c.size > c.maxSize {
+		c.evict(c.order.Back())
+	}
+}
+
+func (c *LRU) Get(key string) (Evictable, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if ok && time.Now().After(e.Value.(*lruItem).expireAt) {
+		c.evict(e)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+func (c *LRU) Del(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.evict(e)
+	}
+}
+
+func (c *LRU) evict(e *list.Element) {
+	item := c.order.Remove(e).(*lruItem)
+	delete(c.items, item.key)
+	c.size -= item.size
+	c.evictions++
+	item.value.OnEvict()
+}
+
+// Len returns the number of items in the cache, including expired items that
+// haven't been evicted yet.
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items)
+}
+
+// Purge evicts all the items of the cache.
+func (c *LRU) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.order.Len() > 0 {
+		c.evict(c.order.Back())
+	}
+}
+
+// DelMatching deletes the items whose key matches, and returns how many were deleted.
+func (c *LRU) DelMatching(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deleted := 0
+	for key, e := range c.items {
+		if match(key) {
+			c.evict(e)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Stats returns the usage statistics of the cache.
+func (c *LRU) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+		Size:      c.size,
+	}
+}
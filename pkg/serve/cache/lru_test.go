@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+type sizedItem struct {
+	countingItem
+	size int64
+}
+
+func (i *sizedItem) Size() int64 {
+	return i.size
+}
+
+func TestLRUEvictsBySize(t *testing.T) {
+	c := NewLRU(100, time.Hour)
+	a, b, d := &sizedItem{size: 40}, &sizedItem{size: 40}, &sizedItem{size: 40}
+	c.Set("a", a)
+	c.Set("b", b)
+	c.Get("a") // b is now the least recently used
+	c.Set("d", d)
+
+	if b.evictions != 1 || a.evictions != 0 || d.evictions != 0 {
+		t.Errorf("got evictions a: %d, b: %d, d: %d, expected b only", a.evictions, b.evictions, d.evictions)
+	}
+	if stats := c.Stats(); stats.Entries != 2 || stats.Size != 80 || stats.Evictions != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestLRUSkipsLargeItems(t *testing.T) {
+	c := NewLRU(100, time.Hour)
+	c.Set("small", &sizedItem{size: 10})
+	c.Set("large", &sizedItem{size: 101})
+	if _, ok := c.Get("large"); ok {
+		t.Error("item larger than the cache was cached")
+	}
+	if _, ok := c.Get("small"); !ok {
+		t.Error("item was evicted for an item larger than the cache")
+	}
+}
+
+func TestLRUReplaces(t *testing.T) {
+	c := NewLRU(100, time.Hour)
+	first, second := &sizedItem{size: 30}, &sizedItem{size: 50}
+	c.Set("key", first)
+	c.Set("key", second)
+	if first.evictions != 1 {
+		t.Errorf("replaced item evicted %d times, expected 1", first.evictions)
+	}
+	if stats := c.Stats(); stats.Entries != 1 || stats.Size != 50 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestLRUExpires(t *testing.T) {
+	c := NewLRU(100, -time.Second)
+	item := &sizedItem{size: 10}
+	c.Set("key", item)
+	if _, ok := c.Get("key"); ok {
+		t.Error("got an expired item")
+	}
+	if item.evictions != 1 || c.Len() != 0 {
+		t.Errorf("expired item evicted %d times, %d items left", item.evictions, c.Len())
+	}
+}
+
+func TestLRUPurgeAndDelMatching(t *testing.T) {
+	c := NewLRU(100, time.Hour)
+	items := map[string]*sizedItem{"a/1": {size: 1}, "a/2": {size: 1}, "b/1": {size: 1}}
+	for k, v := range items {
+		c.Set(k, v)
+	}
+	if n := c.DelMatching(func(key string) bool { return key[0] == 'a' }); n != 2 {
+		t.Errorf("deleted %d items, expected 2", n)
+	}
+	c.Purge()
+	for k, v := range items {
+		if v.evictions != 1 {
+			t.Errorf("%s evicted %d times", k, v.evictions)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("got %+v after purging", stats)
+	}
+}
@@ -1,25 +1,71 @@
 package cache
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/readium/go-toolkit/pkg/pub"
 )
 
-// CachedPublication implements Evictable
+// CachedPublication implements Evictable. It's reference-counted, so that a
+// publication evicted while requests use it is only closed once they're done.
 type CachedPublication struct {
 	*pub.Publication
 	Remote   bool
 	CachedAt time.Time
+	ModTime  time.Time // Last modification of the publication, if known. Defaults to CachedAt
+	derived  sync.Map
+
+	refs    atomic.Int32 // References of the cache and of the requests using the publication
+	evicted sync.Once
 }
 
+// EncapsulatePublication returns a publication with a single reference, held
+// by the cache and dropped when it's evicted.
 func EncapsulatePublication(pub *pub.Publication, remote bool) *CachedPublication {
-	return &CachedPublication{pub, remote, time.Now()}
+	now := time.Now()
+	cp := &CachedPublication{Publication: pub, Remote: remote, CachedAt: now, ModTime: now}
+	cp.refs.Store(1)
+	return cp
 }
 
-func (cp *CachedPublication) OnEvict() {
-	// Cleanup
-	if cp.Publication != nil {
+// Acquire takes a reference to the publication, which must be released with
+// Release once it's not used anymore. It fails if the publication was already
+// closed after being evicted.
+func (cp *CachedPublication) Acquire() bool {
+	for {
+		n := cp.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if cp.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Release drops a reference to the publication, closing it when it was the
+// last one.
+func (cp *CachedPublication) Release() {
+	if cp.refs.Add(-1) == 0 && cp.Publication != nil {
 		cp.Publication.Close()
 	}
 }
+
+// Derived returns a value derived from the publication (such as a digest) stored with SetDerived.
+// Derived values are dropped along with the publication when it's evicted.
+func (cp *CachedPublication) Derived(key string) (any, bool) {
+	return cp.derived.Load(key)
+}
+
+// SetDerived stores a value derived from the publication.
+func (cp *CachedPublication) SetDerived(key string, value any) {
+	cp.derived.Store(key, value)
+}
+
+func (cp *CachedPublication) OnEvict() {
+	// The reference of the cache, the publication is closed once the requests
+	// using it are done
+	cp.evicted.Do(cp.Release)
+}
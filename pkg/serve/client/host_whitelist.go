@@ -1,10 +1,14 @@
 package client
 
 import (
+	"errors"
 	"net/url"
 	"strings"
 )
 
+// ErrNotWhitelisted is returned for requests to URLs that don't match the whitelist.
+var ErrNotWhitelisted = errors.New("URL is not allowed by the whitelist")
+
 // Check if a URL has a valid match in the whitelist.
 // A valid match is when the host (hostname:port) is equal,
 // and the URL starts with the (optional) path in the whitelist entry
@@ -14,7 +14,7 @@ type authTransport struct {
 
 func (a *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if !validateAgainstWhitelist(req.URL, a.Whitelist) {
-		return nil, fmt.Errorf("request to %s is not allowed by the whitelist", req.URL)
+		return nil, fmt.Errorf("request to %s: %w", req.URL, ErrNotWhitelisted)
 	}
 
 	if a.Authorization == "" {
@@ -10,13 +10,18 @@ import (
 	"runtime"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// ErrUnsafeAddress is returned when connecting to a non-public address or port is prevented.
+var ErrUnsafeAddress = errors.New("unsafe address")
+
 // Code below mostly from https://www.agwa.name/blog/post/preventing_server_side_request_forgery_in_golang
 
 func safeSocketControl(network string, address string, conn syscall.RawConn) error {
 	if !(network == "tcp4" || network == "tcp6") {
-		return fmt.Errorf("%s is not a safe network type", network)
+		return fmt.Errorf("%s is not a safe network type: %w", network, ErrUnsafeAddress)
 	}
 
 	host, port, err := net.SplitHostPort(address)
@@ -30,11 +35,11 @@ func safeSocketControl(network string, address string, conn syscall.RawConn) err
 	}
 
 	if !isPublicIPAddress(ipaddress) {
-		return fmt.Errorf("%s is not a public IP address", ipaddress)
+		return fmt.Errorf("%s is not a public IP address: %w", ipaddress, ErrUnsafeAddress)
 	}
 
 	if !(port == "80" || port == "443") {
-		return fmt.Errorf("%s is not a safe port number", port)
+		return fmt.Errorf("%s is not a safe port number: %w", port, ErrUnsafeAddress)
 	}
 
 	return nil
@@ -71,7 +76,8 @@ func NewHTTPClient(auth string, whitelist []*url.URL, bypassSafeSocketControl bo
 	}
 
 	return &http.Client{
-		Transport: newAuthenticatedRoundTripper(auth, whitelist, safeTransport),
+		// Requests are traced, with the trace context propagated in their headers
+		Transport: otelhttp.NewTransport(newAuthenticatedRoundTripper(auth, whitelist, safeTransport)),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) >= 10 {
 				// Default Go behavior
@@ -79,7 +85,7 @@ func NewHTTPClient(auth string, whitelist []*url.URL, bypassSafeSocketControl bo
 			}
 
 			if !validateAgainstWhitelist(req.URL, whitelist) {
-				return fmt.Errorf("redirect to %s is not allowed by the whitelist", req.URL)
+				return fmt.Errorf("redirect to %s: %w", req.URL, ErrNotWhitelisted)
 			}
 			return nil
 		},
@@ -0,0 +1,115 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"github.com/zeebo/xxh3"
+)
+
+// Compute a strong entity tag for a resource of a publication.
+// The tag changes when the publication is modified (or reopened, when its
+// modification time is unknown), when the size of the resource changes,
+// and between the different content encodings of the resource.
+func resourceETag(ctx context.Context, filename, href string, modTime time.Time, res fetcher.Resource, length int64, encoding string) string {
+	var compressedLength int64
+	if cres, ok := res.(fetcher.CompressedResource); ok {
+		compressedLength = cres.CompressedLength(ctx)
+	}
+
+	h := xxh3.New()
+	h.WriteString(filename)
+	h.WriteString("\x00")
+	h.WriteString(href)
+	h.WriteString("\x00")
+	h.WriteString(strconv.FormatInt(modTime.UnixNano(), 36))
+	h.WriteString("\x00")
+	h.WriteString(strconv.FormatInt(length, 36))
+	h.WriteString("\x00")
+	h.WriteString(strconv.FormatInt(compressedLength, 36))
+
+	etag := strconv.FormatUint(h.Sum64(), 36)
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	return `"` + etag + `"`
+}
+
+// Split a list of entity tags, such as in an If-None-Match header.
+func parseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Weak comparison of entity tags, which ignores the W/ prefix.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// Strong comparison of entity tags, which never matches weak tags.
+func etagStrongMatch(a, b string) bool {
+	return a == b && !strings.HasPrefix(a, "W/")
+}
+
+// Whether the conditional request headers (If-None-Match, or If-Modified-Since
+// in its absence) allow the server to respond with 304 Not Modified.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("if-none-match"); inm != "" {
+		for _, tag := range parseETags(inm) {
+			if tag == "*" || etagWeakMatch(tag, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims := r.Header.Get("if-modified-since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// Last-Modified only has a precision of one second
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// Whether the range of a request should be honored given its If-Range header.
+func ifRangeMatches(r *http.Request, etag string, modTime time.Time) bool {
+	ir := r.Header.Get("if-range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etagStrongMatch(ir, etag)
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	return modTime.Truncate(time.Second).Equal(t)
+}
+
+// Respond with 304 Not Modified, keeping the validators and caching headers.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("content-type")
+	h.Del("content-length")
+	h.Del("content-encoding")
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,132 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/readium/cli/pkg/serve/cache"
+)
+
+func TestNotModified(t *testing.T) {
+	const etag = `"abc"`
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	lastModified := modTime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		expected bool
+	}{
+		{"no condition", http.MethodGet, nil, false},
+		{"matching tag", http.MethodGet, map[string]string{"If-None-Match": `"abc"`}, true},
+		{"weak matching tag", http.MethodGet, map[string]string{"If-None-Match": `W/"abc"`}, true},
+		{"tag in list", http.MethodGet, map[string]string{"If-None-Match": `"x", "abc"`}, true},
+		{"any tag", http.MethodGet, map[string]string{"If-None-Match": "*"}, true},
+		{"other tag", http.MethodGet, map[string]string{"If-None-Match": `"x"`}, false},
+		{"tag takes precedence over date", http.MethodGet, map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": lastModified}, false},
+		{"same date", http.MethodHead, map[string]string{"If-Modified-Since": lastModified}, true},
+		{"later date", http.MethodGet, map[string]string{"If-Modified-Since": modTime.Add(time.Hour).Format(http.TimeFormat)}, true},
+		{"earlier date", http.MethodGet, map[string]string{"If-Modified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)}, false},
+		{"invalid date", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"other method", http.MethodPost, map[string]string{"If-None-Match": `"abc"`}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := notModified(r, etag, modTime); got != tt.expected {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	const etag = `"abc"`
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		ifRange  string
+		expected bool
+	}{
+		{"", true},
+		{`"abc"`, true},
+		{`W/"abc"`, false},
+		{`"x"`, false},
+		{modTime.Format(http.TimeFormat), true},
+		{modTime.Add(time.Hour).Format(http.TimeFormat), false},
+		{"invalid", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		if got := ifRangeMatches(r, etag, modTime); got != tt.expected {
+			t.Errorf("If-Range %q: got %v, expected %v", tt.ifRange, got, tt.expected)
+		}
+	}
+}
+
+func TestResourceETag(t *testing.T) {
+	ctx := context.Background()
+	modTime := time.Unix(1700000000, 0)
+	res := &bytesResource{[]byte(rangesContent)}
+	base := resourceETag(ctx, "book.epub", "chapter1.html", modTime, res, 16, "")
+
+	tests := map[string]string{
+		"publication":       resourceETag(ctx, "other.epub", "chapter1.html", modTime, res, 16, ""),
+		"href":              resourceETag(ctx, "book.epub", "chapter2.html", modTime, res, 16, ""),
+		"modification time": resourceETag(ctx, "book.epub", "chapter1.html", modTime.Add(time.Second), res, 16, ""),
+		"length":            resourceETag(ctx, "book.epub", "chapter1.html", modTime, res, 17, ""),
+		"encoding":          resourceETag(ctx, "book.epub", "chapter1.html", modTime, res, 16, "gzip"),
+	}
+	for name, etag := range tests {
+		if etag == base {
+			t.Errorf("entity tag doesn't change with the %s", name)
+		}
+	}
+	if again := resourceETag(ctx, "book.epub", "chapter1.html", modTime, res, 16, ""); again != base {
+		t.Errorf("entity tag isn't stable: %s, %s", base, again)
+	}
+}
+
+func TestReprDigest(t *testing.T) {
+	ctx := context.Background()
+	cp := cache.EncapsulatePublication(nil, true)
+	// A resource of a remote archive, stored deflated
+	res := newDeflatedResource(t, []byte(rangesContent))
+	sum := func(data []byte) string {
+		digest := sha256.Sum256(data)
+		return base64.StdEncoding.EncodeToString(digest[:])
+	}
+
+	tests := []struct {
+		encoding string
+		expected string
+	}{
+		{"", sum([]byte(rangesContent))},
+		{"deflate", sum(res.compressed)},
+	}
+	for _, tt := range tests {
+		// The second time, the digest comes from the cache
+		for range 2 {
+			digest, rerr := reprDigest(ctx, cp, res, true, `"etag-`+tt.encoding+`"`, tt.encoding)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			if digest != tt.expected {
+				t.Errorf("encoding %q: got %s, expected %s", tt.encoding, digest, tt.expected)
+			}
+		}
+	}
+	if _, ok := cp.Derived(`repr-digest:"etag-deflate"`); !ok {
+		t.Error("digest isn't cached")
+	}
+}
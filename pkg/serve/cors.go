@@ -0,0 +1,148 @@
+package serve
+
+import (
+	"net/http"
+	nurl "net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Origin enforcement modes
+const (
+	OriginEnforcementOff     = "off"     // Requests are accepted from any origin
+	OriginEnforcementLenient = "lenient" // Requests with an Origin or Referer that isn't allowed are rejected
+	OriginEnforcementStrict  = "strict"  // Requests without an allowed Origin or Referer are rejected
+)
+
+// Headers exposed to clients by default, needed to read publications in parts
+// and to report the ID of failed requests.
+var DefaultCORSExposedHeaders = []string{"Content-Range", "Accept-Ranges", "ETag", "X-Request-ID"}
+
+const DefaultCORSMaxAge = time.Hour
+
+// CORSConfig controls the cross-origin access to publications, and which
+// origins are allowed to request them at all.
+type CORSConfig struct {
+	AllowedOrigins    []string      // Allowed origins, such as https://reader.example.com. "*" allows any origin, and "https://*.example.com" any subdomain
+	AllowCredentials  bool          // Allow requests with credentials (cookies, HTTP authentication)
+	ExposedHeaders    []string      // Response headers readable by clients
+	MaxAge            time.Duration // How long the response to a preflight request can be cached
+	OriginEnforcement string        // One of the OriginEnforcement* modes
+}
+
+// Whether an origin matches one of the allowed origins.
+func (c *CORSConfig) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "/"))
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether responses depend on the origin of requests, when not every origin
+// gets the same response.
+func (c *CORSConfig) variesByOrigin() bool {
+	enforced := c.OriginEnforcement != "" && c.OriginEnforcement != OriginEnforcementOff
+	return enforced || c.AllowCredentials || !slices.Contains(c.AllowedOrigins, "*")
+}
+
+// Origin (scheme and host) of a URL, or an empty string if it has none.
+func urlOrigin(u string) string {
+	pu, err := nurl.Parse(u)
+	if err != nil || pu.Scheme == "" || pu.Host == "" {
+		return ""
+	}
+	return strings.ToLower(pu.Scheme + "://" + pu.Host)
+}
+
+// Whether a request is allowed by the origin enforcement mode. The origins of
+// the server itself are always allowed, since documents of publications load
+// their own resources.
+func (s *Server) originAllowed(req *http.Request) bool {
+	mode := s.config.CORS.OriginEnforcement
+	if mode == "" || mode == OriginEnforcementOff {
+		return true
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		origin = urlOrigin(req.Header.Get("Referer"))
+	}
+	if origin == "" {
+		return mode != OriginEnforcementStrict
+	}
+	if origin == urlOrigin(s.baseURL(req)) || (s.config.ResourceBaseURL != "" && origin == urlOrigin(s.config.ResourceBaseURL)) {
+		return true
+	}
+	return s.config.CORS.allows(origin)
+}
+
+// Set the CORS headers of a response to a request from an allowed origin.
+func (s *Server) setCORSHeaders(w http.ResponseWriter, origin string) {
+	h := w.Header()
+	if slices.Contains(s.config.CORS.AllowedOrigins, "*") && !s.config.CORS.AllowCredentials {
+		h.Set("access-control-allow-origin", "*")
+	} else {
+		h.Set("access-control-allow-origin", origin)
+		if s.config.CORS.AllowCredentials {
+			h.Set("access-control-allow-credentials", "true")
+		}
+	}
+	if len(s.config.CORS.ExposedHeaders) > 0 {
+		h.Set("access-control-expose-headers", strings.Join(s.config.CORS.ExposedHeaders, ", "))
+	}
+}
+
+// Middleware adding CORS headers to responses, answering preflight requests,
+// and rejecting requests from origins that aren't allowed.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Also for requests from origins that aren't allowed, or without an
+		// origin, so that shared caches don't send their response to others
+		if s.config.CORS.variesByOrigin() {
+			w.Header().Add("vary", "Origin")
+		}
+		if !s.originAllowed(r) {
+			s.writeProblem(w, http.StatusForbidden, ErrCodeOriginNotAllowed, errors.New("origin not allowed"))
+			return
+		}
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.config.CORS.allows(origin) {
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.setCORSHeaders(w, origin)
+
+		// Preflight request, such as for a range request
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h := w.Header()
+			h.Add("vary", "Access-Control-Request-Method")
+			h.Add("vary", "Access-Control-Request-Headers")
+			h.Set("access-control-allow-methods", "GET, HEAD, OPTIONS")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				h.Set("access-control-allow-headers", headers)
+			}
+			if s.config.CORS.MaxAge > 0 {
+				h.Set("access-control-max-age", strconv.Itoa(int(s.config.CORS.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
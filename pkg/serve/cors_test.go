@@ -0,0 +1,49 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestCORSHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      CORSConfig
+		origin      string
+		status      int
+		allowOrigin string
+		vary        bool
+	}{
+		{"any origin", CORSConfig{AllowedOrigins: []string{"*"}}, "https://a.example.com", http.StatusOK, "*", false},
+		{"any origin, no origin", CORSConfig{AllowedOrigins: []string{"*"}}, "", http.StatusOK, "", false},
+		{"allowed origin", CORSConfig{AllowedOrigins: []string{"https://a.example.com"}}, "https://a.example.com", http.StatusOK, "https://a.example.com", true},
+		{"other origin", CORSConfig{AllowedOrigins: []string{"https://a.example.com"}}, "https://b.example.com", http.StatusOK, "", true},
+		{"no origin", CORSConfig{AllowedOrigins: []string{"https://a.example.com"}}, "", http.StatusOK, "", true},
+		{"subdomain", CORSConfig{AllowedOrigins: []string{"https://*.example.com"}}, "https://a.example.com", http.StatusOK, "https://a.example.com", true},
+		{"enforced", CORSConfig{AllowedOrigins: []string{"*"}, OriginEnforcement: OriginEnforcementStrict}, "", http.StatusForbidden, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{config: ServerConfig{CORS: tt.config}}
+			h := s.corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, expected %d", w.Code, tt.status)
+			}
+			if allowOrigin := w.Header().Get("access-control-allow-origin"); allowOrigin != tt.allowOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, expected %q", allowOrigin, tt.allowOrigin)
+			}
+			if vary := slices.Contains(w.Header().Values("vary"), "Origin"); vary != tt.vary {
+				t.Errorf("got Vary: Origin %v, expected %v", vary, tt.vary)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package serve
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/serve/client"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"google.golang.org/api/googleapi"
+)
+
+// Stable error codes, returned in the "code" member of problem details.
+const (
+	ErrCodeInvalidToken        = "invalid_token"
+	ErrCodeTokenExpired        = "token_expired"
+	ErrCodeInvalidPath         = "invalid_path"
+	ErrCodeInvalidQuery        = "invalid_query"
+	ErrCodeUnsupportedScheme   = "unsupported_scheme"
+	ErrCodeForbidden           = "forbidden"
+	ErrCodeOriginNotAllowed    = "origin_not_allowed"
+	ErrCodePublicationNotFound = "publication_not_found"
+	ErrCodeResourceNotFound    = "resource_not_found"
+	ErrCodeRangeNotSatisfiable = "range_not_satisfiable"
+	ErrCodeUnsupportedFormat   = "unsupported_format"
+	ErrCodeImageTooLarge       = "image_too_large"
+	ErrCodeImageInvalid        = "image_invalid"
+	ErrCodePublicationInvalid  = "publication_invalid"
+	ErrCodeUpstreamError       = "upstream_error"
+	ErrCodeUpstreamTimeout     = "upstream_timeout"
+	ErrCodeInternalError       = "internal_error"
+)
+
+// PublicationError is an error that occurred while opening or reading a publication,
+// with the HTTP status and error code it should be reported with.
+type PublicationError struct {
+	Status int
+	Code   string
+	Err    error
+}
+
+func (e *PublicationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PublicationError) Unwrap() error {
+	return e.Err
+}
+
+func newPublicationError(status int, code string, err error) *PublicationError {
+	return &PublicationError{Status: status, Code: code, Err: err}
+}
+
+// Used to extract the status or code of AWS SDK errors without depending on smithy-go
+type httpStatusCoder interface {
+	HTTPStatusCode() int
+}
+type apiErrorCoder interface {
+	ErrorCode() string
+}
+
+// Classify an error returned when opening a publication.
+func classifyOpenError(err error, remote bool) *PublicationError {
+	var perr *PublicationError
+	if errors.As(err, &perr) {
+		return perr
+	}
+
+	// Timeouts
+	var nerr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()) {
+		return newPublicationError(http.StatusGatewayTimeout, ErrCodeUpstreamTimeout, err)
+	}
+
+	// Missing publications
+	var s3NoSuchKey *types.NoSuchKey
+	var s3NoSuchBucket *types.NoSuchBucket
+	var s3NotFound *types.NotFound
+	if errors.Is(err, fs.ErrNotExist) ||
+		errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) ||
+		errors.As(err, &s3NoSuchKey) || errors.As(err, &s3NoSuchBucket) || errors.As(err, &s3NotFound) {
+		return newPublicationError(http.StatusNotFound, ErrCodePublicationNotFound, err)
+	}
+
+	// Forbidden access
+	if errors.Is(err, fs.ErrPermission) || errors.Is(err, client.ErrNotWhitelisted) || errors.Is(err, client.ErrUnsafeAddress) {
+		return newPublicationError(http.StatusForbidden, ErrCodeForbidden, err)
+	}
+	var acerr apiErrorCoder
+	if errors.As(err, &acerr) && acerr.ErrorCode() == "AccessDenied" {
+		return newPublicationError(http.StatusForbidden, ErrCodeForbidden, err)
+	}
+
+	// Statuses returned by the storage or the toolkit
+	var status int
+	var gerr *googleapi.Error
+	var rerr *fetcher.ResourceError
+	var scerr httpStatusCoder
+	if errors.As(err, &gerr) {
+		status = gerr.Code
+	} else if errors.As(err, &rerr) {
+		status = rerr.HTTPStatus()
+	} else if errors.As(err, &scerr) {
+		status = scerr.HTTPStatusCode()
+	}
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return newPublicationError(http.StatusNotFound, ErrCodePublicationNotFound, err)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return newPublicationError(http.StatusForbidden, ErrCodeForbidden, err)
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return newPublicationError(http.StatusGatewayTimeout, ErrCodeUpstreamTimeout, err)
+	case status >= 500 && remote:
+		return newPublicationError(http.StatusBadGateway, ErrCodeUpstreamError, err)
+	}
+
+	// Network failures when reaching a remote storage
+	if remote && (nerr != nil || errors.As(err, &nerr)) {
+		return newPublicationError(http.StatusBadGateway, ErrCodeUpstreamError, err)
+	}
+
+	// The publication was retrieved, but couldn't be parsed
+	return newPublicationError(http.StatusUnprocessableEntity, ErrCodePublicationInvalid, err)
+}
+
+// Error code for a status returned by an auth provider.
+func codeForAuthStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnauthorized:
+		return ErrCodeInvalidToken
+	case http.StatusGone:
+		return ErrCodeTokenExpired
+	default:
+		return codeForStatus(status)
+	}
+}
+
+// Error code for a status returned when reading a resource.
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeResourceNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		return ErrCodeRangeNotSatisfiable
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return ErrCodeUpstreamError
+	case http.StatusGatewayTimeout:
+		return ErrCodeUpstreamTimeout
+	default:
+		return ErrCodeInternalError
+	}
+}
@@ -0,0 +1,122 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/serve/client"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"google.golang.org/api/googleapi"
+)
+
+// S3 error with an API error code, such as AccessDenied.
+type apiError struct {
+	code string
+}
+
+func (e *apiError) Error() string     { return e.code }
+func (e *apiError) ErrorCode() string { return e.code }
+
+func TestClassifyOpenError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		remote bool
+		status int
+		code   string
+	}{
+		{"publication error", newPublicationError(http.StatusBadRequest, ErrCodeInvalidPath, errors.New("x")), false, http.StatusBadRequest, ErrCodeInvalidPath},
+		{"wrapped publication error", errors.Wrap(newPublicationError(http.StatusBadRequest, ErrCodeInvalidPath, errors.New("x")), "y"), false, http.StatusBadRequest, ErrCodeInvalidPath},
+		{"deadline", errors.Wrap(context.DeadlineExceeded, "x"), true, http.StatusGatewayTimeout, ErrCodeUpstreamTimeout},
+		{"missing file", errors.Wrap(fs.ErrNotExist, "x"), false, http.StatusNotFound, ErrCodePublicationNotFound},
+		{"missing GCS object", storage.ErrObjectNotExist, true, http.StatusNotFound, ErrCodePublicationNotFound},
+		{"missing S3 key", &types.NoSuchKey{}, true, http.StatusNotFound, ErrCodePublicationNotFound},
+		{"permission", fs.ErrPermission, false, http.StatusForbidden, ErrCodeForbidden},
+		{"not whitelisted", client.ErrNotWhitelisted, true, http.StatusForbidden, ErrCodeForbidden},
+		{"unsafe address", client.ErrUnsafeAddress, true, http.StatusForbidden, ErrCodeForbidden},
+		{"S3 access denied", &apiError{"AccessDenied"}, true, http.StatusForbidden, ErrCodeForbidden},
+		{"GCS not found", &googleapi.Error{Code: http.StatusNotFound}, true, http.StatusNotFound, ErrCodePublicationNotFound},
+		{"GCS unavailable", &googleapi.Error{Code: http.StatusServiceUnavailable}, true, http.StatusBadGateway, ErrCodeUpstreamError},
+		{"resource not found", fetcher.NotFound(errors.New("x")), true, http.StatusNotFound, ErrCodePublicationNotFound},
+		{"resource forbidden", fetcher.Forbidden(errors.New("x")), true, http.StatusForbidden, ErrCodeForbidden},
+		{"resource timeout", fetcher.Timeout(errors.New("x")), true, http.StatusGatewayTimeout, ErrCodeUpstreamTimeout},
+		{"network failure", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, http.StatusBadGateway, ErrCodeUpstreamError},
+		{"local server error", fetcher.Other(errors.New("x")), false, http.StatusUnprocessableEntity, ErrCodePublicationInvalid},
+		{"invalid publication", errors.New("failed parsing"), true, http.StatusUnprocessableEntity, ErrCodePublicationInvalid},
+	}
+	for _, tt := range tests {
+		perr := classifyOpenError(tt.err, tt.remote)
+		if perr.Status != tt.status || perr.Code != tt.code {
+			t.Errorf("%s: got %d %s, expected %d %s", tt.name, perr.Status, perr.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestCodeForStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		code     string
+		authCode string
+	}{
+		{http.StatusBadRequest, ErrCodeInternalError, ErrCodeInvalidToken},
+		{http.StatusUnauthorized, ErrCodeInternalError, ErrCodeInvalidToken},
+		{http.StatusForbidden, ErrCodeForbidden, ErrCodeForbidden},
+		{http.StatusNotFound, ErrCodeResourceNotFound, ErrCodeResourceNotFound},
+		{http.StatusGone, ErrCodeInternalError, ErrCodeTokenExpired},
+		{http.StatusRequestedRangeNotSatisfiable, ErrCodeRangeNotSatisfiable, ErrCodeRangeNotSatisfiable},
+		{http.StatusBadGateway, ErrCodeUpstreamError, ErrCodeUpstreamError},
+		{http.StatusServiceUnavailable, ErrCodeUpstreamError, ErrCodeUpstreamError},
+		{http.StatusGatewayTimeout, ErrCodeUpstreamTimeout, ErrCodeUpstreamTimeout},
+		{http.StatusInternalServerError, ErrCodeInternalError, ErrCodeInternalError},
+	}
+	for _, tt := range tests {
+		if code := codeForStatus(tt.status); code != tt.code {
+			t.Errorf("status %d: got %s, expected %s", tt.status, code, tt.code)
+		}
+		if code := codeForAuthStatus(tt.status); code != tt.authCode {
+			t.Errorf("auth status %d: got %s, expected %s", tt.status, code, tt.authCode)
+		}
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		s := &Server{config: ServerConfig{Debug: debug}}
+		w := httptest.NewRecorder()
+		w.Header().Set("etag", `"abc"`)
+		w.Header().Set("content-encoding", "deflate")
+		s.writeProblem(w, http.StatusNotFound, ErrCodeResourceNotFound, errors.New("no resource in s3://bucket/book.epub"))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("got status %d", w.Code)
+		}
+		h := w.Header()
+		if h.Get("content-type") != "application/problem+json" || h.Get("cache-control") != "no-store" {
+			t.Errorf("got Content-Type %q and Cache-Control %q", h.Get("content-type"), h.Get("cache-control"))
+		}
+		if h.Get("etag") != "" || h.Get("content-encoding") != "" {
+			t.Errorf("headers of the resource were kept: %v", h)
+		}
+
+		var problem Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		expected := Problem{Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound, Code: ErrCodeResourceNotFound}
+		if debug {
+			// Details can contain storage locations
+			expected.Detail = "no resource in s3://bucket/book.epub"
+		}
+		if problem != expected {
+			t.Errorf("debug %v: got %+v, expected %+v", debug, problem, expected)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Package filewatch reloads files, such as keys and certificates, when they
+// change on disk.
+package filewatch
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often files are checked for changes, at most
+const checkInterval = 5 * time.Second
+
+// Watcher loads files, and loads them again when they change on disk.
+// Changes are checked when Check is called, at most once per interval, so
+// that it can be called for every request: only one of the concurrent
+// callers checks the files, without blocking the others.
+type Watcher struct {
+	files []string
+	load  func() error
+
+	mu        sync.Mutex   // Serializes loads, so that an older read isn't committed last
+	modTime   time.Time    // Latest modification time of the files when they were loaded
+	lastCheck atomic.Int64 // Unix time in nanoseconds
+}
+
+// New returns a watcher of files, which are loaded with a function keeping
+// the current state if it fails, such as when the files are in the middle of
+// being replaced. The files are loaded a first time.
+func New(files []string, load func() error) (*Watcher, error) {
+	w := &Watcher{
+		files: files,
+		load:  load,
+	}
+	if err := w.Load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Latest modification time of the files.
+func (w *Watcher) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range w.files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed checking file: %w", err)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Load loads the files, even if they haven't changed, such as on SIGHUP.
+func (w *Watcher) Load() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	modTime, err := w.filesModTime()
+	if err != nil {
+		return err
+	}
+	if err := w.load(); err != nil {
+		return err
+	}
+	w.modTime = modTime
+	w.lastCheck.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Check loads the files again if they changed since they were loaded, unless
+// they were checked less than an interval ago. It reports whether they were
+// loaded.
+func (w *Watcher) Check() (bool, error) {
+	now := time.Now().UnixNano()
+	last := w.lastCheck.Load()
+	if now-last < int64(checkInterval) || !w.lastCheck.CompareAndSwap(last, now) {
+		return false, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	modTime, err := w.filesModTime()
+	if err != nil {
+		return false, err
+	}
+	if modTime.Equal(w.modTime) {
+		return false, nil
+	}
+	if err := w.load(); err != nil {
+		return false, err
+	}
+	w.modTime = modTime
+	return true, nil
+}
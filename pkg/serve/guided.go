@@ -0,0 +1,109 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	nurl "net/url"
+	"slices"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/helpers"
+	"github.com/readium/cli/pkg/serve/cache"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+)
+
+// Result of the conversion of the media overlays of a publication
+type mediaOverlaysResult struct {
+	overlays map[string]*helpers.GuidedNavigationDocument
+	err      error
+}
+
+// Get the guided navigation documents converted from the media overlays of a
+// publication. They're kept for as long as the publication is cached, and so
+// are conversion failures, so that invalid SMIL documents aren't converted
+// again for each request of the manifest.
+func mediaOverlays(ctx context.Context, cp *cache.CachedPublication) (map[string]*helpers.GuidedNavigationDocument, error) {
+	if result, ok := cp.Derived("media-overlays"); ok {
+		r := result.(*mediaOverlaysResult)
+		return r.overlays, r.err
+	}
+
+	overlays, err := helpers.MediaOverlays(ctx, cp.Publication)
+	if err != nil && ctx.Err() != nil {
+		// The request was canceled, the conversion can be tried again
+		return nil, err
+	}
+	cp.SetDerived("media-overlays", &mediaOverlaysResult{overlays: overlays, err: err})
+	return overlays, err
+}
+
+// Add links to the guided navigation documents of the resources of the reading
+// order that have a media overlay, as alternates. The resources are looked up
+// by their href in the original reading order, since the hrefs of the reading
+// order may have been rewritten to the resource base URL.
+func withGuidedNavigationLinks(readingOrder, original manifest.LinkList, overlays map[string]*helpers.GuidedNavigationDocument) manifest.LinkList {
+	if len(overlays) == 0 {
+		return readingOrder
+	}
+
+	readingOrder = slices.Clone(readingOrder)
+	for i, link := range original {
+		href := link.Href.String()
+		if _, ok := overlays[href]; !ok {
+			continue
+		}
+		readingOrder[i].Alternates = append(slices.Clone(readingOrder[i].Alternates), manifest.Link{
+			Href:      manifest.MustNewHREFFromString("guided-navigation?ref="+nurl.QueryEscape(href), false),
+			MediaType: &mediatype.ReadiumGuidedNavigationDocument,
+		})
+	}
+	return readingOrder
+}
+
+func (s *Server) getGuidedNavigation(w http.ResponseWriter, req *http.Request) {
+	filename := req.Context().Value(ContextPathKey).(string)
+
+	ref := req.URL.Query().Get("ref")
+	if ref == "" {
+		s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("missing resource reference"))
+		return
+	}
+
+	// Load the publication
+	cp, err := s.getPublication(req.Context(), filename)
+	if err != nil {
+		s.writePublicationProblem(w, err)
+		return
+	}
+	defer cp.Release()
+
+	overlays, err := mediaOverlays(req.Context(), cp)
+	if err != nil {
+		s.writeProblem(w, http.StatusUnprocessableEntity, ErrCodePublicationInvalid, err)
+		return
+	}
+	doc, ok := overlays[ref]
+	if !ok {
+		s.writeProblem(w, http.StatusNotFound, ErrCodeResourceNotFound, errors.New("no media overlay for resource "+ref))
+		return
+	}
+
+	var j []byte
+	if s.config.JSONIndent == "" {
+		j, err = json.Marshal(doc)
+	} else {
+		j, err = json.MarshalIndent(doc, "", s.config.JSONIndent)
+	}
+	if err != nil {
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed marshalling guided navigation JSON"))
+		return
+	}
+
+	w.Header().Set("content-type", mediatype.ReadiumGuidedNavigationDocument.String()+"; charset=utf-8")
+	w.Header().Set("cache-control", "private, max-age=86400, immutable")
+	w.Header().Set("content-length", strconv.Itoa(len(j)))
+	w.Write(j)
+}
@@ -53,6 +53,8 @@ var compressableMimes = []string{
 	mediatype.NCX.String(),
 	mediatype.XML.String(),
 	mediatype.JSON.String(),
+	opdsMediaType,
+	"application/vnd.readium.locators+json",
 }
 
 func conformsToAsMimetype(conformsTo manifest.Profiles) mediatype.MediaType {
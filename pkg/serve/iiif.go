@@ -0,0 +1,521 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"net/http"
+	nurl "net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/serve/cache"
+	"github.com/readium/cli/pkg/serve/webp"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/util/url"
+	"github.com/zeebo/xxh3"
+	_ "golang.org/x/image/webp" // WebP decoding
+)
+
+// Default maximum width and height of images produced by the IIIF service
+const DefaultIIIFMaxSize = 4096
+
+// Default total size of the images produced by the IIIF service kept in memory
+const DefaultIIIFCacheSize = 128 * 1024 * 1024
+
+const iiifCacheTTL = time.Hour
+
+// Images with more pixels than this are not processed, to protect against decompression bombs
+const iiifMaxSourcePixels = 100_000_000
+
+// Maximum size of an image resource that can be processed
+const iiifMaxSourceLength = 64 * 1024 * 1024
+
+const iiifProfile = "http://iiif.io/api/image/3/level2.json"
+
+// Encoders of the formats of images produced by the IIIF service
+var iiifEncoders = map[string]func(w io.Writer, img image.Image) error{
+	"jpg": func(w io.Writer, img image.Image) error {
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(85))
+	},
+	"png": func(w io.Writer, img image.Image) error {
+		return imaging.Encode(w, img, imaging.PNG)
+	},
+	"gif": func(w io.Writer, img image.Image) error {
+		return imaging.Encode(w, img, imaging.GIF)
+	},
+	"webp": webp.Encode, // Lossless
+}
+
+var iiifMimeTypes = map[string]string{
+	"jpg":  "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// Image produced by the IIIF service, implements Evictable and Sized
+type iiifImage struct {
+	data []byte
+	etag string
+}
+
+func (i *iiifImage) OnEvict() {}
+
+func (i *iiifImage) Size() int64 {
+	return int64(len(i.data))
+}
+
+// Parameters of an IIIF image request
+type iiifRequest struct {
+	region   image.Rectangle
+	width    int
+	height   int
+	mirror   bool
+	rotation float64
+	quality  string
+	format   string
+}
+
+type iiifInfo struct {
+	Context        string   `json:"@context"`
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	MaxWidth       int      `json:"maxWidth"`
+	MaxHeight      int      `json:"maxHeight"`
+	ExtraFormats   []string `json:"extraFormats"`
+	ExtraQualities []string `json:"extraQualities"`
+	ExtraFeatures  []string `json:"extraFeatures"`
+}
+
+// Parse the region parameter of an IIIF request, for an image of the given size.
+func parseIIIFRegion(s string, width, height int) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, width, height)
+	switch s {
+	case "full":
+		return bounds, nil
+	case "square":
+		side := min(width, height)
+		x, y := (width-side)/2, (height-side)/2
+		return image.Rect(x, y, x+side, y+side), nil
+	}
+
+	pct := strings.HasPrefix(s, "pct:")
+	parts := strings.Split(strings.TrimPrefix(s, "pct:"), ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, errors.New("invalid region " + s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) {
+			return image.Rectangle{}, errors.New("invalid region " + s)
+		}
+		v[i] = f
+	}
+	if pct {
+		v[0], v[2] = v[0]*float64(width)/100, v[2]*float64(width)/100
+		v[1], v[3] = v[1]*float64(height)/100, v[3]*float64(height)/100
+	}
+	x, y := int(math.Round(v[0])), int(math.Round(v[1]))
+	region := image.Rect(x, y, x+int(math.Round(v[2])), y+int(math.Round(v[3]))).Intersect(bounds)
+	if region.Empty() {
+		return image.Rectangle{}, errors.New("region " + s + " is outside of the image")
+	}
+	return region, nil
+}
+
+// Parse the size parameter of an IIIF request, for a region of the given size.
+func parseIIIFSize(s string, width, height, maxSize int) (int, int, error) {
+	upscale := strings.HasPrefix(s, "^")
+	s = strings.TrimPrefix(s, "^")
+
+	// Scale to fit in a box, keeping the aspect ratio
+	fit := func(bw, bh int) (int, int) {
+		scale := min(float64(bw)/float64(width), float64(bh)/float64(height))
+		return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+	}
+
+	var w, h int
+	switch {
+	case s == "max":
+		w, h = width, height
+		if w > maxSize || h > maxSize {
+			w, h = fit(maxSize, maxSize)
+		}
+	case strings.HasPrefix(s, "pct:"):
+		pct, err := strconv.ParseFloat(s[4:], 64)
+		if err != nil || pct <= 0 || math.IsInf(pct, 0) {
+			return 0, 0, errors.New("invalid size " + s)
+		}
+		w, h = max(1, int(math.Round(float64(width)*pct/100))), max(1, int(math.Round(float64(height)*pct/100)))
+	default:
+		confined := strings.HasPrefix(s, "!")
+		ws, hs, ok := strings.Cut(strings.TrimPrefix(s, "!"), ",")
+		if !ok {
+			return 0, 0, errors.New("invalid size " + s)
+		}
+		var err error
+		if ws != "" {
+			if w, err = strconv.Atoi(ws); err != nil || w <= 0 {
+				return 0, 0, errors.New("invalid size " + s)
+			}
+		}
+		if hs != "" {
+			if h, err = strconv.Atoi(hs); err != nil || h <= 0 {
+				return 0, 0, errors.New("invalid size " + s)
+			}
+		}
+		switch {
+		case confined && (w == 0 || h == 0):
+			return 0, 0, errors.New("invalid size " + s)
+		case confined:
+			w, h = fit(w, h)
+		case w == 0 && h == 0:
+			return 0, 0, errors.New("invalid size " + s)
+		case h == 0:
+			h = max(1, int(math.Round(float64(height)*float64(w)/float64(width))))
+		case w == 0:
+			w = max(1, int(math.Round(float64(width)*float64(h)/float64(height))))
+		}
+	}
+
+	if !upscale && (w > width || h > height) {
+		return 0, 0, errors.New("size " + s + " is larger than the region, and upscaling was not requested")
+	}
+	if w > maxSize || h > maxSize {
+		return 0, 0, errors.New("size " + s + " is larger than the maximum size")
+	}
+	return w, h, nil
+}
+
+// Parse the rotation parameter of an IIIF request.
+func parseIIIFRotation(s string) (bool, float64, error) {
+	mirror := strings.HasPrefix(s, "!")
+	rotation, err := strconv.ParseFloat(strings.TrimPrefix(s, "!"), 64)
+	if err != nil || rotation < 0 || rotation > 360 {
+		return false, 0, errors.New("invalid rotation " + s)
+	}
+	return mirror, rotation, nil
+}
+
+// Apply an IIIF request to an image, in the order defined by the specification.
+func processIIIFImage(img image.Image, req iiifRequest) image.Image {
+	img = imaging.Crop(img, req.region)
+	if req.width != req.region.Dx() || req.height != req.region.Dy() {
+		img = imaging.Resize(img, req.width, req.height, imaging.Lanczos)
+	}
+	if req.mirror {
+		img = imaging.FlipH(img)
+	}
+	if req.rotation != 0 && req.rotation != 360 {
+		background := color.Color(color.Transparent)
+		if req.format == "jpg" {
+			background = color.White
+		}
+		img = imaging.Rotate(img, 360-req.rotation, background) // Clockwise
+	}
+	switch req.quality {
+	case "gray":
+		img = imaging.Grayscale(img)
+	case "bitonal":
+		gray := imaging.Grayscale(img)
+		bitonal := image.NewGray(gray.Bounds())
+		for y := gray.Bounds().Min.Y; y < gray.Bounds().Max.Y; y++ {
+			for x := gray.Bounds().Min.X; x < gray.Bounds().Max.X; x++ {
+				if gray.NRGBAAt(x, y).R >= 128 {
+					bitonal.SetGray(x, y, color.Gray{Y: 255})
+				}
+			}
+		}
+		img = bitonal
+	}
+	return img
+}
+
+// Find an image resource of the publication from its href.
+func iiifImageLink(cp *cache.CachedPublication, asset string) (*manifest.Link, error) {
+	href, err := url.URLFromDecodedPath(path.Clean(asset))
+	if err != nil {
+		return nil, newPublicationError(http.StatusBadRequest, ErrCodeInvalidPath, errors.Wrap(err, "failed parsing image path as URL"))
+	}
+	link := cp.LinkWithHref(href)
+	if link == nil {
+		return nil, newPublicationError(http.StatusNotFound, ErrCodeResourceNotFound, errors.New("no resource with href "+href.String()))
+	}
+	if link.MediaType == nil || !link.MediaType.IsBitmap() {
+		return nil, newPublicationError(http.StatusNotFound, ErrCodeResourceNotFound, errors.New("resource "+href.String()+" is not a bitmap image"))
+	}
+	return link, nil
+}
+
+// Read an image resource of the publication.
+func readIIIFSource(ctx context.Context, cp *cache.CachedPublication, link manifest.Link) ([]byte, error) {
+	res := cp.Get(ctx, link)
+	defer res.Close()
+
+	l, rerr := res.Length(ctx)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if l > iiifMaxSourceLength {
+		return nil, newPublicationError(http.StatusRequestEntityTooLarge, ErrCodeImageTooLarge, errors.New("image is too large to be processed"))
+	}
+	data, rerr := res.Read(ctx, 0, 0)
+	if rerr != nil {
+		return nil, rerr
+	}
+	return data, nil
+}
+
+// Reader of a resource, reading it in ranges as needed.
+type resourceReader struct {
+	ctx    context.Context
+	res    fetcher.Resource
+	offset int64
+	length int64
+	err    *fetcher.ResourceError // Last error reading the resource, which decoders may not return as is
+}
+
+func (r *resourceReader) Read(p []byte) (int, error) {
+	if r.offset >= r.length {
+		return 0, io.EOF
+	}
+	end := min(r.offset+int64(len(p)), r.length) - 1
+	data, rerr := r.res.Read(r.ctx, r.offset, end)
+	if rerr != nil {
+		r.err = rerr
+		return 0, rerr
+	}
+	n := copy(p, data)
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Size of the reads of image headers
+const iiifHeaderReadSize = 32 * 1024
+
+// Get the dimensions of an image resource, without decoding it, and only
+// reading it up to its header. They're kept for as long as the publication
+// is cached.
+func iiifImageSize(ctx context.Context, cp *cache.CachedPublication, link manifest.Link) (int, int, error) {
+	key := "iiif-size:" + link.Href.String()
+	if size, ok := cp.Derived(key); ok {
+		p := size.(image.Point)
+		return p.X, p.Y, nil
+	}
+
+	res := cp.Get(ctx, link)
+	defer res.Close()
+	l, rerr := res.Length(ctx)
+	if rerr != nil {
+		return 0, 0, rerr
+	}
+	r := &resourceReader{ctx: ctx, res: res, length: l}
+	config, _, err := image.DecodeConfig(bufio.NewReaderSize(r, iiifHeaderReadSize))
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+	if err != nil {
+		return 0, 0, newPublicationError(http.StatusUnprocessableEntity, ErrCodeImageInvalid, errors.Wrap(err, "failed decoding image"))
+	}
+	cp.SetDerived(key, image.Pt(config.Width, config.Height))
+	return config.Width, config.Height, nil
+}
+
+// Respond with an error returned while handling an IIIF request.
+func (s *Server) writeIIIFProblem(w http.ResponseWriter, err error) {
+	var rerr *fetcher.ResourceError
+	if errors.As(err, &rerr) {
+		s.writeProblem(w, rerr.HTTPStatus(), codeForStatus(rerr.HTTPStatus()), rerr)
+		return
+	}
+	s.writePublicationProblem(w, err)
+}
+
+func (s *Server) getIIIFRedirect(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	ru, _ := s.router.Get("iiif-info").URLPath("path", vars["path"], "asset", nurl.PathEscape(vars["asset"]))
+	// Behind a proxy with a prefix, the path of the router alone would miss it
+	http.Redirect(w, req, s.baseURL(req)+ru.String(), http.StatusSeeOther)
+}
+
+func (s *Server) getIIIFInfo(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	filename := req.Context().Value(ContextPathKey).(string)
+
+	// Load the publication
+	cp, err := s.getPublication(req.Context(), filename)
+	if err != nil {
+		s.writePublicationProblem(w, err)
+		return
+	}
+	defer cp.Release()
+	link, err := iiifImageLink(cp, vars["asset"])
+	if err != nil {
+		s.writePublicationProblem(w, err)
+		return
+	}
+	width, height, err := iiifImageSize(req.Context(), cp, *link)
+	if err != nil {
+		s.writeIIIFProblem(w, err)
+		return
+	}
+
+	// The ID of the image is the base URL of the service, with the href of the image escaped
+	base, _ := s.router.Get("iiif").URLPath("path", vars["path"], "asset", nurl.PathEscape(vars["asset"]))
+	info := iiifInfo{
+		Context:        "http://iiif.io/api/image/3/context.json",
+		ID:             s.baseURL(req) + base.String(),
+		Type:           "ImageService3",
+		Protocol:       "http://iiif.io/api/image",
+		Profile:        "level2",
+		Width:          width,
+		Height:         height,
+		MaxWidth:       s.config.IIIFMaxSize,
+		MaxHeight:      s.config.IIIFMaxSize,
+		ExtraFormats:   []string{"gif", "webp"},
+		ExtraQualities: []string{"color", "gray", "bitonal"},
+		ExtraFeatures:  []string{"mirroring", "rotationArbitrary", "sizeUpscaling"},
+	}
+
+	var j []byte
+	if s.config.JSONIndent == "" {
+		j, err = json.Marshal(info)
+	} else {
+		j, err = json.MarshalIndent(info, "", s.config.JSONIndent)
+	}
+	if err != nil {
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed marshalling IIIF info"))
+		return
+	}
+
+	// Clients asking for JSON-LD get JSON-LD
+	contentType := "application/json"
+	if strings.Contains(req.Header.Get("accept"), "application/ld+json") {
+		contentType = `application/ld+json;profile="http://iiif.io/api/image/3/context.json"`
+	}
+	w.Header().Set("content-type", contentType)
+	w.Header().Set("cache-control", "private, must-revalidate")
+	w.Header().Set("link", "<"+iiifProfile+`>;rel="profile"`)
+	w.Header().Set("etag", `"`+strconv.FormatUint(xxh3.Hash(j), 36)+`"`)
+	http.ServeContent(w, req, "info.json", cp.ModTime, bytes.NewReader(j))
+}
+
+func (s *Server) getIIIFImage(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	filename := req.Context().Value(ContextPathKey).(string)
+
+	format := vars["format"]
+	encode, ok := iiifEncoders[format]
+	if !ok {
+		s.writeProblem(w, http.StatusNotImplemented, ErrCodeUnsupportedFormat, errors.New("format "+format+" is not supported"))
+		return
+	}
+	quality := vars["quality"]
+	switch quality {
+	case "default", "color", "gray", "bitonal":
+	default:
+		s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("invalid quality "+quality))
+		return
+	}
+
+	// Load the publication
+	cp, err := s.getPublication(req.Context(), filename)
+	if err != nil {
+		s.writePublicationProblem(w, err)
+		return
+	}
+	defer cp.Release()
+	link, err := iiifImageLink(cp, vars["asset"])
+	if err != nil {
+		s.writePublicationProblem(w, err)
+		return
+	}
+	width, height, err := iiifImageSize(req.Context(), cp, *link)
+	if err != nil {
+		s.writeIIIFProblem(w, err)
+		return
+	}
+
+	// Parse the request
+	ireq := iiifRequest{quality: quality, format: format}
+	ireq.region, err = parseIIIFRegion(vars["region"], width, height)
+	if err == nil {
+		ireq.width, ireq.height, err = parseIIIFSize(vars["size"], ireq.region.Dx(), ireq.region.Dy(), s.config.IIIFMaxSize)
+	}
+	if err == nil {
+		ireq.mirror, ireq.rotation, err = parseIIIFRotation(vars["rotation"])
+	}
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+		return
+	}
+
+	// Requests resulting in the same image share the cache entry
+	key := strings.Join([]string{
+		filename, link.Href.String(), strconv.FormatInt(cp.ModTime.UnixNano(), 36),
+		ireq.region.String(), strconv.Itoa(ireq.width), strconv.Itoa(ireq.height),
+		strconv.FormatBool(ireq.mirror), strconv.FormatFloat(ireq.rotation, 'g', -1, 64),
+		quality, format,
+	}, "\x00")
+
+	var result *iiifImage
+	if dat, ok := s.iiif.Get(key); ok {
+		result = dat.(*iiifImage)
+	} else {
+		if width*height > iiifMaxSourcePixels {
+			s.writeProblem(w, http.StatusRequestEntityTooLarge, ErrCodeImageTooLarge, errors.New("image is too large to be processed"))
+			return
+		}
+		data, err := readIIIFSource(req.Context(), cp, *link)
+		if err != nil {
+			s.writeIIIFProblem(w, err)
+			return
+		}
+
+		// Limit the number of images being processed at the same time
+		select {
+		case s.iiifSem <- struct{}{}:
+		case <-req.Context().Done():
+			return
+		}
+		var buf bytes.Buffer
+		img, err := imaging.Decode(bytes.NewReader(data))
+		if err == nil {
+			err = encode(&buf, processIIIFImage(img, ireq))
+		}
+		<-s.iiifSem
+		if err != nil {
+			s.writeProblem(w, http.StatusUnprocessableEntity, ErrCodeImageInvalid, errors.Wrap(err, "failed processing image"))
+			return
+		}
+
+		result = &iiifImage{
+			data: buf.Bytes(),
+			etag: `"` + strconv.FormatUint(xxh3.Hash(buf.Bytes()), 36) + `"`,
+		}
+		s.iiif.Set(key, result)
+	}
+
+	w.Header().Set("content-type", iiifMimeTypes[format])
+	w.Header().Set("cache-control", "private, max-age=86400, immutable")
+	w.Header().Set("link", "<"+iiifProfile+`>;rel="profile"`)
+	w.Header().Set("etag", result.etag)
+	http.ServeContent(w, req, "", cp.ModTime, bytes.NewReader(result.data))
+}
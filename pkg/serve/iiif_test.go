@@ -0,0 +1,50 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/fetcher"
+)
+
+// Resource counting the bytes read from it.
+type countingResource struct {
+	bytesResource
+	read int
+}
+
+func (r *countingResource) Read(ctx context.Context, start, end int64) ([]byte, *fetcher.ResourceError) {
+	data, rerr := r.bytesResource.Read(ctx, start, end)
+	r.read += len(data)
+	return data, rerr
+}
+
+func TestResourceReaderDecodesHeaderOnly(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 1000, 800))
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rnd.Uint32())
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	res := &countingResource{bytesResource: bytesResource{buf.Bytes()}}
+	r := &resourceReader{ctx: context.Background(), res: res, length: int64(buf.Len())}
+	config, format, err := image.DecodeConfig(bufio.NewReaderSize(r, iiifHeaderReadSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || config.Width != 1000 || config.Height != 800 {
+		t.Errorf("got %s image of %dx%d", format, config.Width, config.Height)
+	}
+	if res.read > iiifHeaderReadSize {
+		t.Errorf("read %d bytes of a %d bytes image", res.read, buf.Len())
+	}
+}
@@ -0,0 +1,252 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/serve/cache"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/zeebo/xxh3"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// InjectionRules are the elements injected in the HTML and XHTML resources of a layout.
+type InjectionRules struct {
+	StylesheetsBefore []string // Stylesheets added at the start of the head, before the publisher's styles
+	StylesheetsAfter  []string // Stylesheets added at the end of the head, after the publisher's styles
+	Scripts           []string // Scripts added at the end of the head
+	Viewport          string   // Content of a viewport meta tag, added if the document doesn't have one
+}
+
+func (r InjectionRules) empty() bool {
+	return len(r.StylesheetsBefore) == 0 && len(r.StylesheetsAfter) == 0 && len(r.Scripts) == 0 && r.Viewport == ""
+}
+
+// Hash of the rules, to distinguish injected documents in entity tags.
+func (r InjectionRules) hash() string {
+	j, _ := json.Marshal(r)
+	return strconv.FormatUint(xxh3.Hash(j), 36)
+}
+
+// InjectionConfig enables injecting stylesheets, scripts and a viewport in
+// HTML and XHTML resources, such as ReadiumCSS.
+type InjectionConfig struct {
+	Reflowable  InjectionRules // Rules for reflowable resources
+	FixedLayout InjectionRules // Rules for fixed-layout resources
+}
+
+// Layout of the publication, as found in its metadata. It's kept for as
+// long as the publication is cached.
+func publicationLayout(cp *cache.CachedPublication) string {
+	if layout, ok := cp.Derived("layout"); ok {
+		return layout.(string)
+	}
+
+	var metadata struct {
+		Layout       string `json:"layout"`
+		Presentation struct {
+			Layout string `json:"layout"`
+		} `json:"presentation"`
+	}
+	var layout string
+	if j, err := json.Marshal(&cp.Manifest.Metadata); err == nil && json.Unmarshal(j, &metadata) == nil {
+		layout = metadata.Layout
+		if layout == "" {
+			layout = metadata.Presentation.Layout
+		}
+	}
+	cp.SetDerived("layout", layout)
+	return layout
+}
+
+// Rules to apply to a resource, or nil if nothing needs to be injected.
+func (s *Server) injectionRules(cp *cache.CachedPublication, link manifest.Link, mimeType string) *InjectionRules {
+	if s.config.Injection == nil || (mimeType != "text/html" && mimeType != "application/xhtml+xml") {
+		return nil
+	}
+
+	// The layout of a resource can override the one of the publication
+	layout, _ := link.Properties["layout"].(string)
+	if layout == "" {
+		layout = publicationLayout(cp)
+	}
+
+	rules := &s.config.Injection.Reflowable
+	if layout == "fixed" {
+		rules = &s.config.Injection.FixedLayout
+	}
+	if rules.empty() {
+		return nil
+	}
+	return rules
+}
+
+// Insert the elements of the rules in the head of an HTML or XHTML document.
+// The document is not reserialized, to keep XHTML well-formed: elements are
+// inserted at the offsets of the tags found by the tokenizer.
+func injectElements(doc []byte, rules *InjectionRules) []byte {
+	var before, after strings.Builder
+	for _, href := range rules.StylesheetsBefore {
+		before.WriteString(`<link rel="stylesheet" type="text/css" href="` + html.EscapeString(href) + `"/>`)
+	}
+	for _, href := range rules.StylesheetsAfter {
+		after.WriteString(`<link rel="stylesheet" type="text/css" href="` + html.EscapeString(href) + `"/>`)
+	}
+	for _, src := range rules.Scripts {
+		after.WriteString(`<script type="text/javascript" src="` + html.EscapeString(src) + `"></script>`)
+	}
+
+	// Find the head of the document
+	htmlEnd, headEnd, headCloseStart := -1, -1, -1
+	hasViewport := false
+	offset := 0
+	z := xhtml.NewTokenizer(bytes.NewReader(doc))
+tokens:
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+		raw := len(z.Raw())
+		if tt != xhtml.StartTagToken && tt != xhtml.EndTagToken && tt != xhtml.SelfClosingTagToken {
+			offset += raw
+			continue
+		}
+		if tt == xhtml.SelfClosingTagToken {
+			// In XHTML, self-closing elements such as <script/> have no content
+			z.NextIsNotRawText()
+		}
+		name, hasAttr := z.TagName()
+		switch a := atom.Lookup(name); {
+		case tt == xhtml.StartTagToken && a == atom.Html && htmlEnd < 0:
+			htmlEnd = offset + raw
+		case tt == xhtml.StartTagToken && a == atom.Head && headEnd < 0:
+			headEnd = offset + raw
+		case (tt == xhtml.StartTagToken || tt == xhtml.SelfClosingTagToken) && a == atom.Meta && hasAttr:
+			for {
+				key, val, more := z.TagAttr()
+				if string(key) == "name" && strings.EqualFold(string(val), "viewport") {
+					hasViewport = true
+				}
+				if !more {
+					break
+				}
+			}
+		case tt == xhtml.EndTagToken && a == atom.Head:
+			headCloseStart = offset
+			break tokens
+		case tt == xhtml.StartTagToken && a == atom.Body:
+			// No closing head tag
+			headCloseStart = offset
+			break tokens
+		}
+		offset += raw
+	}
+
+	if rules.Viewport != "" && !hasViewport {
+		before.WriteString(`<meta name="viewport" content="` + html.EscapeString(rules.Viewport) + `"/>`)
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(doc) + before.Len() + after.Len() + len("<head></head>"))
+	switch {
+	case headEnd >= 0 && headCloseStart >= headEnd:
+		out.Write(doc[:headEnd])
+		out.WriteString(before.String())
+		out.Write(doc[headEnd:headCloseStart])
+		out.WriteString(after.String())
+		out.Write(doc[headCloseStart:])
+	case headEnd >= 0:
+		// Head without an end
+		out.Write(doc[:headEnd])
+		out.WriteString(before.String() + after.String())
+		out.Write(doc[headEnd:])
+	case htmlEnd >= 0:
+		// No head, add one
+		out.Write(doc[:htmlEnd])
+		out.WriteString("<head>" + before.String() + after.String() + "</head>")
+		out.Write(doc[htmlEnd:])
+	default:
+		out.WriteString(before.String() + after.String())
+		out.Write(doc)
+	}
+	return out.Bytes()
+}
+
+// Total size of the rewritten documents kept in memory
+const rewrittenCacheSize = 64 * 1024 * 1024
+
+const rewrittenCacheTTL = time.Hour
+
+// Rewritten document, implements Evictable and Sized
+type rewrittenDoc []byte
+
+func (d rewrittenDoc) OnEvict() {}
+
+func (d rewrittenDoc) Size() int64 {
+	return int64(len(d))
+}
+
+// Get a document rewritten for serving: scripts are removed from it if
+// sanitize is set, then the elements of the rules (if any) are injected. The
+// documents used last are kept in memory, keyed by the path of their
+// publication and their entity tag.
+func (s *Server) rewrittenDocument(ctx context.Context, filename string, res fetcher.Resource, mimeType, etag string, rules *InjectionRules, sanitize bool) ([]byte, *fetcher.ResourceError) {
+	key := filename + "\x00" + etag
+	if doc, ok := s.rewritten.Get(key); ok {
+		return doc.(rewrittenDoc), nil
+	}
+
+	doc, rerr := res.Read(ctx, 0, 0)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if sanitize {
+		doc = sanitizeDocument(doc, mimeType)
+	}
+	if rules != nil {
+		doc = injectElements(doc, rules)
+	}
+	s.rewritten.Set(key, rewrittenDoc(doc))
+	return doc, nil
+}
+
+// Respond with a document rewritten in memory. It's never served with
+// compressed passthrough, and ranges apply to the rewritten document.
+func (s *Server) serveRewritten(w http.ResponseWriter, r *http.Request, cp *cache.CachedPublication, res fetcher.Resource, mimeType, etag string, rules *InjectionRules, sanitize bool) {
+	// The entity tag of the original resource, along with the rewrites
+	etag = strings.TrimSuffix(etag, `"`)
+	if sanitize {
+		etag += "-s"
+	}
+	if rules != nil {
+		etag += "-" + rules.hash()
+	}
+	etag += `"`
+
+	filename := r.Context().Value(ContextPathKey).(string)
+	doc, rerr := s.rewrittenDocument(r.Context(), filename, res, mimeType, etag, rules, sanitize)
+	if rerr != nil {
+		s.writeProblem(w, rerr.HTTPStatus(), codeForStatus(rerr.HTTPStatus()), errors.Wrap(rerr, "failed reading document"))
+		return
+	}
+
+	w.Header().Del("content-length") // Set by ServeContent
+	w.Header().Set("etag", etag)
+	if s.config.ReprDigest && !mayBeCompressed(r, mimeType, "") {
+		digest := sha256.Sum256(doc)
+		w.Header().Set("repr-digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+	}
+	http.ServeContent(w, r, "", cp.ModTime, bytes.NewReader(doc))
+}
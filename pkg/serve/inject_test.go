@@ -0,0 +1,36 @@
+package serve
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/cli/pkg/serve/cache"
+)
+
+func TestRewrittenDocumentCache(t *testing.T) {
+	s := &Server{rewritten: cache.NewLRU(1024, time.Hour)}
+	small := &countingResource{bytesResource: bytesResource{[]byte(`<p>a</p><script>alert(1)</script>`)}}
+	large := &countingResource{bytesResource: bytesResource{[]byte("<p>" + strings.Repeat("a", 2048) + "</p>")}}
+
+	for range 2 {
+		doc, rerr := s.rewrittenDocument(context.Background(), "book.epub", small, "text/html", `"small"`, nil, true)
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		if string(doc) != "<p>a</p>" {
+			t.Errorf("got %q", doc)
+		}
+		if _, rerr := s.rewrittenDocument(context.Background(), "book.epub", large, "text/html", `"large"`, nil, true); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	if small.read != len(small.data) {
+		t.Errorf("small document read %d times", small.read/len(small.data))
+	}
+	// Documents larger than the cache are rewritten for each request
+	if large.read != 2*len(large.data) {
+		t.Errorf("large document read %d times", large.read/len(large.data))
+	}
+}
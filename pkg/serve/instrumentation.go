@@ -0,0 +1,231 @@
+package serve
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/readium/cli/pkg/serve/cache"
+)
+
+// Buckets of latency histograms, in seconds, up to the durations of large
+// remote publications
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Buckets of sizes, in bytes
+var sizeBuckets = []float64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+// Requests to remote storage, shared by the HTTP clients of all the servers
+var (
+	remoteRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "readium_remote_requests_total",
+		Help: "Requests to remote storage, such as the range requests of remote archives.",
+	}, []string{"scheme", "status"})
+	remoteResponseBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "readium_remote_response_bytes",
+		Help:    "Size of the responses of remote storage.",
+		Buckets: sizeBuckets,
+	}, []string{"scheme"})
+)
+
+type serverMetrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	assetBytes      *prometheus.CounterVec
+	publicationOpen *prometheus.HistogramVec
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "readium_http_requests_total",
+			Help: "HTTP requests, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "readium_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests until the response is fully sent, by route.",
+			Buckets: latencyBuckets,
+		}, []string{"route"}),
+		assetBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "readium_asset_bytes_total",
+			Help: "Bytes of publication resources sent, compressed as stored in the publication (passthrough) or decompressed.",
+		}, []string{"representation"}),
+		publicationOpen: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "readium_publication_open_duration_seconds",
+			Help:    "Duration of the opening of publications, by scheme and result.",
+			Buckets: latencyBuckets,
+		}, []string{"scheme", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.assetBytes, m.publicationOpen,
+		remoteRequests, remoteResponseBytes,
+		&cacheCollector{server: s},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+var (
+	cacheHitsDesc      = prometheus.NewDesc("readium_cache_hits_total", "Cache hits, by cache.", []string{"cache"}, nil)
+	cacheMissesDesc    = prometheus.NewDesc("readium_cache_misses_total", "Cache misses, by cache.", []string{"cache"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("readium_cache_evictions_total", "Cache evictions, by cache.", []string{"cache"}, nil)
+	cacheEntriesDesc   = prometheus.NewDesc("readium_cache_entries", "Entries in the cache, by cache.", []string{"cache"}, nil)
+)
+
+// Collector of the statistics of the caches of a server, read when metrics
+// are scraped
+type cacheCollector struct {
+	server *Server
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheEntriesDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	caches := map[string]interface{ Stats() cache.Stats }{"publications": c.server.lfu, "iiif": c.server.iiif, "documents": c.server.rewritten}
+	if c.server.opds != nil {
+		caches["opds"] = c.server.opds.entries
+	}
+	for name, c := range caches {
+		stats := c.Stats()
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses), name)
+		ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions), name)
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries), name)
+	}
+}
+
+// InstrumentTransport wraps the transport of an HTTP client used to access
+// remote storage, to count its requests and the size of its responses, and
+// to send the ID of the request they're made for.
+func InstrumentTransport(scheme string, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &instrumentedTransport{scheme: scheme, next: rt}
+}
+
+type instrumentedTransport struct {
+	scheme string
+	next   http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scheme := t.scheme
+	if scheme == "" {
+		scheme = req.URL.Scheme
+	}
+	if id := RequestID(req.Context()); id != "" && req.Header.Get(requestIDHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		remoteRequests.WithLabelValues(scheme, "error").Inc()
+		return resp, err
+	}
+	remoteRequests.WithLabelValues(scheme, strconv.Itoa(resp.StatusCode)).Inc()
+	resp.Body = &countingBody{ReadCloser: resp.Body, scheme: scheme}
+	return resp, nil
+}
+
+// Response body counting the bytes read from it
+type countingBody struct {
+	io.ReadCloser
+	scheme string
+	n      int64
+	once   sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() {
+		remoteResponseBytes.WithLabelValues(b.scheme).Observe(float64(b.n))
+	})
+	return b.ReadCloser.Close()
+}
+
+type requestMetricsKey struct{}
+
+// Metrics of a request, filled in by its handler
+type requestMetrics struct {
+	representation string
+}
+
+// Record how a resource is represented in the response, for the metrics.
+func setRepresentation(ctx context.Context, representation string) {
+	if rm, ok := ctx.Value(requestMetricsKey{}).(*requestMetrics); ok {
+		rm.representation = representation
+	}
+}
+
+// Response writer recording the status and size of a response
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware recording the metrics of requests, by the name of their route.
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "other"
+		if cr := mux.CurrentRoute(r); cr != nil && cr.GetName() != "" {
+			route = cr.GetName()
+		}
+
+		start := time.Now()
+		rm := &requestMetrics{}
+		mw := &metricsResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r.WithContext(context.WithValue(r.Context(), requestMetricsKey{}, rm)))
+
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.metrics.requests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		s.metrics.requestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		if rm.representation != "" {
+			s.metrics.assetBytes.WithLabelValues(rm.representation).Add(float64(mw.bytes))
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/readium/cli/pkg/serve/cache"
+)
+
+// Value of the counter, gauge or histogram count of a metric with the given
+// labels, or -1 if there's none.
+func metricValue(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			case m.GetHistogram() != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return -1
+}
+
+func TestRequestMetrics(t *testing.T) {
+	s := NewServer(ServerConfig{}, Remote{})
+	h := s.Routes()
+	for _, path := range []string{"/health", "/health", "/version", "/unknown"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/health", nil))
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected float64
+	}{
+		{"readium_http_requests_total", map[string]string{"route": "health", "method": "GET", "status": "200"}, 2},
+		{"readium_http_requests_total", map[string]string{"route": "health", "method": "HEAD", "status": "200"}, 1},
+		{"readium_http_requests_total", map[string]string{"route": "version", "method": "GET", "status": "200"}, 1},
+		// Paths without a route don't create a label value each
+		{"readium_http_requests_total", map[string]string{"route": "other", "method": "GET", "status": "404"}, 1},
+		{"readium_http_request_duration_seconds", map[string]string{"route": "health"}, 3},
+	}
+	for _, tt := range tests {
+		if v := metricValue(t, s.metrics.registry, tt.name, tt.labels); v != tt.expected {
+			t.Errorf("%s%v: got %v, expected %v", tt.name, tt.labels, v, tt.expected)
+		}
+	}
+}
+
+func TestAssetBytesMetrics(t *testing.T) {
+	s := NewServer(ServerConfig{}, Remote{})
+	h := s.metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRepresentation(r.Context(), r.URL.Query().Get("representation"))
+		w.Write([]byte("0123456789"))
+	}))
+	for _, representation := range []string{"passthrough", "decompressed", "decompressed", ""} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?representation="+representation, nil))
+	}
+
+	for representation, expected := range map[string]float64{"passthrough": 10, "decompressed": 20} {
+		if v := metricValue(t, s.metrics.registry, "readium_asset_bytes_total", map[string]string{"representation": representation}); v != expected {
+			t.Errorf("%s: got %v bytes, expected %v", representation, v, expected)
+		}
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	s := NewServer(ServerConfig{}, Remote{})
+	s.lfu.Set("a", cache.EncapsulatePublication(nil, false))
+	s.lfu.Get("a")
+	s.lfu.Get("b")
+	s.iiif.Set("image", &iiifImage{data: []byte("x")})
+
+	tests := []struct {
+		name     string
+		cache    string
+		expected float64
+	}{
+		{"readium_cache_hits_total", "publications", 1},
+		{"readium_cache_misses_total", "publications", 1},
+		{"readium_cache_entries", "publications", 1},
+		{"readium_cache_entries", "iiif", 1},
+		{"readium_cache_entries", "documents", 0},
+	}
+	for _, tt := range tests {
+		if v := metricValue(t, s.metrics.registry, tt.name, map[string]string{"cache": tt.cache}); v != tt.expected {
+			t.Errorf("%s{cache=%q}: got %v, expected %v", tt.name, tt.cache, v, tt.expected)
+		}
+	}
+}
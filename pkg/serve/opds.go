@@ -0,0 +1,440 @@
+package serve
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	nurl "net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/serve/auth"
+	"github.com/readium/cli/pkg/serve/cache"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"google.golang.org/api/iterator"
+)
+
+// OPDSConfig enables an OPDS 2.0 feed of the publications available to the server.
+type OPDSConfig struct {
+	Title        string        // Title of the feed
+	Sources      []string      // S3 and GCS locations (s3://bucket/prefix, gs://bucket/prefix) to list in addition to the local directory
+	ItemsPerPage int           // Number of publications in each page of the feed
+	TokenTTL     time.Duration // Lifetime of the tokens in the links of the feed
+	BearerToken  string        // Required in the Authorization header of requests for the feed, if set
+}
+
+const DefaultOPDSItemsPerPage = 50
+const DefaultOPDSTokenTTL = time.Hour
+
+// How long the list of publications is kept before the sources are listed again
+const opdsListingTTL = time.Minute
+
+// Amount of publication entries (metadata and cover) kept in memory
+const opdsMaxCachedEntries = 1000
+
+const opdsMediaType = "application/opds+json"
+
+// Extensions of the files considered publications when listing sources
+var opdsExtensions = []string{".epub", ".pdf", ".cbz", ".lpf", ".audiobook", ".divina", ".webpub"}
+
+// A publication found in one of the sources of the feed
+type catalogItem struct {
+	Location string // Path of the publication, as accepted by the auth provider
+	ModTime  time.Time
+	Size     int64
+}
+
+// Data of a publication needed for the feed, extracted from its manifest
+type catalogEntry struct {
+	metadata  json.RawMessage
+	mediaType string
+	cover     *opdsLink // Relative to the publication
+}
+
+func (e *catalogEntry) OnEvict() {}
+
+type opdsCatalog struct {
+	mu       sync.Mutex
+	items    []catalogItem
+	listedAt time.Time
+	entries  *cache.TinyLFU
+}
+
+func newOPDSCatalog() *opdsCatalog {
+	return &opdsCatalog{
+		entries: cache.NewTinyLFU(opdsMaxCachedEntries, 24*time.Hour),
+	}
+}
+
+// Drop the current listing, so that the sources are listed again.
+func (c *opdsCatalog) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = nil
+}
+
+type opdsLink struct {
+	Href      string `json:"href"`
+	Type      string `json:"type,omitempty"`
+	Rel       string `json:"rel,omitempty"`
+	Templated bool   `json:"templated,omitempty"`
+}
+
+type opdsPublication struct {
+	Metadata json.RawMessage `json:"metadata"`
+	Links    []opdsLink      `json:"links"`
+	Images   []opdsLink      `json:"images,omitempty"`
+}
+
+type opdsFeedMetadata struct {
+	Title         string `json:"title"`
+	NumberOfItems int    `json:"numberOfItems"`
+	ItemsPerPage  int    `json:"itemsPerPage"`
+	CurrentPage   int    `json:"currentPage"`
+}
+
+type opdsFeed struct {
+	Metadata     opdsFeedMetadata  `json:"metadata"`
+	Links        []opdsLink        `json:"links"`
+	Publications []opdsPublication `json:"publications"`
+}
+
+func isPublicationFile(name string) bool {
+	return slices.Contains(opdsExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// List the publications of all sources, reusing the previous listing if it's recent enough.
+func (s *Server) listCatalog(ctx context.Context) ([]catalogItem, error) {
+	s.opds.mu.Lock()
+	defer s.opds.mu.Unlock()
+
+	if s.opds.items != nil && time.Since(s.opds.listedAt) < opdsListingTTL {
+		return s.opds.items, nil
+	}
+
+	var items []catalogItem
+	if s.remote.LocalDirectory != "" {
+		local, err := s.listLocalDirectory()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed listing local directory")
+		}
+		items = append(items, local...)
+	}
+	for _, source := range s.config.OPDS.Sources {
+		su, err := nurl.Parse(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid OPDS source "+source)
+		}
+		bucket, prefix := su.Host, strings.TrimPrefix(su.Path, "/")
+
+		var remote []catalogItem
+		switch su.Scheme {
+		case "s3":
+			remote, err = s.listS3(ctx, bucket, prefix)
+		case "gs":
+			remote, err = s.listGCS(ctx, bucket, prefix)
+		default:
+			err = errors.New("unsupported scheme " + su.Scheme)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed listing "+source)
+		}
+		items = append(items, remote...)
+	}
+
+	// Stable order for pagination
+	slices.SortFunc(items, func(a, b catalogItem) int {
+		return strings.Compare(a.Location, b.Location)
+	})
+
+	s.opds.items = items
+	s.opds.listedAt = time.Now()
+	return items, nil
+}
+
+func (s *Server) listLocalDirectory() ([]catalogItem, error) {
+	var items []catalogItem
+	err := filepath.WalkDir(s.remote.LocalDirectory, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && fp != s.remote.LocalDirectory {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isPublicationFile(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.remote.LocalDirectory, fp)
+		if err != nil {
+			return err
+		}
+		items = append(items, catalogItem{
+			Location: filepath.ToSlash(rel),
+			ModTime:  fi.ModTime(),
+			Size:     fi.Size(),
+		})
+		return nil
+	})
+	return items, err
+}
+
+func (s *Server) listS3(ctx context.Context, bucket, prefix string) ([]catalogItem, error) {
+	if s.remote.S3 == nil {
+		return nil, errors.New("S3 client not configured")
+	}
+
+	var items []catalogItem
+	paginator := s3.NewListObjectsV2Paginator(s.remote.S3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if !isPublicationFile(key) {
+				continue
+			}
+			item := catalogItem{
+				Location: "s3://" + bucket + "/" + key,
+				Size:     aws.ToInt64(obj.Size),
+			}
+			if obj.LastModified != nil {
+				item.ModTime = *obj.LastModified
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (s *Server) listGCS(ctx context.Context, bucket, prefix string) ([]catalogItem, error) {
+	if s.remote.GCS == nil {
+		return nil, errors.New("GCS client not configured")
+	}
+
+	var items []catalogItem
+	it := s.remote.GCS.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !isPublicationFile(attrs.Name) {
+			continue
+		}
+		items = append(items, catalogItem{
+			Location: "gs://" + bucket + "/" + attrs.Name,
+			ModTime:  attrs.Updated,
+			Size:     attrs.Size,
+		})
+	}
+	return items, nil
+}
+
+// Get the data of a publication needed for the feed. Publications that aren't
+// already cached by the server are opened and closed right away, to avoid
+// evicting publications being read.
+func (s *Server) catalogEntry(ctx context.Context, item catalogItem) (*catalogEntry, error) {
+	key := item.Location + "\x00" + strconv.FormatInt(item.ModTime.UnixNano(), 36) + "\x00" + strconv.FormatInt(item.Size, 36)
+	if e, ok := s.opds.entries.Get(key); ok {
+		return e.(*catalogEntry), nil
+	}
+
+	u, err := publicationURL(item.Location)
+	if err != nil {
+		return nil, err
+	}
+	// Like in getPublication, the cached publication may have been closed
+	// after being evicted since
+	var cp *cache.CachedPublication
+	if dat, ok := s.lfu.Get(u.String()); ok && dat.(*cache.CachedPublication).Acquire() {
+		cp = dat.(*cache.CachedPublication)
+	} else {
+		// The only reference of a publication that isn't cached, released
+		// to close it
+		cp, err = s.openPublication(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer cp.Release()
+
+	metadata, err := json.Marshal(&cp.Manifest.Metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed marshalling metadata")
+	}
+	entry := &catalogEntry{
+		metadata:  metadata,
+		mediaType: conformsToAsMimetype(cp.Manifest.Metadata.ConformsTo).String(),
+	}
+
+	// Find the cover of the publication
+	for _, links := range []manifest.LinkList{cp.Manifest.Links, cp.Manifest.ReadingOrder, cp.Manifest.Resources} {
+		for _, link := range links {
+			if !slices.Contains(link.Rels, "cover") {
+				continue
+			}
+			entry.cover = &opdsLink{Href: link.Href.String()}
+			if link.MediaType != nil {
+				entry.cover.Type = link.MediaType.String()
+			}
+			break
+		}
+		if entry.cover != nil {
+			break
+		}
+	}
+
+	s.opds.entries.Set(key, entry)
+	return entry, nil
+}
+
+// Middleware restricting the feed to the clients holding its bearer token,
+// since the feed contains tokens granting access to every publication.
+func (s *Server) opdsAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := s.config.OPDS.BearerToken
+		if expected != "" {
+			scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				w.Header().Set("www-authenticate", `Bearer realm="opds"`)
+				s.writeProblem(w, http.StatusUnauthorized, ErrCodeInvalidToken, errors.New("missing or invalid bearer token for the OPDS feed"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) getOPDSFeed(w http.ResponseWriter, req *http.Request) {
+	issuer, ok := s.config.Auth.(auth.TokenIssuer)
+	if !ok {
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.New("the access mode can't issue tokens for the OPDS feed"))
+		return
+	}
+
+	page := 1
+	if p := req.URL.Query().Get("page"); p != "" {
+		var err error
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 {
+			s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidPath, errors.New("invalid page "+p))
+			return
+		}
+	}
+
+	items, err := s.listCatalog(req.Context())
+	if err != nil {
+		s.writeProblem(w, http.StatusBadGateway, ErrCodeUpstreamError, err)
+		return
+	}
+
+	perPage := s.config.OPDS.ItemsPerPage
+	lastPage := max(1, (len(items)+perPage-1)/perPage)
+	if page > lastPage {
+		s.writeProblem(w, http.StatusNotFound, ErrCodeResourceNotFound, errors.New("no page "+strconv.Itoa(page)+" in the feed"))
+		return
+	}
+
+	base := s.baseURL(req)
+	feedPath, _ := s.router.Get("opds").URLPath()
+	pageURL := func(n int) string {
+		return base + feedPath.String() + "?page=" + strconv.Itoa(n)
+	}
+
+	feed := opdsFeed{
+		Metadata: opdsFeedMetadata{
+			Title:         s.config.OPDS.Title,
+			NumberOfItems: len(items),
+			ItemsPerPage:  perPage,
+			CurrentPage:   page,
+		},
+		Links: []opdsLink{
+			{Rel: "self", Href: pageURL(page), Type: opdsMediaType},
+			{Rel: "first", Href: pageURL(1), Type: opdsMediaType},
+			{Rel: "last", Href: pageURL(lastPage), Type: opdsMediaType},
+		},
+		Publications: []opdsPublication{},
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, opdsLink{Rel: "previous", Href: pageURL(page - 1), Type: opdsMediaType})
+	}
+	if page < lastPage {
+		feed.Links = append(feed.Links, opdsLink{Rel: "next", Href: pageURL(page + 1), Type: opdsMediaType})
+	}
+
+	expiresAt := time.Now().Add(s.config.OPDS.TokenTTL)
+	for _, item := range items[(page-1)*perPage : min(page*perPage, len(items))] {
+		entry, err := s.catalogEntry(req.Context(), item)
+		if err != nil {
+			slog.Warn("failed adding publication to OPDS feed", "error", err)
+			continue
+		}
+		token, err := issuer.Issue(item.Location, expiresAt)
+		if err != nil {
+			s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed issuing token"))
+			return
+		}
+
+		manifestPath, err := s.router.Get("manifest").URLPath("path", token)
+		if err != nil {
+			s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed creating manifest URL"))
+			return
+		}
+		manifestURL := base + manifestPath.String()
+		publication := opdsPublication{
+			Metadata: entry.metadata,
+			Links: []opdsLink{
+				{Rel: "http://opds-spec.org/acquisition", Href: manifestURL, Type: entry.mediaType},
+			},
+		}
+		if entry.cover != nil {
+			cover := *entry.cover
+			cover.Href = strings.TrimSuffix(manifestURL, "manifest.json") + cover.Href
+			publication.Images = []opdsLink{cover}
+		}
+		feed.Publications = append(feed.Publications, publication)
+	}
+
+	var j []byte
+	if s.config.JSONIndent == "" {
+		j, err = json.Marshal(feed)
+	} else {
+		j, err = json.MarshalIndent(feed, "", s.config.JSONIndent)
+	}
+	if err != nil {
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed marshalling OPDS feed"))
+		return
+	}
+
+	w.Header().Set("content-type", opdsMediaType+"; charset=utf-8")
+	w.Header().Set("cache-control", "private, no-cache") // Links contain tokens that expire
+	w.Header().Set("content-length", strconv.Itoa(len(j)))
+	w.Write(j)
+}
@@ -0,0 +1,56 @@
+package serve
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Problem details for HTTP APIs (RFC 9457)
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"` // Stable error code, one of the ErrCode* constants
+}
+
+// Respond with an application/problem+json error.
+// The details of the error are only included in debug mode, since they can
+// contain internal information such as storage locations.
+func (s *Server) writeProblem(w http.ResponseWriter, status int, code string, err error) {
+	if status >= 500 {
+		slog.Error("request failed", "status", status, "code", code, "error", err)
+	} else {
+		slog.Debug("request failed", "status", status, "code", code, "error", err)
+	}
+
+	problem := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+	}
+	if s.config.Debug && err != nil {
+		problem.Detail = err.Error()
+	}
+	j, _ := json.Marshal(problem)
+
+	// Headers describing the resource that would have been served don't apply
+	h := w.Header()
+	for _, k := range []string{"content-encoding", "accept-ranges", "etag", "last-modified", "repr-digest"} {
+		h.Del(k)
+	}
+	h.Set("content-type", "application/problem+json")
+	h.Set("content-length", strconv.Itoa(len(j)))
+	h.Set("cache-control", "no-store")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// Respond with the problem matching an error returned by getPublication.
+func (s *Server) writePublicationProblem(w http.ResponseWriter, err error) {
+	perr := classifyOpenError(err, false)
+	s.writeProblem(w, perr.Status, perr.Code, perr.Err)
+}
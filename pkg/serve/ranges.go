@@ -0,0 +1,108 @@
+package serve
+
+import (
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+
+	httprange "github.com/gotd/contrib/http_range"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+)
+
+// Default maximum amount of ranges that can be requested at once, after coalescing.
+// Requests for more ranges than this are answered with the full resource.
+const DefaultMaxRanges = 16
+
+// Coalesce overlapping and adjacent ranges, sorted by their start offset.
+// Serving overlapping ranges separately would let a client request the same
+// bytes over and over in a single request.
+func coalesceRanges(ranges []httprange.Range) []httprange.Range {
+	if len(ranges) < 2 {
+		return ranges
+	}
+
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b httprange.Range) int {
+		switch {
+		case a.Start < b.Start:
+			return -1
+		case a.Start > b.Start:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	coalesced := make([]httprange.Range, 0, len(sorted))
+	current := sorted[0]
+	for _, next := range sorted[1:] {
+		currentEnd := current.Start + current.Length
+		if next.Start <= currentEnd {
+			// Overlapping or adjacent, extend the current range
+			if nextEnd := next.Start + next.Length; nextEnd > currentEnd {
+				current.Length = nextEnd - current.Start
+			}
+			continue
+		}
+		coalesced = append(coalesced, current)
+		current = next
+	}
+	return append(coalesced, current)
+}
+
+func rangeMIMEHeader(rng httprange.Range, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {rng.ContentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// Compute the length of a multipart/byteranges body, without reading the resource.
+func multipartRangesLength(ranges []httprange.Range, boundary, contentType string, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+
+	var encSize int64
+	for _, rng := range ranges {
+		mw.CreatePart(rangeMIMEHeader(rng, contentType, size))
+		encSize += rng.Length
+	}
+	mw.Close()
+	return encSize + int64(w)
+}
+
+// Respond to a request for multiple ranges of a resource with a multipart/byteranges body.
+func serveMultipartRanges(w http.ResponseWriter, r *http.Request, res fetcher.Resource, remote bool, ranges []httprange.Range, contentType string, size int64) *fetcher.ResourceError {
+	mw := multipart.NewWriter(w)
+
+	w.Header().Set("content-type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("content-length", strconv.FormatInt(multipartRangesLength(ranges, mw.Boundary(), contentType, size), 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	for _, rng := range ranges {
+		part, err := mw.CreatePart(rangeMIMEHeader(rng, contentType, size))
+		if err != nil {
+			return fetcher.Other(err)
+		}
+		if rerr := writeResourceRange(r.Context(), part, res, remote, &rng); rerr != nil {
+			return rerr
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return fetcher.Other(err)
+	}
+	return nil
+}
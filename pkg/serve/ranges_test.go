@@ -0,0 +1,248 @@
+package serve
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	httprange "github.com/gotd/contrib/http_range"
+	"github.com/readium/go-toolkit/pkg/archive"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// In-memory resource, read whole when start and end are 0 like the resources
+// of go-toolkit.
+type bytesResource struct {
+	data []byte
+}
+
+func (r *bytesResource) File() string                    { return "" }
+func (r *bytesResource) Close()                          {}
+func (r *bytesResource) Link() manifest.Link             { return manifest.Link{} }
+func (r *bytesResource) Properties() manifest.Properties { return manifest.Properties{} }
+
+func (r *bytesResource) Length(ctx context.Context) (int64, *fetcher.ResourceError) {
+	return int64(len(r.data)), nil
+}
+
+func (r *bytesResource) Read(ctx context.Context, start, end int64) ([]byte, *fetcher.ResourceError) {
+	if start == 0 && end == 0 {
+		return r.data, nil
+	}
+	end = min(end, int64(len(r.data))-1)
+	return r.data[start : end+1], nil
+}
+
+func (r *bytesResource) Stream(ctx context.Context, w io.Writer, start, end int64) (int64, *fetcher.ResourceError) {
+	data, rerr := r.Read(ctx, start, end)
+	if rerr != nil {
+		return -1, rerr
+	}
+	n, err := w.Write(data)
+	if err != nil {
+		return int64(n), fetcher.Other(err)
+	}
+	return int64(n), nil
+}
+
+// Resource stored deflated in a remote archive, which mustn't be streamed
+// with Stream since it reads the whole compressed resource in memory.
+type deflatedResource struct {
+	bytesResource
+	compressed []byte
+}
+
+func newDeflatedResource(t *testing.T, data []byte) *deflatedResource {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	fw.Close()
+	return &deflatedResource{bytesResource{data}, buf.Bytes()}
+}
+
+func (r *deflatedResource) Stream(ctx context.Context, w io.Writer, start, end int64) (int64, *fetcher.ResourceError) {
+	return -1, fetcher.Other(errors.New("streamed from memory"))
+}
+
+func (r *deflatedResource) CompressedAs(method archive.CompressionMethod) bool {
+	return method == archive.CompressionMethodDeflate
+}
+
+func (r *deflatedResource) CompressedLength(ctx context.Context) int64 {
+	return int64(len(r.compressed))
+}
+
+func (r *deflatedResource) StreamCompressed(ctx context.Context, w io.Writer) (int64, *fetcher.ResourceError) {
+	n, err := w.Write(r.compressed)
+	if err != nil {
+		return int64(n), fetcher.Other(err)
+	}
+	return int64(n), nil
+}
+
+func (r *deflatedResource) StreamCompressedGzip(ctx context.Context, w io.Writer) (int64, *fetcher.ResourceError) {
+	return -1, fetcher.Other(errors.New("not implemented"))
+}
+
+func (r *deflatedResource) ReadCompressed(ctx context.Context) ([]byte, *fetcher.ResourceError) {
+	return r.compressed, nil
+}
+
+func (r *deflatedResource) ReadCompressedGzip(ctx context.Context) ([]byte, *fetcher.ResourceError) {
+	return nil, fetcher.Other(errors.New("not implemented"))
+}
+
+func (r *deflatedResource) CRC32Checksum(ctx context.Context) *uint32 {
+	return nil
+}
+
+const rangesContent = "0123456789abcdef"
+
+func parseTestRange(t *testing.T, header string) []httprange.Range {
+	t.Helper()
+	ranges, err := httprange.ParseRange(header, int64(len(rangesContent)))
+	if err != nil {
+		t.Fatalf("failed parsing %q: %v", header, err)
+	}
+	return coalesceRanges(ranges)
+}
+
+func TestWriteResourceRange(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", rangesContent},
+		{"bytes=0-0", "0"},
+		{"bytes=0-1", "01"},
+		{"bytes=1-1", "1"},
+		{"bytes=5-9", "56789"},
+		{"bytes=-3", "def"},
+		{"bytes=10-", "abcdef"},
+	}
+	resources := []struct {
+		name   string
+		res    fetcher.Resource
+		remote bool
+	}{
+		{"local", &bytesResource{[]byte(rangesContent)}, false},
+		{"remote", &bytesResource{[]byte(rangesContent)}, true},
+		{"remote deflated", newDeflatedResource(t, []byte(rangesContent)), true},
+	}
+	for _, r := range resources {
+		for _, tt := range tests {
+			var rng *httprange.Range
+			if tt.header != "" {
+				rng = &parseTestRange(t, tt.header)[0]
+			}
+			var buf bytes.Buffer
+			if rerr := writeResourceRange(context.Background(), &buf, r.res, r.remote, rng); rerr != nil {
+				t.Fatalf("%q (%s): %v", tt.header, r.name, rerr)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("%q (%s): got %q, expected %q", tt.header, r.name, buf.String(), tt.expected)
+			}
+		}
+	}
+}
+
+func TestWriteResourceFirstByteOfOneByteResource(t *testing.T) {
+	var buf bytes.Buffer
+	rng := &httprange.Range{Start: 0, Length: 1}
+	if rerr := writeResourceRange(context.Background(), &buf, &bytesResource{[]byte("x")}, false, rng); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if buf.String() != "x" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestWriteInflatedRangeStopsEarly(t *testing.T) {
+	// A large resource, of which only the beginning is inflated
+	data := bytes.Repeat([]byte(rangesContent), 1<<16)
+	res := newDeflatedResource(t, data)
+	var buf bytes.Buffer
+	rng := &httprange.Range{Start: 10, Length: 20}
+	if rerr := writeResourceRange(context.Background(), &buf, res, true, rng); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if !bytes.Equal(buf.Bytes(), data[10:30]) {
+		t.Errorf("got %q", buf.Bytes())
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	tests := map[string][]httprange.Range{
+		"bytes=0-0,5-9":     {{Start: 0, Length: 1}, {Start: 5, Length: 5}},
+		"bytes=5-9,0-0":     {{Start: 0, Length: 1}, {Start: 5, Length: 5}},
+		"bytes=0-4,5-9":     {{Start: 0, Length: 10}},
+		"bytes=0-6,3-9":     {{Start: 0, Length: 10}},
+		"bytes=0-9,2-3,0-0": {{Start: 0, Length: 10}},
+	}
+	for header, expected := range tests {
+		ranges := parseTestRange(t, header)
+		if len(ranges) != len(expected) {
+			t.Errorf("%q: got %v, expected %v", header, ranges, expected)
+			continue
+		}
+		for i := range ranges {
+			if ranges[i] != expected[i] {
+				t.Errorf("%q: got %v, expected %v", header, ranges, expected)
+			}
+		}
+	}
+}
+
+func TestServeMultipartRanges(t *testing.T) {
+	ranges := parseTestRange(t, "bytes=0-0,5-9")
+	size := int64(len(rangesContent))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	if rerr := serveMultipartRanges(w, r, &bytesResource{[]byte(rangesContent)}, false, ranges, "text/plain", size); rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("got status %d", w.Code)
+	}
+	if length := w.Header().Get("content-length"); length != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length is %s, body is %d bytes", length, w.Body.Len())
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("content-type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("got Content-Type %q", w.Header().Get("content-type"))
+	}
+
+	expected := []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 0-0/16", "0"},
+		{"bytes 5-9/16", "56789"},
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for i, e := range expected {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(part)
+		if cr := part.Header.Get("Content-Range"); cr != e.contentRange || string(body) != e.body {
+			t.Errorf("part %d: got %q %q, expected %q %q", i, cr, body, e.contentRange, e.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected the end of the body, got %v", err)
+	}
+}
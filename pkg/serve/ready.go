@@ -0,0 +1,255 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	nurl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"github.com/readium/cli/internal/version"
+	"github.com/readium/cli/pkg/serve/auth"
+	"github.com/readium/go-toolkit/pkg/util/url"
+	gv "github.com/readium/go-toolkit/pkg/util/version"
+	"google.golang.org/api/iterator"
+)
+
+// How long the results of the readiness checks are reused
+const readinessCacheTTL = 10 * time.Second
+
+// How long each readiness check can take
+const readinessCheckTimeout = 5 * time.Second
+
+// Status of a readiness check
+const (
+	checkStatusOK      = "ok"
+	checkStatusFailed  = "failed"
+	checkStatusSkipped = "skipped" // Nothing could be checked, such as without a bucket to list
+)
+
+type readinessCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"` // Only in debug mode
+}
+
+type readiness struct {
+	Ready     bool                      `json:"ready"`
+	CheckedAt time.Time                 `json:"checkedAt"`
+	Checks    map[string]readinessCheck `json:"checks"`
+}
+
+type readinessCache struct {
+	mu     sync.Mutex
+	result *readiness
+}
+
+type versionInfo struct {
+	Version string   `json:"version"`
+	Toolkit string   `json:"toolkit"`
+	Schemes []string `json:"schemes"`
+	Auth    string   `json:"auth,omitempty"`
+}
+
+// Check that the local directory can be read.
+func (s *Server) checkLocalDirectory(context.Context) error {
+	dir, err := os.Open(s.remote.LocalDirectory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Check that S3 can be accessed, by listing at most one object of each
+// location, or by retrieving credentials when there's no location to list.
+func (s *Server) checkS3(ctx context.Context, locations []*nurl.URL) error {
+	if len(locations) == 0 {
+		if creds := s.remote.S3.Options().Credentials; creds != nil {
+			if _, err := creds.Retrieve(ctx); err != nil {
+				return errors.Wrap(err, "failed retrieving credentials")
+			}
+		}
+		return nil
+	}
+	for _, loc := range locations {
+		_, err := s.remote.S3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(loc.Host),
+			Prefix:  aws.String(strings.TrimPrefix(loc.Path, "/")),
+			MaxKeys: aws.Int32(1),
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed listing "+loc.String())
+		}
+	}
+	return nil
+}
+
+// Check that GCS can be accessed, by listing at most one object of each
+// location.
+func (s *Server) checkGCS(ctx context.Context, locations []*nurl.URL) error {
+	for _, loc := range locations {
+		it := s.remote.GCS.Bucket(loc.Host).Objects(ctx, &storage.Query{Prefix: strings.TrimPrefix(loc.Path, "/")})
+		if _, err := it.Next(); err != nil && err != iterator.Done {
+			return errors.Wrap(err, "failed listing "+loc.String())
+		}
+	}
+	return nil
+}
+
+// Locations checked for readiness, by scheme.
+func (s *Server) readinessLocations() map[string][]*nurl.URL {
+	locations := s.config.ReadinessLocations
+	if locations == nil && s.config.OPDS != nil {
+		locations = s.config.OPDS.Sources
+	}
+	byScheme := make(map[string][]*nurl.URL)
+	for _, l := range locations {
+		if u, err := nurl.Parse(l); err == nil {
+			byScheme[u.Scheme] = append(byScheme[u.Scheme], u)
+		}
+	}
+	return byScheme
+}
+
+// Run the readiness checks of the configured backends concurrently.
+func (s *Server) checkReadiness(ctx context.Context) *readiness {
+	type check struct {
+		name string
+		run  func(context.Context) error
+	}
+	var checks []check
+	locations := s.readinessLocations()
+	if s.remote.LocalDirectory != "" {
+		checks = append(checks, check{"file", s.checkLocalDirectory})
+	}
+	if s.remote.S3 != nil {
+		checks = append(checks, check{"s3", func(ctx context.Context) error {
+			return s.checkS3(ctx, locations["s3"])
+		}})
+	}
+	if s.remote.GCS != nil {
+		if len(locations["gs"]) > 0 {
+			checks = append(checks, check{"gs", func(ctx context.Context) error {
+				return s.checkGCS(ctx, locations["gs"])
+			}})
+		} else {
+			checks = append(checks, check{"gs", nil})
+		}
+	}
+	if rc, ok := s.config.Auth.(auth.ReadinessChecker); ok {
+		checks = append(checks, check{"auth", rc.Ready})
+	}
+
+	result := &readiness{
+		Ready:     true,
+		CheckedAt: time.Now(),
+		Checks:    make(map[string]readinessCheck, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		if c.run == nil {
+			result.Checks[c.name] = readinessCheck{Status: checkStatusSkipped}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+			defer cancel()
+			err := c.run(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				result.Checks[c.name] = readinessCheck{Status: checkStatusOK}
+				return
+			}
+			slog.Warn("readiness check failed", "check", c.name, "error", err)
+			result.Ready = false
+			rc := readinessCheck{Status: checkStatusFailed}
+			if s.config.Debug {
+				rc.Error = err.Error()
+			}
+			result.Checks[c.name] = rc
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+// Report whether the server can serve publications, with the results of the
+// checks of its backends. Results are cached for a few seconds, so that
+// frequent probes don't hit the backends.
+func (s *Server) getReady(w http.ResponseWriter, req *http.Request) {
+	s.ready.mu.Lock()
+	result := s.ready.result
+	if result == nil || time.Since(result.CheckedAt) >= readinessCacheTTL {
+		// Not canceled along with the request, since the result is shared
+		result = s.checkReadiness(context.WithoutCancel(req.Context()))
+		s.ready.result = result
+	}
+	s.ready.mu.Unlock()
+
+	status := http.StatusOK
+	if !result.Ready || s.draining.Load() {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeJSON(w, status, result)
+}
+
+// Report the version of the server and its configuration.
+func (s *Server) getVersion(w http.ResponseWriter, req *http.Request) {
+	info := versionInfo{
+		Version: version.Version,
+		Toolkit: gv.Version,
+		Schemes: []string{},
+		Auth:    s.config.AuthMode,
+	}
+	for _, scheme := range []url.Scheme{url.SchemeFile, url.SchemeHTTP, url.SchemeHTTPS, url.SchemeS3, url.SchemeGS} {
+		if s.remote.AcceptsScheme(scheme) {
+			info.Schemes = append(info.Schemes, scheme.String())
+		}
+	}
+	s.writeJSON(w, http.StatusOK, info)
+}
+
+// Whether a route is used by health checks and probes, which are excluded
+// from traces and the access log.
+func isProbeRoute(name string) bool {
+	return name == "health" || name == "ready"
+}
+
+// Respond with a JSON document that must not be cached, such as a status.
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	var j []byte
+	var err error
+	if s.config.JSONIndent == "" {
+		j, err = json.Marshal(v)
+	} else {
+		j, err = json.MarshalIndent(v, "", s.config.JSONIndent)
+	}
+	if err != nil {
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed marshalling JSON"))
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.Header().Set("content-length", strconv.Itoa(len(j)))
+	w.WriteHeader(status)
+	w.Write(j)
+}
@@ -0,0 +1,209 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/readium/cli/internal/version"
+	"github.com/readium/cli/pkg/serve/auth"
+)
+
+// Auth provider reporting a readiness error, counting its checks.
+type readinessAuth struct {
+	auth.AuthProvider
+	err    error
+	checks atomic.Int32
+}
+
+func (a *readinessAuth) Ready(context.Context) error {
+	a.checks.Add(1)
+	return a.err
+}
+
+func getTestReady(t *testing.T, s *Server) (int, readiness) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.getReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("got Cache-Control %q", cc)
+	}
+	var result readiness
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, result
+}
+
+func TestReadiness(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name   string
+		config ServerConfig
+		remote Remote
+		status int
+		checks map[string]readinessCheck
+	}{
+		{"no backends", ServerConfig{}, Remote{}, http.StatusOK, map[string]readinessCheck{}},
+		{
+			"local directory",
+			ServerConfig{}, Remote{LocalDirectory: dir},
+			http.StatusOK, map[string]readinessCheck{"file": {Status: checkStatusOK}},
+		},
+		{
+			"missing local directory",
+			ServerConfig{}, Remote{LocalDirectory: missing},
+			http.StatusServiceUnavailable, map[string]readinessCheck{"file": {Status: checkStatusFailed}},
+		},
+		{
+			"auth",
+			ServerConfig{Auth: &readinessAuth{}}, Remote{LocalDirectory: dir},
+			http.StatusOK, map[string]readinessCheck{"file": {Status: checkStatusOK}, "auth": {Status: checkStatusOK}},
+		},
+		{
+			"failed auth",
+			ServerConfig{Auth: &readinessAuth{err: errors.New("no keys")}}, Remote{LocalDirectory: dir},
+			http.StatusServiceUnavailable, map[string]readinessCheck{"file": {Status: checkStatusOK}, "auth": {Status: checkStatusFailed}},
+		},
+		{
+			"errors in debug mode",
+			ServerConfig{Debug: true, Auth: &readinessAuth{err: errors.New("no keys")}}, Remote{},
+			http.StatusServiceUnavailable, map[string]readinessCheck{"auth": {Status: checkStatusFailed, Error: "no keys"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, result := getTestReady(t, NewServer(tt.config, tt.remote))
+			if status != tt.status {
+				t.Errorf("got status %d, expected %d", status, tt.status)
+			}
+			if result.Ready != (tt.status == http.StatusOK) {
+				t.Errorf("got ready %v", result.Ready)
+			}
+			if !reflect.DeepEqual(result.Checks, tt.checks) {
+				t.Errorf("got checks %v, expected %v", result.Checks, tt.checks)
+			}
+		})
+	}
+}
+
+func TestReadinessCache(t *testing.T) {
+	a := &readinessAuth{}
+	s := NewServer(ServerConfig{Auth: a}, Remote{})
+	for range 3 {
+		getTestReady(t, s)
+	}
+	if n := a.checks.Load(); n != 1 {
+		t.Errorf("got %d checks, expected 1", n)
+	}
+
+	s.ready.result.CheckedAt = s.ready.result.CheckedAt.Add(-readinessCacheTTL)
+	getTestReady(t, s)
+	if n := a.checks.Load(); n != 2 {
+		t.Errorf("got %d checks once expired, expected 2", n)
+	}
+}
+
+func TestReadinessDraining(t *testing.T) {
+	s := NewServer(ServerConfig{}, Remote{})
+	s.Drain()
+	status, result := getTestReady(t, s)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while draining", status)
+	}
+	// The backends are still ready
+	if !result.Ready {
+		t.Error("got ready false while draining")
+	}
+}
+
+func TestReadinessLocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ServerConfig
+		expected map[string][]string
+	}{
+		{"none", ServerConfig{}, map[string][]string{}},
+		{
+			"configured",
+			ServerConfig{ReadinessLocations: []string{"s3://a/books", "gs://b", "s3://c"}},
+			map[string][]string{"s3": {"s3://a/books", "s3://c"}, "gs": {"gs://b"}},
+		},
+		{
+			"OPDS sources",
+			ServerConfig{OPDS: &OPDSConfig{Sources: []string{"s3://a/books"}}},
+			map[string][]string{"s3": {"s3://a/books"}},
+		},
+		{
+			"configured over OPDS sources",
+			ServerConfig{ReadinessLocations: []string{}, OPDS: &OPDSConfig{Sources: []string{"s3://a/books"}}},
+			map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string][]string{}
+			for scheme, locations := range NewServer(tt.config, Remote{}).readinessLocations() {
+				for _, l := range locations {
+					got[scheme] = append(got[scheme], l.String())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ServerConfig
+		remote  Remote
+		schemes []string
+		auth    string
+	}{
+		{"no schemes", ServerConfig{}, Remote{}, []string{}, ""},
+		{"local directory", ServerConfig{AuthMode: "jwt"}, Remote{LocalDirectory: "."}, []string{"file"}, "jwt"},
+		{
+			"HTTP",
+			ServerConfig{}, Remote{HTTP: http.DefaultClient, HTTPSEnabled: true},
+			[]string{"https"}, "",
+		},
+		{
+			"HTTP without a client",
+			ServerConfig{}, Remote{HTTPEnabled: true, HTTPSEnabled: true},
+			[]string{}, "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			NewServer(tt.config, tt.remote).getVersion(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d", rec.Code)
+			}
+			var info versionInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+				t.Fatal(err)
+			}
+			if info.Version != version.Version || info.Toolkit == "" {
+				t.Errorf("got version %q and toolkit %q", info.Version, info.Toolkit)
+			}
+			if !reflect.DeepEqual(info.Schemes, tt.schemes) {
+				t.Errorf("got schemes %v, expected %v", info.Schemes, tt.schemes)
+			}
+			if info.Auth != tt.auth {
+				t.Errorf("got auth %q, expected %q", info.Auth, tt.auth)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"slices"
+
+	httprange "github.com/gotd/contrib/http_range"
+	"github.com/readium/cli/pkg/serve/cache"
+	"github.com/readium/go-toolkit/pkg/archive"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+)
+
+// Pick the content encoding a resource can be served with without decompressing it.
+// An empty string means the resource is served as-is.
+func negotiateEncoding(r *http.Request, res fetcher.Resource, length int64) string {
+	if !negotiatesEncoding(res) {
+		return ""
+	}
+	if supportsEncoding(r, "deflate") {
+		return "deflate"
+	}
+	if supportsEncoding(r, "gzip") && length <= archive.GzipMaxLength {
+		return "gzip"
+	}
+	return ""
+}
+
+// Whether the representation of the resource depends on the Accept-Encoding
+// header of the request, because it's stored compressed with deflate.
+func negotiatesEncoding(res fetcher.Resource) bool {
+	cres, ok := res.(fetcher.CompressedResource)
+	return ok && cres.CompressedAs(archive.CompressionMethodDeflate)
+}
+
+// Length of the resource in the given content encoding.
+func encodedLength(ctx context.Context, res fetcher.Resource, encoding string) int64 {
+	cres := res.(fetcher.CompressedResource)
+	switch encoding {
+	case "deflate":
+		return cres.CompressedLength(ctx)
+	case "gzip":
+		return cres.CompressedLength(ctx) + archive.GzipWrapperLength
+	}
+	return 0
+}
+
+// Write the resource to w in the given content encoding, streaming it.
+// The range to write, if any, only applies to unencoded resources.
+func writeRepresentation(ctx context.Context, w io.Writer, res fetcher.Resource, remote bool, encoding string, rng *httprange.Range) *fetcher.ResourceError {
+	cres, ok := res.(fetcher.CompressedResource)
+	if !ok || encoding == "" {
+		return writeResourceRange(ctx, w, res, remote, rng)
+	}
+
+	w = &contextWriter{ctx: ctx, w: w}
+	var rerr *fetcher.ResourceError
+	if encoding == "gzip" {
+		_, rerr = cres.StreamCompressedGzip(ctx, w)
+	} else {
+		_, rerr = cres.StreamCompressed(ctx, w)
+	}
+	return rerr
+}
+
+// Whether the compression middleware could re-encode an unencoded response,
+// in which case a digest of the representation would not match what's sent.
+func mayBeCompressed(r *http.Request, mimeType string, encoding string) bool {
+	return encoding == "" && r.Header.Get("accept-encoding") != "" && slices.Contains(compressableMimes, mimeType)
+}
+
+// Compute the base64-encoded SHA-256 digest of a representation of a resource,
+// to be used in a Repr-Digest header. Digests are kept for as long as the
+// publication is cached, keyed by the resource's entity tag.
+func reprDigest(ctx context.Context, cp *cache.CachedPublication, res fetcher.Resource, remote bool, etag, encoding string) (string, *fetcher.ResourceError) {
+	key := "repr-digest:" + etag
+	if digest, ok := cp.Derived(key); ok {
+		return digest.(string), nil
+	}
+
+	h := sha256.New()
+	if rerr := writeRepresentation(ctx, h, res, remote, encoding, nil); rerr != nil {
+		return "", rerr
+	}
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	cp.SetDerived(key, digest)
+	return digest, nil
+}
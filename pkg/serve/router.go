@@ -2,64 +2,119 @@ package serve
 
 import (
 	"context"
+	"maps"
 	"net/http"
-	"net/http/pprof"
+	"path"
+	"strings"
 
 	"github.com/CAFxX/httpcompression"
 	"github.com/gorilla/mux"
+	"github.com/readium/go-toolkit/pkg/util/url"
 )
 
 type ContextKey string
 
+// Wraps a handler outside of the routes with the instrumentation middlewares.
+func (s *Server) instrument(h http.Handler) http.Handler {
+	return s.metricsMiddleware(s.tracingMiddleware(s.accessLogMiddleware(h)))
+}
+
 const ContextPathKey ContextKey = "path"
 
 func (s *Server) Routes() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(s.metricsMiddleware)
+	r.Use(s.tracingMiddleware)
+	r.Use(s.accessLogMiddleware)
+	// The middlewares of the router only run for matched routes
+	r.NotFoundHandler = s.instrument(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = s.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
 
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Draining"))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
-	})
+	}).Name("health")
+	r.HandleFunc("/ready", s.getReady).Name("ready")
+	r.HandleFunc("/version", s.getVersion).Name("version")
 
-	if s.config.Debug {
-		r.HandleFunc("/debug/pprof/", pprof.Index)
-		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
-
-		r.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
-		r.Handle("/debug/pprof/block", pprof.Handler("block"))
-		r.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-		r.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-		r.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
-		r.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	if s.config.OPDS != nil {
+		opds := r.PathPrefix("/opds").Subrouter()
+		opds.Use(compressionMiddleware)
+		opds.Use(s.corsMiddleware)
+		opds.Use(s.opdsAuthMiddleware)
+		opds.HandleFunc("/publications.json", s.getOPDSFeed).Name("opds")
 	}
 
 	pub := r.PathPrefix("/webpub/{path}").Subrouter()
-	pub.Use(func(next http.Handler) http.Handler {
-		adapter, _ := httpcompression.DefaultAdapter(httpcompression.ContentTypes(compressableMimes, false))
-		return adapter(next)
-	})
+	pub.Use(compressionMiddleware)
+	pub.Use(s.corsMiddleware)
 	pub.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			vars := mux.Vars(r)
 			token := vars["path"]
+			_, span := tracer.Start(r.Context(), "Auth.Validate")
 			newPath, status, err := s.config.Auth.Validate(token)
+			endSpan(span, err)
 			if err != nil {
-				http.Error(w, err.Error(), status)
+				s.writeProblem(w, status, codeForAuthStatus(status), err)
 				return
 			}
+			setLoggedPublication(r.Context(), newPath)
 			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ContextPathKey, newPath)))
 		})
 	})
 	pub.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
 		ru, _ := r.Get("manifest").URLPath("path", mux.Vars(req)["path"])
-		http.Redirect(w, req, ru.String(), http.StatusFound)
+		http.Redirect(w, req, s.baseURL(req)+ru.String(), http.StatusFound)
 	})
 	pub.HandleFunc("/manifest.json", s.getManifest).Name("manifest")
+	pub.HandleFunc("/search", s.unlessResource(s.getSearch)).Name("search")
+	pub.HandleFunc("/guided-navigation", s.unlessResource(s.getGuidedNavigation)).Name("guided-navigation")
+	pub.HandleFunc("/iiif/{asset:.+}/info.json", s.unlessResource(s.getIIIFInfo)).Name("iiif-info")
+	pub.HandleFunc("/iiif/{asset:.+}/{region}/{size}/{rotation}/{quality:[a-z]+}.{format:[a-z]+}", s.unlessResource(s.getIIIFImage)).Name("iiif-image")
+	pub.HandleFunc("/iiif/{asset:.+}", s.unlessResource(s.getIIIFRedirect)).Name("iiif")
 	pub.HandleFunc("/{asset:.*}", s.getAsset).Name("asset")
 
 	s.router = r
 	return r
 }
+
+// Wrap the handler of a service, whose path is relative to the manifest like
+// the resources of the publication. If the publication has a resource with
+// the same href, such as a "search" file, it's served instead, so that every
+// resource can be fetched.
+func (s *Server) unlessResource(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, asset, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/webpub/"), "/")
+		filename := r.Context().Value(ContextPathKey).(string)
+		cp, err := s.getPublication(r.Context(), filename)
+		if err != nil {
+			// The service reports the error
+			next(w, r)
+			return
+		}
+		href, err := url.URLFromDecodedPath(path.Clean(asset))
+		isResource := err == nil && cp.LinkWithHref(href) != nil
+		cp.Release()
+		if !isResource {
+			next(w, r)
+			return
+		}
+
+		vars := maps.Clone(mux.Vars(r))
+		vars["asset"] = asset
+		s.getAsset(w, mux.SetURLVars(r, vars))
+	}
+}
+
+func compressionMiddleware(next http.Handler) http.Handler {
+	adapter, _ := httpcompression.DefaultAdapter(httpcompression.ContentTypes(compressableMimes, false))
+	return adapter(next)
+}
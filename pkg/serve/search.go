@@ -0,0 +1,396 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	nurl "net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/serve/cache"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Maximum number of results of a search, across all pages
+const MaxSearchResults = 1000
+
+const searchResultsPerPage = 20
+
+// Number of characters of text before and after each result
+const searchContextLength = 50
+
+var locatorsMediaType, _ = mediatype.NewOfString("application/vnd.readium.locators+json")
+
+// Letters that are distinct from their base letter in a language, and must not
+// lose their diacritics when folding text. Searching for "saari" in Finnish
+// should not match "sääri".
+var searchPreservedLetters = map[string]string{
+	"fi": "åäö",
+	"sv": "åäö",
+}
+
+// Elements whose boundaries separate words
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Br: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Figcaption: true, atom.Figure: true, atom.Footer: true, atom.H1: true,
+	atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.Li: true, atom.Nav: true, atom.Ol: true,
+	atom.P: true, atom.Pre: true, atom.Section: true, atom.Table: true, atom.Td: true,
+	atom.Th: true, atom.Tr: true, atom.Ul: true,
+}
+
+// Text content of a resource of the reading order
+type searchDocument struct {
+	link manifest.Link
+	text string
+}
+
+type searchLocations struct {
+	Progression float64 `json:"progression"`
+}
+
+type searchText struct {
+	Before    string `json:"before,omitempty"`
+	Highlight string `json:"highlight"`
+	After     string `json:"after,omitempty"`
+}
+
+type searchLocator struct {
+	Href      string          `json:"href"`
+	Type      string          `json:"type"`
+	Title     string          `json:"title,omitempty"`
+	Locations searchLocations `json:"locations"`
+	Text      searchText      `json:"text"`
+}
+
+type locatorCollectionMetadata struct {
+	Title         string `json:"title"`
+	NumberOfItems int    `json:"numberOfItems"`
+	CurrentPage   int    `json:"currentPage"`
+}
+
+// Readium locator collection, the result of a search
+type locatorCollection struct {
+	Metadata locatorCollectionMetadata `json:"metadata"`
+	Links    []opdsLink                `json:"links"`
+	Locators []searchLocator           `json:"locators"`
+}
+
+func isSearchable(link manifest.Link) bool {
+	return link.MediaType != nil && link.MediaType.IsHTML()
+}
+
+// Whether the publication has content documents that can be searched.
+func hasSearchableContent(m *manifest.Manifest) bool {
+	for _, link := range m.ReadingOrder {
+		if isSearchable(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// Link to the search service, added to the manifest of searchable publications.
+func searchServiceLink() manifest.Link {
+	return manifest.Link{
+		Href:      manifest.MustNewHREFFromString("search{?q}", true),
+		MediaType: &locatorsMediaType,
+		Rels:      manifest.Strings{"search"},
+	}
+}
+
+// Extract the text content of an (X)HTML document, normalized to NFC with
+// collapsed whitespace.
+func extractText(r io.Reader) string {
+	var sb strings.Builder
+	z := html.NewTokenizer(r)
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return norm.NFC.String(strings.Join(strings.Fields(sb.String()), " "))
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			if tt == html.SelfClosingTagToken {
+				// In XHTML, self-closing elements such as <script/> have no content
+				z.NextIsNotRawText()
+			}
+			name, _ := z.TagName()
+			a := atom.Lookup(name)
+			switch a {
+			case atom.Head, atom.Script, atom.Style, atom.Template:
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			}
+			if blockElements[a] {
+				sb.WriteByte(' ')
+			}
+		case html.TextToken:
+			if skip == 0 {
+				sb.Write(z.Text())
+			}
+		}
+	}
+}
+
+// Get the text content of the publication's reading order. It's kept for as
+// long as the publication is cached.
+func searchDocuments(ctx context.Context, cp *cache.CachedPublication) ([]searchDocument, *fetcher.ResourceError) {
+	if docs, ok := cp.Derived("search-documents"); ok {
+		return docs.([]searchDocument), nil
+	}
+
+	var docs []searchDocument
+	for _, link := range cp.Manifest.ReadingOrder {
+		if !isSearchable(link) {
+			continue
+		}
+		res := cp.Get(ctx, link)
+		data, rerr := res.Read(ctx, 0, 0)
+		res.Close()
+		if rerr != nil {
+			return nil, rerr
+		}
+		docs = append(docs, searchDocument{link: link, text: extractText(bytes.NewReader(data))})
+	}
+	cp.SetDerived("search-documents", docs)
+	return docs, nil
+}
+
+// Primary language of the publication, as a lowercase ISO 639 code.
+func publicationLanguage(cp *cache.CachedPublication) string {
+	if lang, ok := cp.Derived("language"); ok {
+		return lang.(string)
+	}
+
+	var metadata struct {
+		Language json.RawMessage `json:"language"`
+	}
+	var lang string
+	if j, err := json.Marshal(&cp.Manifest.Metadata); err == nil && json.Unmarshal(j, &metadata) == nil {
+		var languages []string
+		if json.Unmarshal(metadata.Language, &languages) != nil {
+			languages = make([]string, 1)
+			json.Unmarshal(metadata.Language, &languages[0])
+		}
+		if len(languages) > 0 {
+			lang = primaryLanguage(languages[0])
+		}
+	}
+	cp.SetDerived("language", lang)
+	return lang
+}
+
+func primaryLanguage(tag string) string {
+	primary, _, _ := strings.Cut(tag, "-")
+	return strings.ToLower(primary)
+}
+
+// Text folded for case and diacritic insensitive matching, with the position
+// in the original text of every byte.
+type foldedText struct {
+	text   string
+	starts []int // Start of the original character for each byte
+	ends   []int // End of the original character for each byte
+}
+
+func foldRune(r rune, preserved string) string {
+	r = unicode.ToLower(r)
+	if r < utf8.RuneSelf || strings.ContainsRune(preserved, r) {
+		return string(r)
+	}
+	var sb strings.Builder
+	for _, dr := range norm.NFD.String(string(r)) {
+		if !unicode.Is(unicode.Mn, dr) {
+			sb.WriteRune(dr)
+		}
+	}
+	return sb.String()
+}
+
+func foldText(s string, preserved string) foldedText {
+	var sb strings.Builder
+	starts := make([]int, 0, len(s))
+	ends := make([]int, 0, len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		f := foldRune(r, preserved)
+		sb.WriteString(f)
+		for range len(f) {
+			starts = append(starts, i)
+			ends = append(ends, i+size)
+		}
+		i += size
+	}
+	return foldedText{text: sb.String(), starts: starts, ends: ends}
+}
+
+// Last n characters of s
+func lastRunes(s string, n int) string {
+	i := len(s)
+	for ; n > 0 && i > 0; n-- {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	return s[i:]
+}
+
+// First n characters of s
+func firstRunes(s string, n int) string {
+	i := 0
+	for ; n > 0 && i < len(s); n-- {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return s[:i]
+}
+
+// Search the documents for a query, up to MaxSearchResults results.
+func findMatches(docs []searchDocument, query, lang string) []searchLocator {
+	preserved := searchPreservedLetters[lang]
+	fq := foldText(norm.NFC.String(query), preserved).text
+	if fq == "" {
+		return nil
+	}
+
+	var results []searchLocator
+	for _, doc := range docs {
+		folded := foldText(doc.text, preserved)
+		var mediaType string
+		if doc.link.MediaType != nil {
+			mediaType = doc.link.MediaType.String()
+		}
+
+		for i := 0; ; {
+			pos := strings.Index(folded.text[i:], fq)
+			if pos < 0 {
+				break
+			}
+			start, end := i+pos, i+pos+len(fq)
+			origStart, origEnd := folded.starts[start], folded.ends[end-1]
+			results = append(results, searchLocator{
+				Href:  doc.link.Href.String(),
+				Type:  mediaType,
+				Title: doc.link.Title,
+				Locations: searchLocations{
+					Progression: float64(origStart) / float64(len(doc.text)),
+				},
+				Text: searchText{
+					Before:    lastRunes(doc.text[:origStart], searchContextLength),
+					Highlight: doc.text[origStart:origEnd],
+					After:     firstRunes(doc.text[origEnd:], searchContextLength),
+				},
+			})
+			if len(results) >= MaxSearchResults {
+				return results
+			}
+			i = end
+		}
+	}
+	return results
+}
+
+func (s *Server) getSearch(w http.ResponseWriter, req *http.Request) {
+	filename := req.Context().Value(ContextPathKey).(string)
+
+	query := strings.TrimSpace(req.URL.Query().Get("q"))
+	if query == "" {
+		s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("missing search query"))
+		return
+	}
+	page := 1
+	if p := req.URL.Query().Get("page"); p != "" {
+		var err error
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 {
+			s.writeProblem(w, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("invalid page "+p))
+			return
+		}
+	}
+
+	// Load the publication
+	cp, err := s.getPublication(req.Context(), filename)
+	if err != nil {
+		s.writePublicationProblem(w, err)
+		return
+	}
+	defer cp.Release()
+	if !hasSearchableContent(&cp.Manifest) {
+		s.writeProblem(w, http.StatusNotFound, ErrCodeResourceNotFound, errors.New("publication has no searchable content"))
+		return
+	}
+
+	docs, rerr := searchDocuments(req.Context(), cp)
+	if rerr != nil {
+		s.writeProblem(w, rerr.HTTPStatus(), codeForStatus(rerr.HTTPStatus()), rerr)
+		return
+	}
+
+	// The language of the publication decides which letters are kept distinct
+	lang := primaryLanguage(req.URL.Query().Get("lang"))
+	if lang == "" {
+		lang = publicationLanguage(cp)
+	}
+	results := findMatches(docs, query, lang)
+	if base := s.resourceBaseURL(req); base != "" {
+		// Locators must match the hrefs of the manifest
+		for i := range results {
+			results[i].Href = base + results[i].Href
+		}
+	}
+
+	pageURL := func(n int) string {
+		return s.baseURL(req) + req.URL.Path + "?q=" + nurl.QueryEscape(query) + "&page=" + strconv.Itoa(n)
+	}
+	collection := locatorCollection{
+		Metadata: locatorCollectionMetadata{
+			Title:         query,
+			NumberOfItems: len(results),
+			CurrentPage:   page,
+		},
+		Links: []opdsLink{
+			{Rel: "self", Href: pageURL(page), Type: locatorsMediaType.String()},
+		},
+		Locators: []searchLocator{},
+	}
+	if start := (page - 1) * searchResultsPerPage; start < len(results) {
+		collection.Locators = results[start:min(start+searchResultsPerPage, len(results))]
+	}
+	if page > 1 {
+		collection.Links = append(collection.Links, opdsLink{Rel: "previous", Href: pageURL(page - 1), Type: locatorsMediaType.String()})
+	}
+	if page*searchResultsPerPage < len(results) {
+		collection.Links = append(collection.Links, opdsLink{Rel: "next", Href: pageURL(page + 1), Type: locatorsMediaType.String()})
+	}
+
+	var j []byte
+	if s.config.JSONIndent == "" {
+		j, err = json.Marshal(collection)
+	} else {
+		j, err = json.MarshalIndent(collection, "", s.config.JSONIndent)
+	}
+	if err != nil {
+		s.writeProblem(w, http.StatusInternalServerError, ErrCodeInternalError, errors.Wrap(err, "failed marshalling search results"))
+		return
+	}
+
+	w.Header().Set("content-type", locatorsMediaType.String()+"; charset=utf-8")
+	w.Header().Set("cache-control", "private, max-age=3600")
+	w.Header().Set("content-length", strconv.Itoa(len(j)))
+	w.Write(j)
+}
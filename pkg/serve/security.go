@@ -0,0 +1,474 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/xml"
+	"html"
+	nurl "net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	xhtml "golang.org/x/net/html"
+)
+
+// Content security modes
+const (
+	ContentSecurityOff      = "off"      // Documents are served as-is
+	ContentSecurityCSP      = "csp"      // Documents are served with a Content-Security-Policy forbidding scripts
+	ContentSecuritySanitize = "sanitize" // Scripts are also removed from documents
+)
+
+// ContentSecurityConfig controls how scripts in publications are handled.
+type ContentSecurityConfig struct {
+	Mode                 string   // One of the ContentSecurity* modes
+	ScriptedPublications []string // Patterns of the publications allowed to run scripts, see ScriptedPublicationPattern
+}
+
+// Attributes containing URLs, that must not use the javascript: scheme
+var urlAttributes = []string{"href", "src", "action", "formaction", "data", "poster", "background", "cite", "codebase"}
+
+// Attributes of SVG animations, which can set URL attributes, such as
+// <set attributeName="href" to="javascript:...">
+var animationAttributes = []string{"to", "from", "by", "values"}
+
+// Whether a resource is a document that can contain scripts.
+func isScriptableDocument(mimeType string) bool {
+	return mimeType == "text/html" || mimeType == "application/xhtml+xml" || mimeType == "image/svg+xml"
+}
+
+// Schemes of the remote publications that scripted publication patterns can match
+var scriptedPublicationSchemes = []string{"s3", "gs", "http", "https"}
+
+// ScriptedPublicationPattern validates a pattern of the publications allowed
+// to run scripts, and returns it normalized. Patterns use the syntax of
+// path.Match, so that * doesn't match slashes:
+//
+//   - local publications are matched by their path relative to the directory
+//     of publications, such as interactive/*.epub
+//   - remote publications are matched by their URL, without its query, such
+//     as s3://bucket/interactive/*.epub or https://example.com/interactive/*.epub,
+//     with a scheme and a host that are not patterns
+func ScriptedPublicationPattern(pattern string) (string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", err
+	}
+	scheme, rest, ok := strings.Cut(pattern, "://")
+	if !ok {
+		if strings.HasPrefix(pattern, "/") || path.Clean(pattern) != pattern {
+			return "", errors.New("the path of local publications must be relative and clean")
+		}
+		return pattern, nil
+	}
+
+	scheme = strings.ToLower(scheme)
+	if !slices.Contains(scriptedPublicationSchemes, scheme) {
+		return "", errors.New("scheme must be one of " + strings.Join(scriptedPublicationSchemes, ", "))
+	}
+	host, p, _ := strings.Cut(rest, "/")
+	if host == "" || strings.ContainsAny(host, `*?[\`) {
+		return "", errors.New("host must be set, and can't be a pattern")
+	}
+	p = "/" + p
+	if path.Clean(p) != p {
+		return "", errors.New("path must be clean")
+	}
+	return scheme + "://" + strings.ToLower(host) + p, nil
+}
+
+// Path of a publication matched by the scripted publication patterns: its
+// path relative to the directory of local publications, or its URL without
+// query for remote ones.
+func scriptedPublicationPath(filename string) (string, bool) {
+	u, err := nurl.Parse(filename)
+	if err != nil {
+		return "", false
+	}
+	// As when the publication is opened, the path can't go above the root
+	p := path.Clean("/" + u.Path)
+	if u.Scheme == "" || strings.EqualFold(u.Scheme, "file") {
+		return strings.TrimPrefix(p, "/"), true
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + p, true
+}
+
+// Whether a publication is allowed to run scripts.
+func (s *Server) allowsScripts(filename string) bool {
+	if s.config.ContentSecurity.Mode == "" || s.config.ContentSecurity.Mode == ContentSecurityOff {
+		return true
+	}
+	p, ok := scriptedPublicationPath(filename)
+	if !ok {
+		return false
+	}
+	for _, pattern := range s.config.ContentSecurity.ScriptedPublications {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether scripts must be removed from a resource.
+func (s *Server) sanitizes(filename, mimeType string) bool {
+	return s.config.ContentSecurity.Mode == ContentSecuritySanitize && isScriptableDocument(mimeType) && !s.allowsScripts(filename)
+}
+
+// Sources of a policy directive: the base sources, along with the origins of
+// the injected resources.
+func policySources(base []string, urls []string) string {
+	sources := slices.Clone(base)
+	for _, u := range urls {
+		source := "'self'"
+		if pu, err := nurl.Parse(u); err == nil && pu.Host != "" {
+			scheme := pu.Scheme
+			if scheme == "" {
+				scheme = "https" // Protocol-relative
+			}
+			source = scheme + "://" + pu.Host
+		}
+		if !slices.Contains(sources, source) {
+			sources = append(sources, source)
+		}
+	}
+	return strings.Join(sources, " ")
+}
+
+// Content-Security-Policy of a resource, or an empty string if none applies.
+func (s *Server) contentSecurityPolicy(filename, mimeType string) string {
+	mode := s.config.ContentSecurity.Mode
+	if mode == "" || mode == ContentSecurityOff || !isScriptableDocument(mimeType) {
+		return ""
+	}
+
+	// Injected stylesheets and scripts must be allowed
+	var stylesheets, scripts []string
+	if s.config.Injection != nil {
+		for _, rules := range []InjectionRules{s.config.Injection.Reflowable, s.config.Injection.FixedLayout} {
+			stylesheets = append(stylesheets, rules.StylesheetsBefore...)
+			stylesheets = append(stylesheets, rules.StylesheetsAfter...)
+			scripts = append(scripts, rules.Scripts...)
+		}
+	}
+	styleSources := policySources([]string{"'self'", "'unsafe-inline'", "data:"}, stylesheets)
+	fontSources := policySources([]string{"'self'", "data:"}, stylesheets)
+
+	scriptSources := "'none'"
+	if s.allowsScripts(filename) {
+		scriptSources = policySources([]string{"'self'", "'unsafe-inline'", "'unsafe-eval'"}, scripts)
+	} else if len(scripts) > 0 && mimeType != "image/svg+xml" {
+		scriptSources = policySources(nil, scripts)
+	}
+
+	if mimeType == "image/svg+xml" {
+		return "default-src 'self' data:; script-src " + scriptSources + "; style-src " + styleSources + "; object-src 'none'"
+	}
+	return "default-src 'self' data: blob:; script-src " + scriptSources +
+		"; style-src " + styleSources +
+		"; font-src " + fontSources +
+		"; img-src 'self' data: blob:; media-src 'self' data: blob:; object-src 'none'; base-uri 'self'; form-action 'none'"
+}
+
+func isAttributeSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// Whether an attribute can run scripts.
+func isScriptAttribute(name, value []byte) bool {
+	local := strings.ToLower(string(name))
+	if i := strings.LastIndexByte(local, ':'); i >= 0 {
+		local = local[i+1:] // Such as xlink:href
+	}
+	if strings.HasPrefix(local, "on") || local == "srcdoc" {
+		return true
+	}
+	animation := slices.Contains(animationAttributes, local)
+	if !animation && !slices.Contains(urlAttributes, local) {
+		return false
+	}
+
+	// Browsers ignore whitespace and control characters in URL schemes
+	v := strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, html.UnescapeString(string(value)))
+	v = strings.ToLower(v)
+	if animation {
+		// A list of values separated by semicolons
+		return strings.Contains(v, "javascript:") || strings.Contains(v, "vbscript:")
+	}
+	return strings.HasPrefix(v, "javascript:") || strings.HasPrefix(v, "vbscript:")
+}
+
+// Remove event handlers and javascript: URLs from a raw start tag. The rest of
+// the tag is kept as-is, since XHTML and SVG are case-sensitive.
+func sanitizeTag(tag []byte) []byte {
+	// Skip the name of the tag
+	i := 1
+	for i < len(tag) && !isAttributeSpace(tag[i]) && tag[i] != '/' && tag[i] != '>' {
+		i++
+	}
+
+	var out []byte
+	last := 0
+	for i < len(tag) {
+		attrStart := i
+		for i < len(tag) && (isAttributeSpace(tag[i]) || tag[i] == '/') {
+			i++
+		}
+		if i >= len(tag) || tag[i] == '>' {
+			break
+		}
+
+		nameStart := i
+		for i < len(tag) && !isAttributeSpace(tag[i]) && tag[i] != '=' && tag[i] != '>' && tag[i] != '/' {
+			i++
+		}
+		name := tag[nameStart:i]
+		if i == nameStart {
+			i++ // Stray character
+			continue
+		}
+
+		var value []byte
+		j := i
+		for j < len(tag) && isAttributeSpace(tag[j]) {
+			j++
+		}
+		if j < len(tag) && tag[j] == '=' {
+			j++
+			for j < len(tag) && isAttributeSpace(tag[j]) {
+				j++
+			}
+			if j < len(tag) && (tag[j] == '"' || tag[j] == '\'') {
+				quote := tag[j]
+				end := bytes.IndexByte(tag[j+1:], quote)
+				if end < 0 {
+					end = len(tag) - j - 1
+				}
+				value = tag[j+1 : j+1+end]
+				i = min(j+end+2, len(tag))
+			} else {
+				start := j
+				for j < len(tag) && !isAttributeSpace(tag[j]) && tag[j] != '>' {
+					j++
+				}
+				value = tag[start:j]
+				i = j
+			}
+		}
+
+		if isScriptAttribute(name, value) {
+			out = append(out, tag[last:attrStart]...)
+			last = i
+		}
+	}
+	if out == nil {
+		return tag
+	}
+	return append(out, tag[last:]...)
+}
+
+// Whether an element is a script, such as <script>, <svg:script> or
+// <h:script>, whatever the prefix of its namespace.
+func isScriptElement(name string) bool {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.EqualFold(name, "script")
+}
+
+// Remove scripts, event handlers and javascript: URLs from an HTML, XHTML or
+// SVG document. Like injection, the document is not reserialized. XHTML and
+// SVG documents are tokenized as XML, like browsers parse them.
+func sanitizeDocument(doc []byte, mimeType string) []byte {
+	if mimeType == "text/html" {
+		return sanitizeHTML(doc)
+	}
+	return sanitizeXML(doc)
+}
+
+// HTML elements closing the SVG and MathML elements they're in, see
+// https://html.spec.whatwg.org/multipage/parsing.html#parsing-main-inforeign
+var foreignBreakoutElements = []string{
+	"b", "big", "blockquote", "body", "br", "center", "code", "dd", "div", "dl", "dt", "em", "embed",
+	"h1", "h2", "h3", "h4", "h5", "h6", "head", "hr", "i", "img", "li", "listing", "menu", "meta",
+	"nobr", "ol", "p", "pre", "ruby", "s", "small", "span", "strong", "strike", "sub", "sup",
+	"table", "tt", "u", "ul", "var",
+}
+
+// SVG and MathML elements containing HTML elements
+var htmlIntegrationElements = []string{"foreignobject", "desc", "title", "mi", "mo", "mn", "ms", "mtext"}
+
+// MathML text elements, containing HTML elements but <mglyph> and <malignmark>
+var mathTextElements = []string{"mi", "mo", "mn", "ms", "mtext"}
+
+// Element switching between HTML and foreign content, the content of SVG and
+// MathML elements.
+type contentElement struct {
+	name    string
+	foreign bool // Whether its content is foreign
+}
+
+// Tracks whether the tokenizer is in foreign content, where elements such as
+// <style> or <title> don't contain raw text, following how browsers build
+// the document tree closely enough to tokenize it like they do.
+type contentNesting []contentElement
+
+func (n contentNesting) foreign() bool {
+	return len(n) > 0 && n[len(n)-1].foreign
+}
+
+// Close the foreign elements up to the innermost HTML content.
+func (n *contentNesting) breakOut() {
+	for n.foreign() {
+		*n = (*n)[:len(*n)-1]
+	}
+}
+
+// Update the nesting with a tag, and report whether the element is in
+// foreign content.
+func (n *contentNesting) tag(z *xhtml.Tokenizer, tt xhtml.TokenType, name string, hasAttr bool) bool {
+	if tt == xhtml.EndTagToken {
+		if n.foreign() && (name == "p" || name == "br") {
+			n.breakOut()
+		}
+		for i := len(*n) - 1; i >= 0; i-- {
+			if (*n)[i].name == name {
+				*n = (*n)[:i]
+				break
+			}
+		}
+		return n.foreign()
+	}
+
+	// Attributes of <font> and <annotation-xml> changing the content
+	var breakout, htmlAnnotation bool
+	for hasAttr && (name == "font" || name == "annotation-xml") {
+		var key, val []byte
+		key, val, hasAttr = z.TagAttr()
+		switch string(key) {
+		case "color", "face", "size":
+			breakout = name == "font"
+		case "encoding":
+			htmlAnnotation = strings.EqualFold(string(val), "text/html") || strings.EqualFold(string(val), "application/xhtml+xml")
+		}
+	}
+	if n.foreign() && (breakout || slices.Contains(foreignBreakoutElements, name)) {
+		n.breakOut()
+	}
+
+	foreign := n.foreign()
+	mathText := len(*n) > 0 && slices.Contains(mathTextElements, (*n)[len(*n)-1].name)
+	if tt == xhtml.StartTagToken {
+		switch {
+		case name == "svg" || name == "math":
+			*n = append(*n, contentElement{name, true})
+		case foreign && (slices.Contains(htmlIntegrationElements, name) || name == "annotation-xml" && htmlAnnotation):
+			*n = append(*n, contentElement{name, false})
+		case !foreign && mathText && (name == "mglyph" || name == "malignmark"):
+			*n = append(*n, contentElement{name, true})
+		}
+	}
+	return foreign
+}
+
+func sanitizeHTML(doc []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(doc))
+	z := xhtml.NewTokenizer(bytes.NewReader(doc))
+	offset := 0
+	inScript := 0
+	var nesting contentNesting
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			if inScript == 0 {
+				out.Write(doc[offset:])
+			}
+			break
+		}
+		chunk := doc[offset : offset+len(z.Raw())]
+		offset += len(chunk)
+
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken, xhtml.EndTagToken:
+			name, hasAttr := z.TagName()
+			script := isScriptElement(string(name))
+			foreign := nesting.tag(z, tt, string(name), hasAttr)
+			if tt != xhtml.EndTagToken && !script && foreign {
+				// The content of elements such as <title>, <style> or
+				// <noscript> is not raw text in SVG and MathML elements, so
+				// it's sanitized as well
+				z.NextIsNotRawText()
+			}
+			if script {
+				// <script/> also starts a script in HTML
+				if tt != xhtml.EndTagToken {
+					inScript++
+				} else if tt == xhtml.EndTagToken && inScript > 0 {
+					inScript--
+				}
+				continue
+			}
+			if inScript > 0 {
+				continue
+			}
+			if tt != xhtml.EndTagToken {
+				chunk = sanitizeTag(chunk)
+			}
+		default:
+			if inScript > 0 {
+				continue
+			}
+		}
+		out.Write(chunk)
+	}
+	return out.Bytes()
+}
+
+func sanitizeXML(doc []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(doc))
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	d.Strict = false
+	offset := 0
+	inScript := 0
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			// Browsers don't render what follows a syntax error either
+			break
+		}
+		end := int(d.InputOffset())
+		chunk := doc[offset:end]
+		offset = end
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if isScriptElement(t.Name.Local) {
+				inScript++
+				continue
+			}
+			chunk = sanitizeTag(chunk)
+		case xml.EndElement:
+			if isScriptElement(t.Name.Local) && inScript > 0 {
+				inScript--
+				continue
+			}
+		case xml.Directive:
+			// Entities declared in the internal subset of the DOCTYPE could
+			// expand to elements
+			if bytes.HasPrefix(t, []byte("DOCTYPE")) && bytes.ContainsRune(t, '[') {
+				continue
+			}
+		}
+		if inScript == 0 {
+			out.Write(chunk)
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,180 @@
+package serve
+
+import (
+	"strings"
+	"testing"
+)
+
+const xhtmlHead = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:h="http://www.w3.org/1999/xhtml" xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">`
+
+func TestSanitizeXHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"script", `<body><script>alert(1)</script></body>`},
+		{"self-closing script", `<body><script src="x.js"/></body>`},
+		{"svg prefixed script", `<body><svg:svg><svg:script>alert(1)</svg:script></svg:svg></body>`},
+		{"xhtml prefixed script", `<body><h:script>alert(1)</h:script></body>`},
+		{"script in title", `<head><title><script>alert(1)</script></title></head>`},
+		{"script in style", `<head><style><script>alert(1)</script></style></head>`},
+		{"script in textarea", `<body><textarea><script>alert(1)</script></textarea></body>`},
+		{"script in noscript", `<body><noscript><script>alert(1)</script></noscript></body>`},
+		{"script in xmp", `<body><xmp><script>alert(1)</script></xmp></body>`},
+		{"script in iframe", `<body><iframe><script>alert(1)</script></iframe></body>`},
+		{"script in noembed", `<body><noembed><script>alert(1)</script></noembed></body>`},
+		{"script in noframes", `<body><noframes><script>alert(1)</script></noframes></body>`},
+		{"handler in title", `<head><title><img src="x" onerror="alert(1)"/></title></head>`},
+		{"handler in textarea", `<body><textarea><img src="x" onerror="alert(1)"/></textarea></body>`},
+		{"javascript URL in style", `<head><style><a href="javascript:alert(1)">x</a></style></head>`},
+		{"animation", `<body><svg:svg><svg:a><svg:set attributeName="xlink:href" to="javascript:alert(1)"/></svg:a></svg:svg></body>`},
+		{"animation values", `<body><svg:svg><svg:a><svg:animate attributeName="href" values="#a;javascript:alert(1)"/></svg:a></svg:svg></body>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := string(sanitizeDocument([]byte(xhtmlHead+tt.doc+`</html>`), "application/xhtml+xml"))
+			for _, s := range []string{"<script", ":script", "alert"} {
+				if strings.Contains(out, s) {
+					t.Errorf("sanitized document contains %q: %s", s, out)
+				}
+			}
+			if !strings.HasSuffix(out, "</html>") {
+				t.Errorf("sanitized document is truncated: %s", out)
+			}
+		})
+	}
+}
+
+func TestSanitizeXHTMLEntities(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<!DOCTYPE html [<!ENTITY e "<script>alert(1)</script>">]>
+<html xmlns="http://www.w3.org/1999/xhtml"><body>&e;</body></html>`
+	out := string(sanitizeDocument([]byte(doc), "application/xhtml+xml"))
+	if strings.Contains(out, "ENTITY") {
+		t.Errorf("entity declaration wasn't removed: %s", out)
+	}
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	doc := `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)">
+<script type="text/ecmascript"><![CDATA[alert(1)]]></script>
+<a xlink:href="javascript:alert(1)"><text>x</text></a>
+<foreignObject><body xmlns="http://www.w3.org/1999/xhtml"><title><script>alert(1)</script></title></body></foreignObject>
+</svg>`
+	out := string(sanitizeDocument([]byte(doc), "image/svg+xml"))
+	if strings.Contains(out, "alert") {
+		t.Errorf("sanitized document contains a script: %s", out)
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"script", `<p>a</p><script>alert(1)</script><p>b</p>`},
+		{"self-closing script", `<p>a</p><script/>alert(1)</script><p>b</p>`},
+		{"handler", `<p>a</p><img src="x" onerror="alert(1)"><p>b</p>`},
+		{"handler in svg style", `<p>a</p><svg><style><img src="x" onerror="alert(1)"></style></svg><p>b</p>`},
+		{"handler in math title", `<p>a</p><math><title><img src="x" onerror="alert(1)"></title></math><p>b</p>`},
+		{"comment in style", `<p>a</p><style><!--</style><script>alert(1)</script>--><p>b</p>`},
+		{"attribute in title", `<p>a</p><title><a title="</title><img src=x onerror=alert(1)>"><p>b</p>`},
+		{"style after svg", `<p>a</p><svg></svg><style><!--</style><script>alert(1)</script>--><p>b</p>`},
+		{"style in svg foreignObject", `<p>a</p><svg><foreignObject><style><!--</style><script>alert(1)</script>--></foreignObject></svg><p>b</p>`},
+		{"style out of svg", `<p>a</p><svg><p><style><!--</style><script>alert(1)</script>--><p>b</p>`},
+		{"style in svg font", `<p>a</p><svg><font><style><img src=x onerror=alert(1)></style></font></svg><p>b</p>`},
+		{"style in math mi", `<p>a</p><math><mi><style><!--</style><script>alert(1)</script>--></mi></math><p>b</p>`},
+		{"style in math mglyph", `<p>a</p><math><mi><mglyph><style><img src=x onerror=alert(1)></style></mglyph></mi></math><p>b</p>`},
+		{"style in math annotation", `<p>a</p><math><annotation-xml encoding="text/html"><style><!--</style><script>alert(1)</script>--></annotation-xml></math><p>b</p>`},
+		{"javascript URL", `<p>a</p><a href=" jav&#x09;ascript:alert(1)">x</a><p>b</p>`},
+		{"srcdoc", `<p>a</p><iframe srcdoc="&lt;b onmouseover=alert(1)&gt;"></iframe><p>b</p>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := string(sanitizeDocument([]byte(tt.doc), "text/html"))
+			if strings.Contains(out, "alert") {
+				t.Errorf("sanitized document contains a script: %s", out)
+			}
+			if !strings.HasPrefix(out, "<p>a</p>") || !strings.HasSuffix(out, "<p>b</p>") {
+				t.Errorf("sanitized document lost its content: %s", out)
+			}
+		})
+	}
+}
+
+func TestSanitizeKeepsDocument(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		doc      string
+	}{
+		{"application/xhtml+xml", xhtmlHead + `<head><title>A &amp; B</title><style>p > a { color: red }</style></head>
+<body><p class="x" data-scripted="no"><a href="#note">A</a><br/><![CDATA[<b>]]>&nbsp;</p><svg:svg viewBox="0 0 10 10"><svg:a xlink:href="#b"/></svg:svg></body></html>`},
+		{"text/html", `<!DOCTYPE html><html><head><title>A &amp; B</title></head><body><p><a href="#note">A</a><br></p></body></html>`},
+	}
+	for _, tt := range tests {
+		if out := string(sanitizeDocument([]byte(tt.doc), tt.mimeType)); out != tt.doc {
+			t.Errorf("%s document was modified:\n%s\n%s", tt.mimeType, tt.doc, out)
+		}
+	}
+}
+
+func TestScriptedPublicationPattern(t *testing.T) {
+	valid := map[string]string{
+		"interactive/*.epub":                  "interactive/*.epub",
+		"S3://Bucket/interactive/*.epub":      "s3://bucket/interactive/*.epub",
+		"gs://bucket/*.epub":                  "gs://bucket/*.epub",
+		"https://example.com/scripted/*":      "https://example.com/scripted/*",
+		"http://example.com:8080/a/[ab].epub": "http://example.com:8080/a/[ab].epub",
+	}
+	for pattern, expected := range valid {
+		if normalized, err := ScriptedPublicationPattern(pattern); err != nil || normalized != expected {
+			t.Errorf("pattern %q: got %q, %v, expected %q", pattern, normalized, err, expected)
+		}
+	}
+	for _, pattern := range []string{
+		"[",
+		"/interactive/*.epub",
+		"./interactive/*.epub",
+		"interactive/../*.epub",
+		"ftp://example.com/*.epub",
+		"https://*.example.com/*.epub",
+		"s3:///*.epub",
+		"s3://bucket/a//*.epub",
+	} {
+		if _, err := ScriptedPublicationPattern(pattern); err == nil {
+			t.Errorf("pattern %q should be invalid", pattern)
+		}
+	}
+}
+
+func TestAllowsScripts(t *testing.T) {
+	s := &Server{config: ServerConfig{ContentSecurity: ContentSecurityConfig{
+		Mode:                 ContentSecurityCSP,
+		ScriptedPublications: []string{"interactive/*.epub", "s3://bucket/interactive/*.epub", "https://example.com/interactive/*.epub"},
+	}}}
+	tests := map[string]bool{
+		"interactive/a.epub":                               true,
+		"/interactive/a.epub":                              true,
+		"file:///interactive/a.epub":                       true,
+		"interactive/../a.epub":                            false,
+		"interactive/sub/a.epub":                           false,
+		"other/a.epub":                                     false,
+		"s3://bucket/interactive/a.epub":                   true,
+		"s3://bucket/interactive/../secret/a.epub":         false,
+		"s3://other/interactive/a.epub":                    false,
+		"gs://bucket/interactive/a.epub":                   false,
+		"https://example.com/interactive/a.epub?sig=x":     true,
+		"https://EXAMPLE.com/interactive/a.epub":           true,
+		"https://example.com.evil/interactive/a.epub":      false,
+		"https://evil.com/example.com/interactive/a.epub":  false,
+		"http://example.com/interactive/a.epub":            false,
+		"https://example.com/interactive/%2e%2e/b/a.epub":  false,
+		"https://example.com/interactive/sub%2Fdir/a.epub": false,
+	}
+	for filename, expected := range tests {
+		if allowed := s.allowsScripts(filename); allowed != expected {
+			t.Errorf("publication %q: allowed %v, expected %v", filename, allowed, expected)
+		}
+	}
+}
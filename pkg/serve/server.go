@@ -2,6 +2,9 @@ package serve
 
 import (
 	"net/http"
+	"net/netip"
+	"runtime"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -12,6 +15,7 @@ import (
 	"github.com/readium/go-toolkit/pkg/archive"
 	"github.com/readium/go-toolkit/pkg/streamer"
 	"github.com/readium/go-toolkit/pkg/util/url"
+	"golang.org/x/sync/singleflight"
 )
 
 type Remote struct {
@@ -42,10 +46,24 @@ func (r Remote) AcceptsScheme(scheme url.Scheme) bool {
 }
 
 type ServerConfig struct {
-	Debug             bool
-	JSONIndent        string
-	InferA11yMetadata streamer.InferA11yMetadata
-	Auth              auth.AuthProvider
+	Debug              bool
+	JSONIndent         string
+	InferA11yMetadata  streamer.InferA11yMetadata
+	Auth               auth.AuthProvider
+	MaxRanges          int                   // Maximum amount of ranges in a single request
+	ReprDigest         bool                  // Add a Repr-Digest header to assets
+	OPDS               *OPDSConfig           // Serve an OPDS feed of the publications, if set
+	IIIFMaxSize        int                   // Maximum width and height of images produced by the IIIF service
+	IIIFCacheSize      int64                 // Total size in bytes of the images produced by the IIIF service kept in memory
+	Injection          *InjectionConfig      // Inject elements in HTML and XHTML resources, if set
+	ContentSecurity    ContentSecurityConfig // Restrict scripts in HTML, XHTML and SVG resources
+	PublicBaseURL      string                // Base URL of the server used in links, instead of the one of the request
+	TrustedProxies     []netip.Prefix        // Proxies allowed to set the base URL using Forwarded or X-Forwarded-* headers
+	ResourceBaseURL    string                // Base URL of the origin serving the resources of the manifest, if different
+	CORS               CORSConfig            // Cross-origin access to publications
+	AccessLog          AccessLogConfig       // Log each request once its response has been sent
+	AuthMode           string                // Name of the access mode, reported by the version endpoint
+	ReadinessLocations []string              // S3 and GCS locations listed by the readiness checks. Defaults to the sources of the OPDS feed
 }
 
 type Server struct {
@@ -53,6 +71,18 @@ type Server struct {
 	remote Remote
 	router *mux.Router
 	lfu    *cache.TinyLFU
+	opds   *opdsCatalog
+
+	opening singleflight.Group // Publications being opened, by URL
+
+	iiif    *cache.LRU
+	iiifSem chan struct{}
+
+	rewritten *cache.LRU // Sanitized documents and documents with injected elements
+
+	draining atomic.Bool
+	ready    readinessCache
+	metrics  *serverMetrics
 }
 
 const MaxCachedPublicationAmount = 10
@@ -62,9 +92,68 @@ func NewServer(config ServerConfig, remote Remote) *Server {
 	if config.Auth == nil {
 		config.Auth = auth.NewB64EncodedAuthProvider()
 	}
-	return &Server{
-		config: config,
-		remote: remote,
-		lfu:    cache.NewTinyLFU(MaxCachedPublicationAmount, MaxCachedPublicationTTL),
+	if config.MaxRanges <= 0 {
+		config.MaxRanges = DefaultMaxRanges
+	}
+	if config.IIIFMaxSize <= 0 {
+		config.IIIFMaxSize = DefaultIIIFMaxSize
+	}
+	if config.IIIFCacheSize <= 0 {
+		config.IIIFCacheSize = DefaultIIIFCacheSize
+	}
+	if len(config.CORS.AllowedOrigins) == 0 {
+		config.CORS.AllowedOrigins = []string{"*"}
+	}
+	if config.CORS.ExposedHeaders == nil {
+		config.CORS.ExposedHeaders = DefaultCORSExposedHeaders
+	}
+	if config.AccessLog.Publication == "" {
+		config.AccessLog.Publication = AccessLogPublicationHash
+	}
+	s := &Server{
+		config:  config,
+		remote:  remote,
+		lfu:     cache.NewTinyLFU(MaxCachedPublicationAmount, MaxCachedPublicationTTL),
+		iiif:    cache.NewLRU(config.IIIFCacheSize, iiifCacheTTL),
+		iiifSem: make(chan struct{}, runtime.GOMAXPROCS(0)),
+
+		rewritten: cache.NewLRU(rewrittenCacheSize, rewrittenCacheTTL),
+	}
+	if config.OPDS != nil {
+		opds := *config.OPDS
+		s.config.OPDS = &opds
+		if s.config.OPDS.ItemsPerPage <= 0 {
+			s.config.OPDS.ItemsPerPage = DefaultOPDSItemsPerPage
+		}
+		if s.config.OPDS.TokenTTL <= 0 {
+			s.config.OPDS.TokenTTL = DefaultOPDSTokenTTL
+		}
+		s.opds = newOPDSCatalog()
+	}
+	s.metrics = newServerMetrics(s)
+	return s
+}
+
+// Drain makes the health check report the server as unhealthy, so that load
+// balancers stop sending it new requests before it's shut down.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Close evicts all the cached publications, closing them along with their
+// remote readers. It must be called once the HTTP server has stopped serving
+// requests.
+func (s *Server) Close() {
+	s.purgeCaches()
+}
+
+// Evict all the cached publications, images, documents and feed entries. Publications
+// used by requests are closed once they're done.
+func (s *Server) purgeCaches() {
+	s.lfu.Purge()
+	s.iiif.Purge()
+	s.rewritten.Purge()
+	if s.opds != nil {
+		s.opds.entries.Purge()
 	}
 }
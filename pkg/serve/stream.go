@@ -0,0 +1,130 @@
+package serve
+
+import (
+	"compress/flate"
+	"context"
+	"io"
+
+	httprange "github.com/gotd/contrib/http_range"
+	"github.com/pkg/errors"
+	"github.com/readium/go-toolkit/pkg/archive"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+)
+
+// Size of the chunks remote resources are read in when streamed to a client.
+// At most one chunk per request is held in memory at any given time.
+const RemoteStreamChunkSize = 256 * 1024
+
+// contextWriter stops writing as soon as its context is done, which happens
+// when the client's connection is closed. Since writes to the client block
+// until they're accepted by the connection, this also provides back-pressure
+// to the reads from the resource.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+// Write a range of the bytes of a resource to w, or the whole resource if the
+// range is nil.
+func writeResourceRange(ctx context.Context, w io.Writer, res fetcher.Resource, remote bool, rng *httprange.Range) *fetcher.ResourceError {
+	w = &contextWriter{ctx: ctx, w: w}
+
+	if cres, ok := res.(fetcher.CompressedResource); remote && ok && cres.CompressedAs(archive.CompressionMethodDeflate) {
+		return writeInflatedRange(ctx, w, cres, rng)
+	}
+
+	var start, end int64
+	if rng != nil {
+		start, end = rng.Start, rng.Start+rng.Length-1
+		if end == 0 {
+			// Resources are read whole when both start and end are 0, so the
+			// first byte is taken from the first two
+			bin, rerr := res.Read(ctx, 0, 1)
+			if rerr != nil {
+				return rerr
+			}
+			if _, err := w.Write(bin[:min(len(bin), 1)]); err != nil {
+				return fetcher.Other(err)
+			}
+			return nil
+		}
+	}
+
+	if !remote {
+		// Local resources are streamed directly
+		_, rerr := res.Stream(ctx, w, start, end)
+		return rerr
+	}
+
+	if rng == nil {
+		length, rerr := res.Length(ctx)
+		if rerr != nil {
+			return rerr
+		}
+		if length == 0 {
+			return nil
+		}
+		end = length - 1
+	}
+
+	// Remote resources that are stored as-is are read in bounded chunks,
+	// each of them requested only once the previous one was written.
+	for offset := start; offset <= end; offset += RemoteStreamChunkSize {
+		chunkEnd := min(offset+RemoteStreamChunkSize-1, end)
+		bin, rerr := res.Read(ctx, offset, chunkEnd)
+		if rerr != nil {
+			return rerr
+		}
+		if _, err := w.Write(bin); err != nil {
+			return fetcher.Other(err)
+		}
+	}
+	return nil
+}
+
+// Write a range of the bytes of a remote resource stored deflated, or the
+// whole resource if the range is nil. It has to be inflated sequentially, so
+// it's inflated from its raw compressed stream instead of being read in
+// chunks, which would require inflating the beginning of the resource for
+// each of them. Unlike the resource's own Stream, which reads the whole
+// compressed resource in memory first, only the buffers of the inflater are
+// held in memory.
+func writeInflatedRange(ctx context.Context, w io.Writer, cres fetcher.CompressedResource, rng *httprange.Range) *fetcher.ResourceError {
+	pr, pw := io.Pipe()
+	go func() {
+		if _, rerr := cres.StreamCompressed(ctx, pw); rerr != nil {
+			pw.CloseWithError(rerr)
+			return
+		}
+		pw.Close()
+	}()
+	// Stops the compressed stream if the inflated one stops early
+	defer pr.Close()
+
+	fr := flate.NewReader(pr)
+	defer fr.Close()
+
+	var err error
+	if rng == nil {
+		_, err = io.Copy(w, fr)
+	} else {
+		if _, err = io.CopyN(io.Discard, fr, rng.Start); err == nil {
+			_, err = io.CopyN(w, fr, rng.Length)
+		}
+	}
+	if err != nil {
+		var rerr *fetcher.ResourceError
+		if errors.As(err, &rerr) {
+			return rerr
+		}
+		return fetcher.Other(err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package serve
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/readium/cli/pkg/serve/filewatch"
+)
+
+// CertificateReloader provides a TLS certificate loaded from files, and
+// reloads it when the files change on disk, such as when it's renewed.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	watcher  *filewatch.Watcher
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	var err error
+	r.watcher, err = filewatch.New([]string{certFile, keyFile}, r.load)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertificateReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed loading TLS certificate")
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files have changed. If reloading fails, the previous certificate is kept.
+// It's meant to be used as the GetCertificate function of a tls.Config.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if reloaded, err := r.watcher.Check(); err != nil {
+		// The files may be in the middle of being replaced
+		slog.Warn("failed reloading TLS certificate, keeping the current one", "error", err)
+	} else if reloaded {
+		slog.Info("TLS certificate reloaded", "cert", r.certFile)
+	}
+	return r.cert.Load(), nil
+}
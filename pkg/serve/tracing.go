@@ -0,0 +1,107 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const DefaultTracingServiceName = "readium"
+
+// Tracer of the server, using the global tracer provider
+var tracer = otel.Tracer("github.com/readium/cli/pkg/serve")
+
+type TracingConfig struct {
+	Endpoint    string  // URL of the OTLP/HTTP collector, such as http://localhost:4318. Defaults to the OTEL_EXPORTER_OTLP_* environment variables
+	ServiceName string  // Name of the service in traces, unless set with OTEL_SERVICE_NAME
+	SampleRatio float64 // Ratio of the traces sampled, unless the parent of a trace is sampled
+	Version     string  // Version of the service
+}
+
+// NewTracerProvider returns a tracer provider exporting spans to an OTLP/HTTP
+// collector. It must be shut down to flush the remaining spans.
+func NewTracerProvider(ctx context.Context, config TracingConfig) (*sdktrace.TracerProvider, error) {
+	var opts []otlptracehttp.Option
+	if config.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(config.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating OTLP exporter")
+	}
+
+	if config.ServiceName == "" {
+		config.ServiceName = DefaultTracingServiceName
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", config.ServiceName)}
+	if config.Version != "" {
+		attrs = append(attrs, attribute.String("service.version", config.Version))
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attrs...),
+		resource.WithFromEnv(), // OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating tracing resource")
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	), nil
+}
+
+// Middleware starting a span for each request, named after the template of
+// its route. The trace context of the request is extracted with the global
+// propagator.
+func (s *Server) tracingMiddleware(next http.Handler) http.Handler {
+	routed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("url.path", redactedPath(r)))
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				span.SetAttributes(attribute.String("http.route", tmpl))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(routed, "readium",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if cr := mux.CurrentRoute(r); cr != nil {
+				if tmpl, err := cr.GetPathTemplate(); err == nil {
+					return r.Method + " " + tmpl
+				}
+			}
+			return r.Method
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			// Health checks would drown out the other requests
+			if cr := mux.CurrentRoute(r); cr != nil && isProbeRoute(cr.GetName()) {
+				return false
+			}
+			return true
+		}),
+	)
+}
+
+// End a span, recording the error that occurred in it, if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,115 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Records the spans ended with the global tracer provider during a test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+		provider.Shutdown(t.Context())
+	})
+	return recorder
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := recordSpans(t)
+	h := NewServer(ServerConfig{}, Remote{}).Routes()
+
+	tests := []struct {
+		method string
+		path   string
+		span   string // Empty if no span is expected
+		route  string
+	}{
+		{http.MethodGet, "/version", "GET /version", "/version"},
+		{http.MethodHead, "/version", "HEAD /version", "/version"},
+		{http.MethodGet, "/unknown", "GET", ""},
+		// Probes aren't traced
+		{http.MethodGet, "/health", "", ""},
+		{http.MethodGet, "/ready", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			before := len(recorder.Ended())
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+			spans := recorder.Ended()[before:]
+			if tt.span == "" {
+				if len(spans) != 0 {
+					t.Fatalf("got %d spans, expected none", len(spans))
+				}
+				return
+			}
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, expected 1", len(spans))
+			}
+			if spans[0].Name() != tt.span {
+				t.Errorf("got span %q, expected %q", spans[0].Name(), tt.span)
+			}
+			attrs := map[string]string{}
+			for _, kv := range spans[0].Attributes() {
+				attrs[string(kv.Key)] = kv.Value.Emit()
+			}
+			if attrs["url.path"] != tt.path {
+				t.Errorf("got url.path %q, expected %q", attrs["url.path"], tt.path)
+			}
+			if attrs["http.route"] != tt.route {
+				t.Errorf("got http.route %q, expected %q", attrs["http.route"], tt.route)
+			}
+		})
+	}
+}
+
+func TestTracingParent(t *testing.T) {
+	recorder := recordSpans(t)
+	h := NewServer(ServerConfig{}, Remote{}).Routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, expected 1", len(spans))
+	}
+	if id := spans[0].SpanContext().TraceID().String(); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got trace ID %s, expected the one of the parent", id)
+	}
+	if id := spans[0].Parent().SpanID().String(); id != "00f067aa0ba902b7" {
+		t.Errorf("got parent span ID %s", id)
+	}
+}
+
+func TestRedactedPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		vars     map[string]string
+		expected string
+	}{
+		{"/version", nil, "/version"},
+		{"/webpub/dG9rZW4/manifest.json", map[string]string{"path": "dG9rZW4"}, "/webpub/-/manifest.json"},
+		{"/webpub/dG9rZW4/OEBPS/dG9rZW4.xhtml", map[string]string{"path": "dG9rZW4", "asset": "OEBPS/dG9rZW4.xhtml"}, "/webpub/-/OEBPS/dG9rZW4.xhtml"},
+		{"/webpub/", map[string]string{"path": ""}, "/webpub/"},
+	}
+	for _, tt := range tests {
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, tt.path, nil), tt.vars)
+		if got := redactedPath(r); got != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.path, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package webp
+
+import (
+	"cmp"
+	"math/bits"
+	"slices"
+)
+
+const (
+	numLiteralCodes  = 256
+	numLengthCodes   = 24
+	numDistanceCodes = 40
+
+	// Number of distance codes mapped to the neighborhood of pixels
+	numDistanceMapCodes = 120
+
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 7
+)
+
+// LZ77 parameters
+const (
+	minMatchLength = 3
+	maxMatchLength = 4096
+	maxDistance    = 1<<20 - numDistanceMapCodes
+	hashBits       = 16
+	maxChainLength = 32
+)
+
+// Order in which the lengths of the code length code are written
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// A literal pixel, or a backward reference when length is positive.
+type token struct {
+	argb     uint32
+	length   int
+	distance int
+}
+
+// Encode the pixels of an image, without color cache. Only the main image
+// can have meta prefix codes, which are not used.
+func encodeImage(bw *bitWriter, argb []uint32, width int, topLevel bool) {
+	tokens := backwardReferences(argb, width)
+
+	var histograms [5][]uint32
+	histograms[0] = make([]uint32, numLiteralCodes+numLengthCodes)
+	histograms[1] = make([]uint32, numLiteralCodes)
+	histograms[2] = make([]uint32, numLiteralCodes)
+	histograms[3] = make([]uint32, numLiteralCodes)
+	histograms[4] = make([]uint32, numDistanceCodes)
+	for _, t := range tokens {
+		if t.length > 0 {
+			code, _, _ := prefixEncode(t.length)
+			histograms[0][numLiteralCodes+code]++
+			code, _, _ = prefixEncode(t.distance)
+			histograms[4][code]++
+			continue
+		}
+		histograms[0][t.argb>>8&0xff]++
+		histograms[1][t.argb>>16&0xff]++
+		histograms[2][t.argb&0xff]++
+		histograms[3][t.argb>>24]++
+	}
+
+	bw.write(0, 1) // No color cache
+	if topLevel {
+		bw.write(0, 1) // No meta prefix codes
+	}
+	var codes [5]*prefixCode
+	for i, h := range histograms {
+		codes[i] = newPrefixCode(h, maxCodeLength)
+		codes[i].writeTo(bw)
+	}
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			code, n, extra := prefixEncode(t.length)
+			codes[0].writeSymbol(bw, numLiteralCodes+code)
+			bw.write(extra, n)
+			code, n, extra = prefixEncode(t.distance)
+			codes[4].writeSymbol(bw, code)
+			bw.write(extra, n)
+			continue
+		}
+		codes[0].writeSymbol(bw, int(t.argb>>8&0xff))
+		codes[1].writeSymbol(bw, int(t.argb>>16&0xff))
+		codes[2].writeSymbol(bw, int(t.argb&0xff))
+		codes[3].writeSymbol(bw, int(t.argb>>24))
+	}
+}
+
+// Find backward references to repeated sequences of pixels, with hash
+// chains on pairs of pixels.
+func backwardReferences(argb []uint32, width int) []token {
+	hash := func(i int) uint32 {
+		return (argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(argb))
+	insert := func(i int) {
+		if i+1 < len(argb) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	tokens := make([]token, 0, len(argb)/2)
+	for i := 0; i < len(argb); {
+		bestLength, bestDistance := 0, 0
+		if i+minMatchLength <= len(argb) {
+			limit := min(maxMatchLength, len(argb)-i)
+			for j, n := head[hash(i)], 0; j >= 0 && n < maxChainLength && i-int(j) <= maxDistance; j, n = prev[j], n+1 {
+				length := 0
+				for length < limit && argb[int(j)+length] == argb[i+length] {
+					length++
+				}
+				if length > bestLength {
+					bestLength, bestDistance = length, i-int(j)
+					if length == limit {
+						break
+					}
+				}
+			}
+		}
+		if bestLength < minMatchLength {
+			tokens = append(tokens, token{argb: argb[i]})
+			insert(i)
+			i++
+			continue
+		}
+		tokens = append(tokens, token{length: bestLength, distance: distanceCode(bestDistance, width)})
+		for k := range bestLength {
+			insert(i + k)
+		}
+		i += bestLength
+	}
+	return tokens
+}
+
+// Distance code of a backward reference, using the codes of the pixels above
+// and to the left.
+func distanceCode(distance, width int) int {
+	switch distance {
+	case width:
+		return 1
+	case 1:
+		return 2
+	}
+	return distance + numDistanceMapCodes
+}
+
+// Prefix code and extra bits of a length or distance code.
+func prefixEncode(v int) (code int, n uint, extra uint32) {
+	v--
+	if v < 4 {
+		return v, 0, 0
+	}
+	highest := bits.Len(uint(v)) - 1
+	second := (v >> (highest - 1)) & 1
+	n = uint(highest - 1)
+	return 2*highest + second, n, uint32(v) & (1<<n - 1)
+}
+
+// Canonical prefix (Huffman) code of an alphabet.
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16 // Bit-reversed, as they're written least significant bit first
+	symbols []int    // Symbols with a code
+}
+
+// Build a prefix code from the histogram of the symbols, with codes no
+// longer than a limit.
+func newPrefixCode(histogram []uint32, limit int) *prefixCode {
+	c := &prefixCode{
+		lengths: make([]uint8, len(histogram)),
+		codes:   make([]uint16, len(histogram)),
+	}
+	for s, n := range histogram {
+		if n > 0 {
+			c.symbols = append(c.symbols, s)
+		}
+	}
+	if len(c.symbols) < 2 {
+		// A single symbol is written with no bits
+		return c
+	}
+
+	counts := slices.Clone(histogram)
+	for !c.buildLengths(counts, limit) {
+		// Flatten the distribution until the codes are short enough
+		for s, n := range counts {
+			if n > 0 {
+				counts[s] = (n + 1) / 2
+			}
+		}
+	}
+
+	// Codes are assigned in order of length, then of symbol
+	var count [maxCodeLength + 1]int
+	for _, s := range c.symbols {
+		count[c.lengths[s]]++
+	}
+	var next [maxCodeLength + 1]int
+	code := 0
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for _, s := range c.symbols {
+		l := c.lengths[s]
+		c.codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+		next[l]++
+	}
+	return c
+}
+
+// Compute the code lengths of a Huffman tree of the symbols, returning false
+// if they are longer than the limit.
+func (c *prefixCode) buildLengths(counts []uint32, limit int) bool {
+	type node struct {
+		count       uint64
+		symbol      int
+		left, right int
+	}
+	nodes := make([]node, 0, 2*len(c.symbols))
+	for _, s := range c.symbols {
+		nodes = append(nodes, node{count: uint64(counts[s]), symbol: s, left: -1, right: -1})
+	}
+	slices.SortStableFunc(nodes, func(a, b node) int {
+		return cmp.Compare(a.count, b.count)
+	})
+
+	// Two queues: the sorted leaves, and the internal nodes, which are
+	// created in order of count
+	leaf, internal := 0, len(nodes)
+	pop := func() int {
+		if leaf < len(c.symbols) && (internal >= len(nodes) || nodes[leaf].count <= nodes[internal].count) {
+			leaf++
+			return leaf - 1
+		}
+		internal++
+		return internal - 1
+	}
+	for range len(c.symbols) - 1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, symbol: -1, left: a, right: b})
+	}
+
+	ok := true
+	var walk func(i, depth int)
+	walk = func(i, depth int) {
+		if n := nodes[i]; n.symbol >= 0 {
+			ok = ok && depth <= limit
+			c.lengths[n.symbol] = uint8(depth)
+		} else {
+			walk(n.left, depth+1)
+			walk(n.right, depth+1)
+		}
+	}
+	walk(len(nodes)-1, 0)
+	return ok
+}
+
+func (c *prefixCode) writeSymbol(bw *bitWriter, s int) {
+	bw.write(uint32(c.codes[s]), uint(c.lengths[s]))
+}
+
+// Write the code lengths of a prefix code.
+func (c *prefixCode) writeTo(bw *bitWriter) {
+	if len(c.symbols) < 2 {
+		// Simple code with a single symbol, which must fit in 8 bits
+		s := 0
+		if len(c.symbols) == 1 {
+			s = c.symbols[0]
+		}
+		bw.write(1, 1)
+		bw.write(0, 1)
+		if s < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(s), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(s), 8)
+		}
+		return
+	}
+
+	// Run-length encoding of the code lengths, with the repeat codes 16 (the
+	// previous length 3 to 6 times), 17 (zero 3 to 10 times) and 18 (zero 11
+	// to 138 times)
+	type codeLength struct {
+		code  int
+		extra uint32
+		n     uint
+	}
+	var rle []codeLength
+	for i := 0; i < len(c.lengths); {
+		l := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 11 {
+				r := min(run, 138)
+				rle = append(rle, codeLength{18, uint32(r - 11), 7})
+				run -= r
+			}
+			if run >= 3 {
+				rle = append(rle, codeLength{17, uint32(run - 3), 3})
+				run = 0
+			}
+		} else {
+			rle = append(rle, codeLength{code: int(l)})
+			run--
+			for run >= 3 {
+				r := min(run, 6)
+				rle = append(rle, codeLength{16, uint32(r - 3), 2})
+				run -= r
+			}
+		}
+		for range run {
+			rle = append(rle, codeLength{code: int(l)})
+		}
+	}
+
+	histogram := make([]uint32, len(codeLengthCodeOrder))
+	for _, cl := range rle {
+		histogram[cl.code]++
+	}
+	clc := newPrefixCode(histogram, maxCodeLengthCodeLength)
+	if len(clc.symbols) == 1 {
+		// The only code length is read with no bits, but must be declared
+		clc.lengths[clc.symbols[0]] = 1
+	}
+	n := 4
+	for i, s := range codeLengthCodeOrder {
+		if clc.lengths[s] > 0 {
+			n = max(n, i+1)
+		}
+	}
+	bw.write(0, 1) // Normal code
+	bw.write(uint32(n-4), 4)
+	for _, s := range codeLengthCodeOrder[:n] {
+		bw.write(uint32(clc.lengths[s]), 3)
+	}
+	if len(clc.symbols) == 1 {
+		clc.lengths[clc.symbols[0]] = 0
+	}
+
+	bw.write(0, 1) // All the symbols of the alphabet are coded
+	for _, cl := range rle {
+		clc.writeSymbol(bw, cl.code)
+		bw.write(cl.extra, cl.n)
+	}
+}
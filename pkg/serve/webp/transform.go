@@ -0,0 +1,170 @@
+package webp
+
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+)
+
+// Log2 of the width and height of the tiles of the predictor transform
+const predictorBits = 5
+
+// Predictor modes tried for each tile, the others are rarely better
+var predictorModes = []uint32{1, 2, 7, 11, 12}
+
+// Subtract the green channel from the red and blue ones.
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := ((p >> 16) - g) & 0xff
+		b := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// Apply the predictor transform, choosing the mode of each tile which gives
+// the smallest residuals. The modes are written as a sub-image, and the
+// residuals are returned.
+func applyPredictor(bw *bitWriter, argb []uint32, width, height int) []uint32 {
+	tile := 1 << predictorBits
+	tilesX := (width + tile - 1) >> predictorBits
+	tilesY := (height + tile - 1) >> predictorBits
+	modes := make([]uint32, tilesX*tilesY)
+	for ty := range tilesY {
+		for tx := range tilesX {
+			best, bestCost := predictorModes[0], -1
+			for _, mode := range predictorModes {
+				cost := 0
+				for y := ty * tile; y < min((ty+1)*tile, height); y++ {
+					for x := tx * tile; x < min((tx+1)*tile, width); x++ {
+						cost += residualCost(subPixels(argb[y*width+x], predict(argb, width, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			// The mode is stored in the green channel
+			modes[ty*tilesX+tx] = 0xff000000 | best<<8
+		}
+	}
+	encodeImage(bw, modes, tilesX, false)
+
+	residuals := make([]uint32, len(argb))
+	for y := range height {
+		for x := range width {
+			mode := modes[(y>>predictorBits)*tilesX+(x>>predictorBits)] >> 8 & 0xf
+			residuals[y*width+x] = subPixels(argb[y*width+x], predict(argb, width, x, y, mode))
+		}
+	}
+	return residuals
+}
+
+// Cost of the residual of a pixel, the sum of the absolute values of its
+// channels.
+func residualCost(p uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		cost += int(min(uint8(p>>shift), -uint8(p>>shift)))
+	}
+	return cost
+}
+
+// Prediction of a pixel, from its left (L), top (T), top-left (TL) and
+// top-right (TR) neighbors.
+func predict(argb []uint32, width, x, y int, mode uint32) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+	l, t, tl := argb[i-1], argb[i-width], argb[i-width-1]
+	// The TR pixel of the rightmost column is the leftmost one of the row
+	tr := argb[i-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		return selectPixel(l, t, tl)
+	case 12:
+		return mapChannels(func(shift int) uint32 {
+			return clamp(channel(l, shift) + channel(t, shift) - channel(tl, shift))
+		})
+	default:
+		avg := average2(l, t)
+		return mapChannels(func(shift int) uint32 {
+			return clamp(channel(avg, shift) + (channel(avg, shift)-channel(tl, shift))/2)
+		})
+	}
+}
+
+func channel(p uint32, shift int) int {
+	return int(p>>shift) & 0xff
+}
+
+func clamp(v int) uint32 {
+	return uint32(min(max(v, 0), 255))
+}
+
+func mapChannels(f func(shift int) uint32) uint32 {
+	var p uint32
+	for shift := 0; shift < 32; shift += 8 {
+		p |= f(shift) << shift
+	}
+	return p
+}
+
+// Per-channel average, rounded down.
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// Either L or T, whichever is closer to the gradient L + T - TL.
+func selectPixel(l, t, tl uint32) uint32 {
+	pl, pt := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		pl += abs(channel(t, shift) - channel(tl, shift))
+		pt += abs(channel(l, shift) - channel(tl, shift))
+	}
+	if pl < pt {
+		return l
+	}
+	return t
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Per-channel difference, modulo 256.
+func subPixels(a, b uint32) uint32 {
+	ag := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	rb := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return ag&0xff00ff00 | rb&0x00ff00ff
+}
@@ -0,0 +1,108 @@
+// Package webp implements an encoder of lossless WebP images (VP8L), as
+// specified in https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification.
+//
+// The encoder applies the subtract-green and predictor transforms, and
+// compresses the pixels with LZ77 backward references and a single group of
+// prefix codes. It favors simplicity over the compression ratio of libwebp.
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// Max width and height of a WebP image
+const MaxSize = 1 << 14
+
+// Encode writes an image to w in the lossless WebP format.
+func Encode(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 {
+		return errors.New("webp: image is empty")
+	}
+	if width > MaxSize || height > MaxSize {
+		return errors.New("webp: image is too large to be encoded")
+	}
+
+	nrgba, ok := m.(*image.NRGBA)
+	if !ok || nrgba.Rect.Min != (image.Point{}) || nrgba.Stride != 4*width {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Bounds(), m, b.Min, draw.Src)
+	}
+	argb := make([]uint32, width*height)
+	alpha := false
+	for i := range argb {
+		p := nrgba.Pix[4*i : 4*i+4 : 4*i+4]
+		argb[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		alpha = alpha || p[3] != 0xff
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8) // Signature
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3) // Version
+
+	// The transforms are inverted by decoders in the reverse order
+	bw.write(1, 1)
+	bw.write(transformSubtractGreen, 2)
+	subtractGreen(argb)
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	bw.write(predictorBits-2, 3)
+	argb = applyPredictor(bw, argb, width, height)
+	bw.write(0, 1)
+
+	encodeImage(bw, argb, width, true)
+	data := bw.bytes()
+
+	// RIFF container, with chunks padded to an even size
+	size := len(data) + len(data)&1
+	header := make([]byte, 0, 20)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(4+8+size))
+	header = append(header, "WEBPVP8L"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(data) < size {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Writer of the bits of a VP8L bitstream, least significant bit first.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.bits |= uint64(v) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.nBits = 0, 0
+	}
+	return w.buf
+}
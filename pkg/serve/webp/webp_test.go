@@ -0,0 +1,127 @@
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"math/rand/v2"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// Images filled pixel by pixel.
+func fill(width, height int, at func(x, y int) color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.SetNRGBA(x, y, at(x, y))
+		}
+	}
+	return img
+}
+
+func gradient(width, height int) *image.NRGBA {
+	return fill(width, height, func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x), uint8(y), uint8(x + y), 0xff}
+	})
+}
+
+func noise(width, height int, alpha bool) *image.NRGBA {
+	r := rand.New(rand.NewPCG(1, 2))
+	return fill(width, height, func(x, y int) color.NRGBA {
+		c := color.NRGBA{uint8(r.Uint32()), uint8(r.Uint32()), uint8(r.Uint32()), 0xff}
+		if alpha {
+			c.A = uint8(r.Uint32())
+		}
+		return c
+	})
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	stripes := fill(97, 61, func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x / 8 * 40), 0x80, uint8(y % 3 * 100), 0xff}
+	})
+	paletted := image.NewPaletted(image.Rect(0, 0, 50, 40), palette.Plan9)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i * 7)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 33, 17))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	// An image whose bounds don't start at the origin
+	offset := gradient(40, 40).SubImage(image.Rect(5, 7, 35, 30))
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"single pixel", gradient(1, 1)},
+		{"single column", gradient(1, 300)},
+		{"single row", gradient(300, 1)},
+		{"solid", fill(64, 64, func(x, y int) color.NRGBA { return color.NRGBA{0x12, 0x34, 0x56, 0xff} })},
+		{"transparent", fill(10, 10, func(x, y int) color.NRGBA { return color.NRGBA{} })},
+		{"gradient", gradient(256, 256)},
+		{"large", gradient(1500, 1000)},
+		{"odd size", gradient(123, 45)},
+		{"stripes", stripes},
+		{"noise", noise(200, 150, false)},
+		{"noise with alpha", noise(200, 150, true)},
+		{"half transparent", fill(80, 60, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), 0x40, uint8(x * y)} })},
+		{"paletted", paletted},
+		{"gray", gray},
+		{"offset", offset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, tt.img); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("failed decoding: %v", err)
+			}
+
+			b := tt.img.Bounds()
+			if decoded.Bounds().Dx() != b.Dx() || decoded.Bounds().Dy() != b.Dy() {
+				t.Fatalf("got size %v, expected %v", decoded.Bounds().Size(), b.Size())
+			}
+			expected := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(expected, expected.Bounds(), tt.img, b.Min, draw.Src)
+			for y := range b.Dy() {
+				for x := range b.Dx() {
+					got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+					if e := expected.NRGBAAt(x, y); got != e {
+						t.Fatalf("pixel (%d, %d) is %v, expected %v", x, y, got, e)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeConfig(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, noise(30, 20, true)); err != nil {
+		t.Fatal(err)
+	}
+	config, err := webp.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 30 || config.Height != 20 {
+		t.Errorf("got size %dx%d, expected 30x20", config.Width, config.Height)
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 10), image.Rect(0, 0, MaxSize+1, 1)} {
+		if err := Encode(&bytes.Buffer{}, image.NewGray(r)); err == nil {
+			t.Errorf("encoded an image of size %v", r.Size())
+		}
+	}
+}